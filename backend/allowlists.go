@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An allowlist keeps a port open to the ranges a provider publishes, such
+// as a CDN's edge networks or a CI service's runners. The ranges are
+// fetched like blocklist feeds and expanded into one allow rule per range,
+// commented "allowlist <name>". Since a broken or truncated source would
+// close the port, a sync that yields no ranges, or drops more than
+// max_shrink_percent of them at once, is refused.
+
+const (
+	allowlistsFile         = "allowlists.json"
+	maxAllowlistEntries    = 2000
+	defaultAllowlistShrink = 50
+	allowlistCommentPrefix = "allowlist "
+)
+
+var reAllowlistName = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,32}$`)
+
+type allowlist struct {
+	Name             string    `json:"name"`
+	Source           string    `json:"source"`
+	JSONPaths        []string  `json:"json_paths,omitempty"`
+	PortProtocol     string    `json:"port_protocol"`
+	Interval         string    `json:"interval"`
+	MaxShrinkPercent int       `json:"max_shrink_percent"`
+	CreatedBy        string    `json:"created_by,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+
+	// Entries are the ranges whose rules are currently applied, Owned
+	// those whose rule the allowlist added itself.
+	Entries     []string   `json:"entries"`
+	Owned       []string   `json:"owned,omitempty"`
+	LastSync    *time.Time `json:"last_sync,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Skipped     int        `json:"skipped"`
+	Added       int        `json:"added"`
+	Removed     int        `json:"removed"`
+
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	interval time.Duration
+	timer    *time.Timer
+	nextSync time.Time
+	syncing  bool
+	// force lets the next sync apply a shrunken list.
+	force bool
+}
+
+var (
+	allowlistMu sync.Mutex
+	allowlists  = map[string]*allowlist{}
+)
+
+func (a *allowlist) binding() *groupBinding {
+	return &groupBinding{Action: "allow", PortProtocol: a.PortProtocol, Comment: allowlistCommentPrefix + a.Name, Owned: a.Owned}
+}
+
+// jsonPathValues collects the strings found at path in v. Arrays are walked
+// at every level, so "prefixes.ip_prefix" reads the field of each object in
+// the prefixes array.
+func jsonPathValues(v any, path []string, out *[]string) {
+	switch t := v.(type) {
+	case []any:
+		for _, e := range t {
+			jsonPathValues(e, path, out)
+		}
+	case map[string]any:
+		if len(path) > 0 {
+			if next, ok := t[path[0]]; ok {
+				jsonPathValues(next, path[1:], out)
+			}
+		}
+	case string:
+		if len(path) == 0 {
+			*out = append(*out, t)
+		}
+	}
+}
+
+// parseAllowlistEntries extracts the ranges of a source: from the JSON
+// fields at paths if any are set, otherwise from plain text as for feeds.
+// The result is canonical, sorted and without duplicates.
+func parseAllowlistEntries(body []byte, paths []string) ([]string, int, error) {
+	var v4, v6 []string
+	skipped := 0
+	if len(paths) == 0 {
+		v4, v6, skipped = parseFeedEntries(body)
+	} else {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, 0, fmt.Errorf("invalid JSON: %w", err)
+		}
+		var values []string
+		for _, p := range paths {
+			jsonPathValues(doc, strings.Split(p, "."), &values)
+		}
+		for _, e := range values {
+			e = strings.TrimSpace(e)
+			switch feedEntryFamily(e) {
+			case "inet":
+				v4 = append(v4, e)
+			case "inet6":
+				v6 = append(v6, e)
+			default:
+				skipped++
+			}
+		}
+	}
+	n4, err := normalizeIPSetEntries("inet", v4)
+	if err != nil {
+		return nil, skipped, err
+	}
+	n6, err := normalizeIPSetEntries("inet6", v6)
+	if err != nil {
+		return nil, skipped, err
+	}
+	entries := append(n4, n6...)
+	if len(entries) > maxAllowlistEntries {
+		return nil, skipped, fmt.Errorf("source lists %d ranges, at most %d are allowed", len(entries), maxAllowlistEntries)
+	}
+	sort.Strings(entries)
+	return entries, skipped, nil
+}
+
+// checkShrink refuses an empty list, and unless force is set, one that
+// drops more than maxPercent of the current entries.
+func checkShrink(current, next, maxPercent int, force bool) error {
+	if next == 0 {
+		return errors.New("refusing to apply an empty list")
+	}
+	if force || current == 0 {
+		return nil
+	}
+	if lost := current - next; lost*100 > current*maxPercent {
+		return fmt.Errorf("refusing to shrink the list from %d to %d ranges (more than %d%%); sync with force=true to apply it", current, next, maxPercent)
+	}
+	return nil
+}
+
+func saveAllowlistsLocked() {
+	list := make([]*allowlist, 0, len(allowlists))
+	for _, a := range allowlists {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := writeJSONFile(dataPath(allowlistsFile), list); err != nil {
+		log.Printf("WARN: allowlists: failed to save %s: %v", allowlistsFile, err)
+	}
+}
+
+func armAllowlistTimerLocked(a *allowlist, delay time.Duration) {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	a.nextSync = time.Now().Add(delay).UTC()
+	name := a.Name
+	a.timer = time.AfterFunc(delay, func() { syncAllowlist(name) })
+}
+
+// syncAllowlist fetches the source and adds and deletes rules for the ranges
+// that changed. If a command fails or a protected port is left uncovered,
+// the previous firewall state is restored and the sync retried later.
+func syncAllowlist(name string) {
+	allowlistMu.Lock()
+	a := allowlists[name]
+	if a == nil || a.syncing {
+		allowlistMu.Unlock()
+		return
+	}
+	a.syncing = true
+	source, paths, etag, lastModified := a.Source, a.JSONPaths, a.ETag, a.LastModified
+	current, maxShrink, force := a.Entries, a.MaxShrinkPercent, a.force
+	b := a.binding()
+	a.force = false
+	allowlistMu.Unlock()
+
+	var entries []string
+	var skipped int
+	var add, remove []string
+	var owned [][]string
+	data, err := fetchSource(source, etag, lastModified)
+	if err == nil {
+		entries, skipped, err = parseAllowlistEntries(data.Body, paths)
+	}
+	if err == nil {
+		err = checkShrink(len(current), len(entries), maxShrink, force)
+	}
+	if err == nil {
+		add, remove = diffEntries(current, entries)
+		if len(add) > 0 || len(remove) > 0 {
+			err = auditSystem("sync allowlist "+name, func() error {
+				_, aerr := applyWithSnapshot("sync allowlist "+name, 0, func() error {
+					var err error
+					owned, err = expandGroupRules([]*groupBinding{b}, add, remove, false)
+					return err
+				})
+				return aerr
+			})
+		}
+	}
+
+	allowlistMu.Lock()
+	defer allowlistMu.Unlock()
+	a.syncing = false
+	if allowlists[name] != a {
+		return
+	}
+	now := time.Now().UTC()
+	a.LastSync = &now
+	switch {
+	case errors.Is(err, errNotModified):
+		a.LastSuccess, a.LastError = &now, ""
+		a.Added, a.Removed = 0, 0
+	case err != nil:
+		log.Printf("WARN: allowlist %s: sync failed: %v", name, err)
+		a.LastError = err.Error()
+	default:
+		if len(add) > 0 || len(remove) > 0 {
+			log.Printf("Allowlist %s synced: %d ranges, %d added, %d removed", name, len(entries), len(add), len(remove))
+		}
+		a.LastSuccess, a.LastError = &now, ""
+		a.Entries, a.Skipped, a.Added, a.Removed = entries, skipped, len(add), len(remove)
+		if owned != nil {
+			a.Owned = owned[0]
+		}
+		a.ETag, a.LastModified = data.ETag, data.LastModified
+	}
+	saveAllowlistsLocked()
+
+	delay := a.interval
+	if err != nil && !errors.Is(err, errNotModified) && feedRetryDelay < delay {
+		delay = feedRetryDelay
+	}
+	armAllowlistTimerLocked(a, delay)
+}
+
+// startAllowlists loads the saved allowlists and schedules their next sync.
+func startAllowlists() {
+	allowlistMu.Lock()
+	defer allowlistMu.Unlock()
+	var list []*allowlist
+	if _, err := readJSONFile(dataPath(allowlistsFile), &list); err != nil {
+		log.Printf("WARN: allowlists: ignoring unreadable %s: %v", allowlistsFile, err)
+		return
+	}
+	for _, a := range list {
+		d, err := time.ParseDuration(a.Interval)
+		if err != nil {
+			log.Printf("WARN: allowlist %s: invalid interval %q, using %s", a.Name, a.Interval, defaultFeedInterval)
+			d = defaultFeedInterval
+		}
+		a.interval = d
+		allowlists[a.Name] = a
+		delay := time.Duration(0)
+		if a.LastSync != nil {
+			delay = time.Until(a.LastSync.Add(d))
+		}
+		armAllowlistTimerLocked(a, delay)
+	}
+}
+
+func (a *allowlist) view(withEntries bool) gin.H {
+	out := gin.H{
+		"name":               a.Name,
+		"source":             a.Source,
+		"json_paths":         a.JSONPaths,
+		"port_protocol":      a.PortProtocol,
+		"comment":            allowlistCommentPrefix + a.Name,
+		"interval":           a.Interval,
+		"max_shrink_percent": a.MaxShrinkPercent,
+		"created_by":         a.CreatedBy,
+		"created_at":         a.CreatedAt,
+		"last_sync":          a.LastSync,
+		"last_success":       a.LastSuccess,
+		"last_error":         a.LastError,
+		"entries_count":      len(a.Entries),
+		"skipped":            a.Skipped,
+		"added":              a.Added,
+		"removed":            a.Removed,
+		"syncing":            a.syncing,
+		"next_sync":          a.nextSync,
+	}
+	if withEntries {
+		out["entries"] = a.Entries
+	}
+	return out
+}
+
+func registerAllowlistRoutes(rg *gin.RouterGroup) {
+	rg.GET("/allowlists", func(c *gin.Context) {
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		names := make([]string, 0, len(allowlists))
+		for name := range allowlists {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := []gin.H{}
+		for _, name := range names {
+			out = append(out, allowlists[name].view(false))
+		}
+		c.JSON(http.StatusOK, gin.H{"allowlists": out})
+	})
+
+	type CreateAllowlistRequest struct {
+		Name             string   `json:"name" binding:"required"`
+		Source           string   `json:"source" binding:"required"`
+		JSONPaths        []string `json:"json_paths"`
+		PortProtocol     string   `json:"port_protocol" binding:"required"`
+		Interval         string   `json:"interval"`
+		MaxShrinkPercent *int     `json:"max_shrink_percent"`
+	}
+	// POST /allowlists binds a source of ranges to a port. No rule is added
+	// until the first sync, which starts in the background.
+	rg.POST("/allowlists", func(c *gin.Context) {
+		var req CreateAllowlistRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reAllowlistName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid allowlist name", "details": "1-32 letters, digits or _.-"})
+			return
+		}
+		if err := validateSource(req.Source); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source", "details": err.Error()})
+			return
+		}
+		for _, p := range req.JSONPaths {
+			if strings.TrimSpace(p) == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid json_paths", "details": "paths cannot be empty"})
+				return
+			}
+		}
+		a := &allowlist{
+			Name:             req.Name,
+			Source:           req.Source,
+			JSONPaths:        req.JSONPaths,
+			PortProtocol:     strings.TrimSpace(req.PortProtocol),
+			MaxShrinkPercent: defaultAllowlistShrink,
+			CreatedBy:        c.GetString(ctxKeyName),
+			CreatedAt:        time.Now().UTC(),
+			Entries:          []string{},
+			interval:         defaultFeedInterval,
+		}
+		if _, err := a.binding().args("192.0.2.1"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid port_protocol", "details": err.Error()})
+			return
+		}
+		if req.MaxShrinkPercent != nil {
+			if *req.MaxShrinkPercent < 0 || *req.MaxShrinkPercent > 100 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_shrink_percent", "details": "must be between 0 and 100"})
+				return
+			}
+			a.MaxShrinkPercent = *req.MaxShrinkPercent
+		}
+		if req.Interval != "" {
+			d, err := time.ParseDuration(req.Interval)
+			if err != nil || d < minFeedInterval || d > maxFeedInterval {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval", "details": "interval must be between 5m and 168h"})
+				return
+			}
+			a.interval = d
+		}
+		a.Interval = a.interval.String()
+
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		if allowlists[a.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Allowlist already exists"})
+			return
+		}
+		allowlists[a.Name] = a
+		saveAllowlistsLocked()
+		armAllowlistTimerLocked(a, 0)
+		c.JSON(http.StatusOK, gin.H{"message": "Allowlist created; first sync started", "allowlist": a.view(false)})
+	})
+
+	rg.GET("/allowlists/:name", func(c *gin.Context) {
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		a := allowlists[c.Param("name")]
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Allowlist not found"})
+			return
+		}
+		c.JSON(http.StatusOK, a.view(true))
+	})
+
+	// POST /allowlists/:name/sync starts a sync now; with ?force=true it may
+	// apply a list that shrank beyond max_shrink_percent.
+	rg.POST("/allowlists/:name/sync", func(c *gin.Context) {
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		a := allowlists[c.Param("name")]
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Allowlist not found"})
+			return
+		}
+		if a.syncing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Sync already in progress"})
+			return
+		}
+		a.force = forceRequested(c)
+		if a.force {
+			// Fetch again even if the source is unchanged since the
+			// refused sync.
+			a.ETag, a.LastModified = "", ""
+		}
+		armAllowlistTimerLocked(a, 0)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Sync started", "name": a.Name})
+	})
+
+	// DELETE /allowlists/:name deletes the allowlist and its rules. Unless
+	// ?force=true it is refused if a protected port would be left uncovered.
+	rg.DELETE("/allowlists/:name", func(c *gin.Context) {
+		allowlistMu.Lock()
+		defer allowlistMu.Unlock()
+		a := allowlists[c.Param("name")]
+		if a == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Allowlist not found"})
+			return
+		}
+		if a.syncing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Sync in progress", "details": "try again once it has finished"})
+			return
+		}
+		if len(a.Entries) > 0 {
+			_, err := applyWithSnapshot("delete allowlist "+a.Name, 0, func() error {
+				_, err := expandGroupRules([]*groupBinding{a.binding()}, nil, a.Entries, forceRequested(c))
+				return err
+			})
+			if abortOnApplyError(c, err, "Failed to delete allowlist rules; previous state restored") {
+				return
+			}
+		}
+		if a.timer != nil {
+			a.timer.Stop()
+		}
+		delete(allowlists, a.Name)
+		saveAllowlistsLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Allowlist deleted successfully", "name": a.Name, "rules_removed": len(a.Owned)})
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// apiKey is a named client secret. UFW_API_KEY is named "default";
+// UFW_API_KEYS adds more as "name:secret,name2:secret2", so the audit log
+// can tell clients apart.
+type apiKey struct {
+	Name   string
+	Secret string
+}
+
+var reAPIKeyName = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,32}$`)
+
+var apiKeys []apiKey
+
+func loadAPIKeys() ([]apiKey, error) {
+	var keys []apiKey
+	seen := map[string]bool{}
+	add := func(name, secret string) error {
+		if !reAPIKeyName.MatchString(name) {
+			return fmt.Errorf("invalid API key name %q", name)
+		}
+		if secret == "" {
+			return fmt.Errorf("API key %q is empty", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate API key name %q", name)
+		}
+		seen[name] = true
+		keys = append(keys, apiKey{Name: name, Secret: secret})
+		return nil
+	}
+
+	if k := os.Getenv("UFW_API_KEY"); k != "" {
+		if err := add("default", k); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range strings.Split(os.Getenv("UFW_API_KEYS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("UFW_API_KEYS entries must be name:secret")
+		}
+		if err := add(strings.TrimSpace(name), strings.TrimSpace(secret)); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// lookupAPIKey returns the name of the key matching given.
+func lookupAPIKey(given string) (string, bool) {
+	if given == "" {
+		return "", false
+	}
+	name, found := "", false
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(k.Secret)) == 1 {
+			name, found = k.Name, true
+		}
+	}
+	return name, found
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+const apiRuleComment = "ufw-panel-api"
+
+// apiAllowedSources parses API_ALLOWED_SOURCES, the IPs/CIDRs that may reach
+// the API port. An empty result means the port stays open to everyone.
+func apiAllowedSources() ([]string, error) {
+	raw := os.Getenv("API_ALLOWED_SOURCES")
+	var sources []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if err := validateIPorCIDR(item); err != nil {
+			return nil, fmt.Errorf("API_ALLOWED_SOURCES: %w", err)
+		}
+		sources = append(sources, item)
+	}
+	return sources, nil
+}
+
+func bindAddress() (string, error) {
+	addr := strings.TrimSpace(os.Getenv("BIND_ADDRESS"))
+	if addr != "" && net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("BIND_ADDRESS must be an IP address: %s", addr)
+	}
+	return addr, nil
+}
+
+// ensureAPIPortRulesAudited runs ensureAPIPortRules as a system action; while
+// a change awaits confirmation it runs once the change is settled.
+func ensureAPIPortRulesAudited(port string, sources []string) {
+	err := auditSystem("ensure API port rules", func() error {
+		ensureAPIPortRules(port, sources)
+		return nil
+	})
+	if errors.Is(err, errChangePending) {
+		afterPendingChange(func() { ensureAPIPortRulesAudited(port, sources) })
+	}
+}
+
+// ensureAPIPortRules makes sure the API port is reachable. With allowed
+// sources configured it adds one rule per source and, only once all of them
+// are in place, removes the open-to-all rule and restricted rules for sources
+// that are no longer configured.
+func ensureAPIPortRules(port string, sources []string) {
+	apiRule := port + "/tcp"
+
+	if len(sources) == 0 {
+		log.Printf("Attempting to add allow rule for API port %s during startup...", apiRule)
+		if startupErr := AllowUFWPort(apiRule, ""); startupErr != nil {
+			if strings.Contains(startupErr.Error(), "Skipping adding existing rule") {
+				log.Printf("Rule for API port '%s' already exists or skipping message detected.", apiRule)
+			} else {
+				log.Printf("WARNING: Error adding allow rule for API port '%s' during startup: %v. Ensure the server is run with sudo if needed.", apiRule, startupErr)
+			}
+		} else {
+			log.Printf("Successfully added or ensured allow rule for API port: %s", apiRule)
+		}
+		return
+	}
+
+	log.Printf("Restricting API port %s to %v", apiRule, sources)
+	for _, src := range sources {
+		if err := AllowUFWFromIP(src, apiRule, apiRuleComment); err != nil {
+			log.Printf("WARNING: Failed to allow %s to API port %s: %v. Leaving existing API port rules untouched.", src, apiRule, err)
+			return
+		}
+	}
+
+	if _, err := runUFWForce("delete", "allow", apiRule); err != nil {
+		log.Printf("WARNING: Failed to remove open-to-all rule for API port %s: %v", apiRule, err)
+	}
+
+	removeStaleAPIPortRules(port, sources)
+}
+
+func removeStaleAPIPortRules(port string, sources []string) {
+	wanted := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		wanted[canonicalAddr(src)] = true
+	}
+
+	status, err := GetUFWStatus()
+	if err != nil {
+		log.Printf("WARNING: Failed to read rules while reconciling API port: %v", err)
+		return
+	}
+
+	var stale []int
+	for _, r := range parseStatusRules(status.Rules) {
+		if r.Comment != apiRuleComment || r.To != port+"/tcp" {
+			continue
+		}
+		if !wanted[canonicalAddr(r.From)] {
+			stale = append(stale, r.Number)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(stale)))
+	for _, n := range stale {
+		if err := DeleteUFWByNumber(fmt.Sprint(n)); err != nil {
+			log.Printf("WARNING: Failed to remove stale API port rule %d: %v", n, err)
+		} else {
+			log.Printf("Removed stale API port rule %d", n)
+		}
+	}
+}
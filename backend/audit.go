@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditFileName    = "audit.log"
+	headerRequestID  = "X-Request-ID"
+	ctxKeyName       = "apiKeyName"
+	ctxRequestID     = "requestID"
+	maxAuditLineSize = 16 << 20
+)
+
+var reRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+// auditCommand is one ufw invocation, or a configuration file written
+// directly ("write <path>"), made while handling an audited action.
+type auditCommand struct {
+	Argv     []string `json:"argv"`
+	ExitCode int      `json:"exit_code"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// auditEntry is one line of the audit log. Key is the API key name,
+// "cert:<CN>" for client certificates, or "system" for the backend's own
+// actions. Hash chains each entry to the previous one when
+// UFW_AUDIT_HASH_CHAIN is enabled.
+type auditEntry struct {
+	Seq       int64          `json:"seq"`
+	Time      time.Time      `json:"time"`
+	Key       string         `json:"key"`
+	ClientIP  string         `json:"client_ip,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Action    string         `json:"action"`
+	Path      string         `json:"path,omitempty"`
+	Status    int            `json:"status,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Commands  []auditCommand `json:"commands"`
+	Diff      string         `json:"diff,omitempty"`
+	PrevHash  string         `json:"prev_hash,omitempty"`
+	Hash      string         `json:"hash,omitempty"`
+}
+
+var (
+	// mutationMu serializes firewall changes, so every ufw command is
+	// attributed to exactly one audit entry.
+	mutationMu sync.Mutex
+
+	// pendingExemptRoutes are the requests served while a change awaits
+	// confirmation: settling it, and those that leave the firewall alone.
+	pendingExemptRoutes = map[string]bool{
+		"POST /confirm/:id":     true,
+		"POST /rollback/:id":    true,
+		"POST /jails/test":      true,
+		"POST /plans":           true,
+		"DELETE /plans/:id":     true,
+		"POST /snapshots":       true,
+		"DELETE /snapshots/:id": true,
+	}
+
+	auditMu       sync.Mutex
+	auditCurrent  *auditEntry
+	auditSeq      int64
+	auditLastHash string
+)
+
+func auditHashChain() bool {
+	return os.Getenv("UFW_AUDIT_HASH_CHAIN") == "1"
+}
+
+func auditLogPath() string {
+	return dataPath(auditFileName)
+}
+
+// requestIDMiddleware keeps a well-formed X-Request-ID from the client or
+// assigns one, and echoes it in the response.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(headerRequestID)
+		if !reRequestID.MatchString(id) {
+			id = newID()
+		}
+		c.Set(ctxRequestID, id)
+		c.Header(headerRequestID, id)
+		c.Next()
+	}
+}
+
+// auditMiddleware records every request that may change the firewall.
+func auditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		mutationMu.Lock()
+		defer mutationMu.Unlock()
+
+		if !pendingExemptRoutes[c.Request.Method+" "+c.FullPath()] && changePending() {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Change refused", "details": errChangePending.Error()})
+			return
+		}
+		e := &auditEntry{
+			Key:       c.GetString(ctxKeyName),
+			ClientIP:  c.ClientIP(),
+			RequestID: c.GetString(ctxRequestID),
+			Action:    c.Request.Method + " " + c.FullPath(),
+			Path:      c.Request.URL.RequestURI(),
+		}
+		audited(e, func() {
+			c.Next()
+			e.Status = c.Writer.Status()
+		})
+	}
+}
+
+// auditSystem runs a change the backend makes on its own, such as an
+// automatic block, as an audited action. Actions that ran no command and did
+// not fail are not logged. While a change awaits confirmation fn is not run
+// and errChangePending is returned.
+func auditSystem(action string, fn func() error) error {
+	mutationMu.Lock()
+	defer mutationMu.Unlock()
+
+	if changePending() {
+		return errChangePending
+	}
+	return auditSystemLocked(action, fn)
+}
+
+// auditSystemLocked must be called with mutationMu held.
+func auditSystemLocked(action string, fn func() error) error {
+	e := &auditEntry{Key: "system", Action: action}
+	var err error
+	audited(e, func() {
+		if err = fn(); err != nil {
+			e.Error = err.Error()
+		}
+	})
+	return err
+}
+
+// audited must be called with mutationMu held. It collects the commands fn
+// runs into e and appends e to the log with the resulting rule diff.
+func audited(e *auditEntry, fn func()) {
+	before, err := readDriftFiles()
+	if err != nil {
+		log.Printf("WARN: audit: failed to read rules: %v", err)
+	}
+
+	auditMu.Lock()
+	auditCurrent = e
+	auditMu.Unlock()
+	defer func() {
+		auditMu.Lock()
+		auditCurrent = nil
+		auditMu.Unlock()
+
+		if len(e.Commands) == 0 && e.Key == "system" && e.Error == "" {
+			return
+		}
+		if len(e.Commands) > 0 && before != nil {
+			if after, err := readDriftFiles(); err == nil {
+				for _, p := range driftWatchedFiles {
+					e.Diff += unifiedDiff("a"+p, "b"+p, before[p], after[p])
+				}
+			}
+		}
+		if e.Commands == nil {
+			e.Commands = []auditCommand{}
+		}
+		if err := appendAuditEntry(e); err != nil {
+			log.Printf("WARN: audit: failed to write entry for %s: %v", e.Action, err)
+		}
+		if len(e.Commands) > 0 {
+			publishEvent("change", gin.H{
+				"seq":    e.Seq,
+				"key":    e.Key,
+				"action": e.Action,
+				"path":   e.Path,
+				"status": e.Status,
+				"error":  e.Error,
+				"diff":   e.Diff,
+			})
+		}
+	}()
+	fn()
+}
+
+// recordAuditCommand adds a command to the action being audited, if any.
+func recordAuditCommand(argv []string, res *cmdResult, err error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditCurrent == nil {
+		return
+	}
+	cmd := auditCommand{Argv: append([]string(nil), argv...)}
+	if res != nil {
+		cmd.ExitCode = res.ExitCode
+	}
+	if err != nil {
+		cmd.Error = err.Error()
+		if cmd.ExitCode == 0 {
+			cmd.ExitCode = -1
+		}
+	}
+	auditCurrent.Commands = append(auditCurrent.Commands, cmd)
+}
+
+func (e *auditEntry) computeHash() string {
+	c := *e
+	c.Hash = ""
+	data, _ := json.Marshal(&c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func appendAuditEntry(e *auditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	e.Seq = auditSeq + 1
+	e.Time = time.Now().UTC()
+	if auditHashChain() {
+		e.PrevHash = auditLastHash
+		e.Hash = e.computeHash()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(auditLogPath()), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	auditSeq = e.Seq
+	auditLastHash = e.Hash
+	return nil
+}
+
+// scanAuditLog calls fn for every entry in order; unparsable lines are
+// passed as nil with their line number.
+func scanAuditLog(fn func(line int, e *auditEntry) bool) error {
+	f, err := os.Open(auditLogPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), maxAuditLineSize)
+	for n := 1; sc.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			if !fn(n, nil) {
+				return nil
+			}
+			continue
+		}
+		if !fn(n, &e) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+// loadAuditLog continues the sequence numbers and hash chain of an existing
+// log.
+func loadAuditLog() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	err := scanAuditLog(func(_ int, e *auditEntry) bool {
+		if e != nil {
+			auditSeq, auditLastHash = e.Seq, e.Hash
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("WARN: audit: failed to read %s: %v", auditLogPath(), err)
+	}
+}
+
+type auditVerifyResult struct {
+	Valid   bool   `json:"valid"`
+	Entries int    `json:"entries"`
+	Chained int    `json:"chained"`
+	BadLine int    `json:"bad_line,omitempty"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// verifyAuditLog checks that sequence numbers are consecutive and that every
+// hashed entry matches its hash and links to the previous entry's hash.
+func verifyAuditLog() (*auditVerifyResult, error) {
+	res := &auditVerifyResult{Valid: true}
+	var prev *auditEntry
+	fail := func(line int, problem string) bool {
+		res.Valid, res.BadLine, res.Problem = false, line, problem
+		return false
+	}
+	err := scanAuditLog(func(line int, e *auditEntry) bool {
+		if e == nil {
+			return fail(line, "unparsable entry")
+		}
+		res.Entries++
+		if prev != nil && e.Seq != prev.Seq+1 {
+			return fail(line, fmt.Sprintf("sequence jumps from %d to %d", prev.Seq, e.Seq))
+		}
+		if e.Hash != "" {
+			res.Chained++
+			if e.Hash != e.computeHash() {
+				return fail(line, fmt.Sprintf("entry %d does not match its hash", e.Seq))
+			}
+			if prev != nil && e.PrevHash != prev.Hash {
+				return fail(line, fmt.Sprintf("entry %d does not link to entry %d", e.Seq, prev.Seq))
+			}
+		}
+		prev = e
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func registerAuditRoutes(rg *gin.RouterGroup) {
+	// GET /audit?since=&until=&action=&key=&limit= returns matching entries,
+	// newest first. since/until are RFC 3339 times; action matches part of
+	// the action, e.g. "rules/allow" or "DELETE".
+	rg.GET("/audit", func(c *gin.Context) {
+		var since, until time.Time
+		for _, p := range []struct {
+			name string
+			t    *time.Time
+		}{{"since", &since}, {"until", &until}} {
+			if v := c.Query(p.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + p.name, "details": "expected an RFC 3339 time"})
+					return
+				}
+				*p.t = t
+			}
+		}
+		limit := 100
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit", "details": "limit must be between 1 and 1000"})
+				return
+			}
+			limit = n
+		}
+		action := strings.ToLower(c.Query("action"))
+		key := c.Query("key")
+
+		var matched []*auditEntry
+		err := scanAuditLog(func(_ int, e *auditEntry) bool {
+			switch {
+			case e == nil,
+				!since.IsZero() && e.Time.Before(since),
+				!until.IsZero() && e.Time.After(until),
+				action != "" && !strings.Contains(strings.ToLower(e.Action), action),
+				key != "" && e.Key != key:
+				return true
+			}
+			matched = append(matched, e)
+			if len(matched) > limit {
+				matched = matched[1:]
+			}
+			return true
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log", "details": err.Error()})
+			return
+		}
+		entries := make([]*auditEntry, 0, len(matched))
+		for i := len(matched) - 1; i >= 0; i-- {
+			entries = append(entries, matched[i])
+		}
+		c.JSON(http.StatusOK, gin.H{"entries": entries})
+	})
+
+	rg.GET("/audit/verify", func(c *gin.Context) {
+		res, err := verifyAuditLog()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bans deny all traffic from an address. They are issued by the API's own
+// failed-login counter and by the log watchers, and share one path: the
+// address is refused by the API right away, and a deny rule is inserted
+// ahead of the allow rules of its IP version in the background. A ban with
+// a duration is removed by the rule expiry.
+
+const maxRecentBans = 200
+
+type banRecord struct {
+	IP        string     `json:"ip"`
+	Source    string     `json:"source"`
+	Reason    string     `json:"reason"`
+	At        time.Time  `json:"at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var (
+	banMu      sync.Mutex
+	recentBans []*banRecord
+
+	banIgnoreOnce sync.Once
+	banIgnore     []*net.IPNet
+)
+
+// banIgnoreNets returns the networks never banned: loopback, the
+// API_ALLOWED_SOURCES, since a ban inserted ahead of their allow rules
+// would lock the panel out, and the BAN_IGNORE_IPS list.
+func banIgnoreNets() []*net.IPNet {
+	banIgnoreOnce.Do(func() {
+		items := []string{"127.0.0.0/8", "::1/128"}
+		if sources, err := apiAllowedSources(); err == nil {
+			items = append(items, sources...)
+		}
+		for _, item := range strings.Split(os.Getenv("BAN_IGNORE_IPS"), ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		for _, item := range items {
+			if !strings.Contains(item, "/") {
+				if strings.Contains(item, ":") {
+					item += "/128"
+				} else {
+					item += "/32"
+				}
+			}
+			_, n, err := net.ParseCIDR(item)
+			if err != nil {
+				log.Printf("WARN: BAN_IGNORE_IPS: ignoring invalid entry %q", item)
+				continue
+			}
+			banIgnore = append(banIgnore, n)
+		}
+	})
+	return banIgnore
+}
+
+func banExempt(ip net.IP) bool {
+	for _, n := range banIgnoreNets() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// insertBanRule adds the deny rule of a ban ahead of the first rule of its
+// IP version, so it takes precedence over allow rules. Without a rule of
+// that version it is appended.
+func insertBanRule(args []string, v6 bool) error {
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	for _, r := range parseStatusRules(status.Rules) {
+		if r.V6 == v6 {
+			args = insertArgs(args, r.Number)
+			break
+		}
+	}
+	_, err = addUFWRule(args)
+	return err
+}
+
+// banIP bans ip for banTime, or for good if banTime is zero. source names
+// the subsystem issuing the ban and reason becomes the rule comment. It
+// returns false without doing anything if ip is exempt, invalid or already
+// banned.
+func banIP(ip, source, reason string, banTime time.Duration) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || banExempt(parsed) {
+		return false
+	}
+	if _, loaded := blockedIPs.LoadOrStore(ip, struct{}{}); loaded {
+		return false
+	}
+	rec := &banRecord{IP: ip, Source: source, Reason: reason, At: time.Now().UTC()}
+	if banTime > 0 {
+		at := rec.At.Add(banTime)
+		rec.ExpiresAt = &at
+		time.AfterFunc(banTime, func() { blockedIPs.Delete(ip) })
+	}
+	banMu.Lock()
+	recentBans = append(recentBans, rec)
+	if len(recentBans) > maxRecentBans {
+		recentBans = recentBans[len(recentBans)-maxRecentBans:]
+	}
+	banMu.Unlock()
+	log.Printf("Banning %s (%s): %s", ip, source, reason)
+	publishEvent("ban", *rec)
+
+	var block func()
+	block = func() {
+		args, err := ipRuleArgs("deny", ip, "", reason)
+		if err == nil {
+			err = auditSystem("auto block "+ip, func() error {
+				return insertBanRule(args, parsed.To4() == nil)
+			})
+		}
+		if errors.Is(err, errChangePending) {
+			// The API already refuses the address; the rule follows once
+			// the pending change is settled.
+			afterPendingChange(block)
+			return
+		}
+		if err != nil {
+			log.Printf("WARN: failed to add UFW deny rule for %s: %v", ip, err)
+			banMu.Lock()
+			rec.Error = err.Error()
+			banMu.Unlock()
+			return
+		}
+		if rec.ExpiresAt != nil {
+			setRuleExpiry(args, *rec.ExpiresAt, "system")
+		} else {
+			clearRuleExpiry(args)
+		}
+	}
+	go block()
+	return true
+}
+
+func registerBanRoutes(rg *gin.RouterGroup) {
+	// GET /bans lists the most recent bans, newest first.
+	rg.GET("/bans", func(c *gin.Context) {
+		banMu.Lock()
+		defer banMu.Unlock()
+		out := make([]banRecord, 0, len(recentBans))
+		for i := len(recentBans) - 1; i >= 0; i-- {
+			out = append(out, *recentBans[i])
+		}
+		c.JSON(http.StatusOK, gin.H{"bans": out})
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchOperations = 200
+
+// batchOperation is one step of POST /rules/batch. Which fields are used
+// depends on Op; the rules added by allow, deny, allow_ip and deny_ip may
+// expire.
+type batchOperation struct {
+	Op           string `json:"op"`
+	Rule         string `json:"rule,omitempty"`
+	IPAddress    string `json:"ip_address,omitempty"`
+	PortProtocol string `json:"port_protocol,omitempty"`
+	Comment      string `json:"comment,omitempty"`
+	Number       string `json:"number,omitempty"`
+	Direction    string `json:"direction,omitempty"`
+	Policy       string `json:"policy,omitempty"`
+	ruleExpiry
+
+	expiresAt time.Time
+	args      []string
+}
+
+func (o *batchOperation) validate() error {
+	switch o.Op {
+	case "allow", "deny":
+		if strings.TrimSpace(o.Rule) == "" {
+			return fmt.Errorf("%s requires rule", o.Op)
+		}
+	case "allow_ip", "deny_ip":
+		if strings.TrimSpace(o.IPAddress) == "" {
+			return fmt.Errorf("%s requires ip_address", o.Op)
+		}
+	case "delete":
+		if !reDigits.MatchString(strings.TrimSpace(o.Number)) {
+			return fmt.Errorf("delete requires a rule number")
+		}
+	case "default":
+		if !ufwDefaultPolicies[o.Policy] || !ufwDefaultDirections[o.Direction] {
+			return fmt.Errorf("default requires a valid policy and direction")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", o.Op)
+	}
+	if o.isSet() && (o.Op == "delete" || o.Op == "default") {
+		return fmt.Errorf("%s does not take an expiry", o.Op)
+	}
+	var err error
+	o.expiresAt, err = o.resolve()
+	return err
+}
+
+func (o *batchOperation) apply() error {
+	var err error
+	switch o.Op {
+	case "allow", "deny", "allow_ip", "deny_ip":
+		o.args, err = ruleOpArgs(o.Op, o.Rule, o.IPAddress, o.PortProtocol, o.Comment)
+		return o.addRule(err)
+	case "delete":
+		return DeleteUFWByNumber(o.Number)
+	case "default":
+		return SetUFWDefault(o.Policy, o.Direction)
+	}
+	return fmt.Errorf("unknown op %q", o.Op)
+}
+
+// addRule adds the rule in o.args. A rule that is to expire must be new or
+// already temporary, so an expiry never removes a permanent rule.
+func (o *batchOperation) addRule(err error) error {
+	if err != nil {
+		return err
+	}
+	added, err := addUFWRule(o.args)
+	if err != nil {
+		return err
+	}
+	if !o.expiresAt.IsZero() && !added && !hasRuleExpiry(o.args) {
+		return errRuleNotExpiring
+	}
+	return nil
+}
+
+// runBatch applies ops in order. Unless force is set it fails once they are
+// done if the firewall is active and a protected port is left uncovered; the
+// caller restores the previous state on any error.
+func runBatch(ops []batchOperation, force bool) error {
+	for i := range ops {
+		if err := ops[i].apply(); err != nil {
+			return fmt.Errorf("operation %d (%s): %w", i, ops[i].Op, err)
+		}
+	}
+	if force {
+		return nil
+	}
+	return checkActiveLockout()
+}
+
+func registerBatchRoutes(rg *gin.RouterGroup) {
+	type BatchRequest struct {
+		Operations []batchOperation `json:"operations" binding:"required"`
+	}
+	rg.POST("/rules/batch", func(c *gin.Context) {
+		var req BatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: between 1 and %d operations are required", maxBatchOperations)})
+			return
+		}
+		for i := range req.Operations {
+			if err := req.Operations[i].validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid operation", "details": fmt.Sprintf("operation %d: %v", i, err)})
+				return
+			}
+		}
+		timeout, err := confirmTimeout(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		force := forceRequested(c)
+		change, err := applyWithSnapshot("batch", timeout, func() error {
+			return runBatch(req.Operations, force)
+		})
+		if abortOnApplyError(c, err, "Batch failed; previous state restored") {
+			return
+		}
+		expiring := []tempRule{}
+		for _, op := range req.Operations {
+			switch {
+			case !op.expiresAt.IsZero():
+				expiring = append(expiring, setRuleExpiry(op.args, op.expiresAt, c.GetString(ctxKeyName)))
+			case op.args != nil:
+				clearRuleExpiry(op.args)
+			}
+		}
+		resp := gin.H{"message": "Batch applied successfully", "applied": len(req.Operations)}
+		if len(expiring) > 0 {
+			resp["expiring"] = expiring
+		}
+		if change != nil {
+			resp["pending"] = change.view()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	certFileName = "server.crt"
+	keyFileName  = "server.key"
+)
+
+func certKeyType() string {
+	if strings.EqualFold(os.Getenv("TLS_KEY_TYPE"), "ecdsa") {
+		return "ecdsa"
+	}
+	return "rsa"
+}
+
+func certValidity() time.Duration {
+	if v := os.Getenv("TLS_CERT_VALIDITY_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 3650 {
+			return time.Duration(n) * 24 * time.Hour
+		}
+	}
+	return 90 * 24 * time.Hour
+}
+
+func certRenewBefore() time.Duration {
+	d := 30 * 24 * time.Hour
+	if v := os.Getenv("TLS_RENEW_BEFORE_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			d = time.Duration(n) * 24 * time.Hour
+		}
+	}
+	if validity := certValidity(); d >= validity {
+		d = validity / 3
+	}
+	return d
+}
+
+// certSANs returns the subject alternative names for the self-signed
+// certificate: localhost plus TLS_SANS, and the host name and interface
+// addresses when TLS_SAN_AUTODETECT=1.
+func certSANs() ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	seen := map[string]bool{"localhost": true, "127.0.0.1": true}
+
+	add := func(item string) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip)
+			}
+			return
+		}
+		name := strings.ToLower(item)
+		if !seen[name] {
+			seen[name] = true
+			dnsNames = append(dnsNames, name)
+		}
+	}
+
+	for _, item := range strings.Split(os.Getenv("TLS_SANS"), ",") {
+		add(item)
+	}
+
+	if os.Getenv("TLS_SAN_AUTODETECT") == "1" {
+		if host, err := os.Hostname(); err == nil {
+			add(host)
+		}
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				ipNet, ok := a.(*net.IPNet)
+				if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				add(ipNet.IP.String())
+			}
+		} else {
+			log.Printf("WARN: failed to list interface addresses for certificate SANs: %v", err)
+		}
+	}
+
+	return dnsNames, ips
+}
+
+// certRenewalReason explains why an existing certificate must be replaced,
+// or returns "" if it can be kept.
+func certRenewalReason(cert *x509.Certificate, key crypto.Signer, dnsNames []string, ips []net.IP) string {
+	if time.Until(cert.NotAfter) < certRenewBefore() {
+		return fmt.Sprintf("certificate expires %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if keyTypeOf(key) != certKeyType() {
+		return "key type changed to " + certKeyType()
+	}
+	for _, name := range dnsNames {
+		if !containsString(cert.DNSNames, name) {
+			return "missing SAN " + name
+		}
+	}
+	for _, ip := range ips {
+		found := false
+		for _, have := range cert.IPAddresses {
+			if have.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "missing SAN " + ip.String()
+		}
+	}
+	return ""
+}
+
+func ensureSelfSignedCert(certPath, keyPath string) error {
+	dnsNames, ips := certSANs()
+
+	existingCert, existingKey := readCertPair(certPath, keyPath)
+	if existingCert != nil {
+		reason := certRenewalReason(existingCert, existingKey, dnsNames, ips)
+		if reason == "" {
+			log.Printf("Detected existing self-signed certificate, skipping generation (%s, %s)", certPath, keyPath)
+			return nil
+		}
+		log.Printf("Regenerating self-signed certificate: %s", reason)
+	} else {
+		log.Println("No self-signed certificate found, starting generation…")
+	}
+
+	// Reusing the key keeps the SPKI fingerprint stable, so frontends that
+	// pinned it keep trusting the renewed certificate.
+	priv := existingKey
+	if priv == nil || keyTypeOf(priv) != certKeyType() {
+		var err error
+		priv, err = generateKey(certKeyType())
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+	}
+
+	max := new(big.Int)
+	max.Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"UFW-Panel"},
+			CommonName:   dnsNames[0],
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(certValidity()),
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate: %w", err)
+	}
+
+	keyBlock, err := encodePrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(keyBlock), 0o600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	log.Printf("Self-signed certificate created (%s, %s), valid until %s for %v %v", certPath, keyPath, template.NotAfter.Format(time.RFC3339), dnsNames, ips)
+	return nil
+}
+
+func readCertPair(certPath, keyPath string) (*x509.Certificate, crypto.Signer) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil
+	}
+	key, err := parsePrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil
+	}
+	return cert, key
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	if keyType == "ecdsa" {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func keyTypeOf(key crypto.Signer) string {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		return "ecdsa"
+	case *rsa.PrivateKey:
+		return "rsa"
+	default:
+		return ""
+	}
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func encodePrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// certReloader serves the current certificate to the TLS listener and swaps
+// it when the files change, on SIGHUP, or after renewing a self-signed cert.
+type certReloader struct {
+	certPath   string
+	keyPath    string
+	selfSigned bool
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certPath, keyPath string, selfSigned bool) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath, selfSigned: selfSigned}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	pair, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	pair.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &pair
+	r.leaf = leaf
+	r.modTime = r.latestModTime()
+	r.mu.Unlock()
+
+	log.Printf("Loaded TLS certificate %s (SPKI sha256 %s, expires %s)", r.certPath, spkiFingerprint(leaf), leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, p := range []string{r.certPath, r.keyPath} {
+		if st, err := os.Stat(p); err == nil && st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	poll := time.NewTicker(30 * time.Second)
+	defer poll.Stop()
+	renew := time.NewTicker(12 * time.Hour)
+	defer renew.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading TLS certificate")
+			if err := r.reload(); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		case <-poll.C:
+			r.mu.RLock()
+			changed := r.latestModTime().After(r.modTime)
+			r.mu.RUnlock()
+			if changed {
+				log.Println("TLS certificate files changed, reloading")
+				if err := r.reload(); err != nil {
+					log.Printf("WARN: %v", err)
+				}
+			}
+		case <-renew.C:
+			r.checkExpiry()
+		}
+	}
+}
+
+func (r *certReloader) checkExpiry() {
+	r.mu.RLock()
+	notAfter := r.leaf.NotAfter
+	r.mu.RUnlock()
+
+	if !r.selfSigned {
+		if time.Until(notAfter) < certRenewBefore() {
+			log.Printf("WARN: TLS certificate %s expires %s, replace it and send SIGHUP", r.certPath, notAfter.Format(time.RFC3339))
+		}
+		return
+	}
+	if err := ensureSelfSignedCert(r.certPath, r.keyPath); err != nil {
+		log.Printf("WARN: failed to renew self-signed certificate: %v", err)
+		return
+	}
+	if r.latestModTime().After(r.modTime) {
+		if err := r.reload(); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+}
+
+func (r *certReloader) info() gin.H {
+	r.mu.RLock()
+	leaf := r.leaf
+	r.mu.RUnlock()
+
+	certSum := sha256.Sum256(leaf.Raw)
+	ips := make([]string, 0, len(leaf.IPAddresses))
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return gin.H{
+		"spki_sha256":  spkiFingerprint(leaf),
+		"cert_sha256":  hex.EncodeToString(certSum[:]),
+		"subject":      leaf.Subject.String(),
+		"issuer":       leaf.Issuer.String(),
+		"not_before":   leaf.NotBefore,
+		"not_after":    leaf.NotAfter,
+		"dns_names":    leaf.DNSNames,
+		"ip_addresses": ips,
+		"self_signed":  r.selfSigned,
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Risky operations can be applied "commit confirmed": the ufw state is saved
+// first and restored automatically unless POST /confirm/:id arrives within
+// the timeout. The pending change is persisted so a restart does not lose it.
+// Until it is confirmed or rolled back every other change, the backend's own
+// included, is refused with errChangePending, since a rollback would
+// silently undo it.
+
+const (
+	pendingChangeFile = "pending-change.json"
+	minConfirmTimeout = 10 * time.Second
+	maxConfirmTimeout = time.Hour
+)
+
+var errChangePending = errors.New("another change is awaiting confirmation")
+
+type pendingChange struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	State     *ufwState `json:"state"`
+}
+
+type rollbackResult struct {
+	ID        string    `json:"id"`
+	Operation string    `json:"operation"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	confirmMu    sync.Mutex
+	pending      *pendingChange
+	pendingTimer *time.Timer
+	lastRollback *rollbackResult
+	// settleHooks run once the pending change is confirmed or rolled back.
+	settleHooks []func()
+)
+
+func (p *pendingChange) view() gin.H {
+	return gin.H{
+		"id":         p.ID,
+		"operation":  p.Operation,
+		"created_at": p.CreatedAt,
+		"expires_at": p.ExpiresAt,
+	}
+}
+
+// changePending reports whether a change awaits confirmation.
+func changePending() bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	return pending != nil
+}
+
+// afterPendingChange runs fn in the background once no change awaits
+// confirmation: right away if none does, otherwise when the pending change
+// is confirmed or rolled back. Background jobs refused with errChangePending
+// use it to try again.
+func afterPendingChange(fn func()) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	if pending != nil {
+		settleHooks = append(settleHooks, fn)
+		return
+	}
+	go fn()
+}
+
+// settlePendingChangeLocked must be called with confirmMu held.
+func settlePendingChangeLocked() {
+	pending, pendingTimer = nil, nil
+	if err := os.Remove(dataPath(pendingChangeFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: failed to remove pending change file: %v", err)
+	}
+	for _, fn := range settleHooks {
+		go fn()
+	}
+	settleHooks = nil
+}
+
+// confirmTimeout reads the confirm_timeout query parameter in seconds. Zero
+// means the change is applied without confirmation.
+func confirmTimeout(c *gin.Context) (time.Duration, error) {
+	v := c.Query("confirm_timeout")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid confirm_timeout: %q", v)
+	}
+	d := time.Duration(n) * time.Second
+	if d != 0 && (d < minConfirmTimeout || d > maxConfirmTimeout) {
+		return 0, fmt.Errorf("confirm_timeout must be between %d and %d seconds", int(minConfirmTimeout.Seconds()), int(maxConfirmTimeout.Seconds()))
+	}
+	return d, nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// applyConfirmable runs apply directly when timeout is zero, otherwise as a
+// pending change that reverts unless confirmed.
+func applyConfirmable(op string, timeout time.Duration, apply func() error) (*pendingChange, error) {
+	if timeout == 0 {
+		return nil, apply()
+	}
+	return applyWithSnapshot(op, timeout, apply)
+}
+
+// applyWithSnapshot saves the ufw state, runs apply and restores the state if
+// apply fails. With a timeout the change stays pending until confirmed.
+func applyWithSnapshot(op string, timeout time.Duration, apply func() error) (*pendingChange, error) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	if pending != nil {
+		return nil, errChangePending
+	}
+	st, err := captureUFWState()
+	if err != nil {
+		return nil, fmt.Errorf("capture ufw state: %w", err)
+	}
+
+	var change *pendingChange
+	if timeout > 0 {
+		now := time.Now().UTC()
+		change = &pendingChange{ID: newID(), Operation: op, CreatedAt: now, ExpiresAt: now.Add(timeout), State: st}
+		// Persist before applying so a crash during the change still heals.
+		if err := writeJSONFile(dataPath(pendingChangeFile), change); err != nil {
+			return nil, fmt.Errorf("save pending change: %w", err)
+		}
+	}
+
+	if err := apply(); err != nil {
+		if rerr := restoreUFWState(st); rerr != nil {
+			log.Printf("WARN: failed to restore ufw state after failed %s: %v", op, rerr)
+		}
+		if change != nil {
+			_ = os.Remove(dataPath(pendingChangeFile))
+		}
+		return nil, err
+	}
+
+	if change != nil {
+		armPendingChange(change)
+		log.Printf("Change %s (%s) applied; reverting at %s unless confirmed", change.ID, op, change.ExpiresAt.Format(time.RFC3339))
+	}
+	return change, nil
+}
+
+// armPendingChange must be called with confirmMu held.
+func armPendingChange(change *pendingChange) {
+	pending = change
+	pendingTimer = time.AfterFunc(time.Until(change.ExpiresAt), func() {
+		if err := auditRollback(change.ID, "confirmation timeout"); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	})
+}
+
+func confirmPendingChange(id string) error {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	if pending == nil || pending.ID != id {
+		return fmt.Errorf("no pending change with id %s", id)
+	}
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+	}
+	log.Printf("Change %s (%s) confirmed", pending.ID, pending.Operation)
+	settlePendingChangeLocked()
+	return nil
+}
+
+func rollbackPendingChange(id, reason string) error {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	if pending == nil || pending.ID != id {
+		return fmt.Errorf("no pending change with id %s", id)
+	}
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+	}
+	change := pending
+
+	result := &rollbackResult{ID: change.ID, Operation: change.Operation, Reason: reason, At: time.Now().UTC()}
+	err := restoreUFWState(change.State)
+	if err != nil {
+		// Keep the change pending so the rollback can be retried.
+		result.Error = err.Error()
+		lastRollback = result
+		pendingTimer = time.AfterFunc(30*time.Second, func() {
+			if err := auditRollback(id, reason); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		})
+		return fmt.Errorf("failed to roll back change %s: %w", id, err)
+	}
+
+	log.Printf("Change %s (%s) rolled back: %s", change.ID, change.Operation, reason)
+	lastRollback = result
+	settlePendingChangeLocked()
+	return nil
+}
+
+// auditRollback rolls back a change on the backend's own initiative. Unlike
+// other system actions it runs while the change is pending.
+func auditRollback(id, reason string) error {
+	mutationMu.Lock()
+	defer mutationMu.Unlock()
+	return auditSystemLocked("rollback "+id, func() error {
+		return rollbackPendingChange(id, reason)
+	})
+}
+
+// resumePendingChange re-arms a change left pending by a previous run; if its
+// deadline has passed it is rolled back right away.
+func resumePendingChange() {
+	var change pendingChange
+	found, err := readJSONFile(dataPath(pendingChangeFile), &change)
+	if err != nil {
+		log.Printf("WARN: failed to read pending change: %v", err)
+		return
+	}
+	if !found || change.State == nil {
+		return
+	}
+	if time.Now().After(change.ExpiresAt) {
+		confirmMu.Lock()
+		pending = &change
+		confirmMu.Unlock()
+		if err := auditRollback(change.ID, "confirmation timeout (expired while stopped)"); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		return
+	}
+	confirmMu.Lock()
+	armPendingChange(&change)
+	confirmMu.Unlock()
+	log.Printf("Resuming pending change %s (%s), expires %s", change.ID, change.Operation, change.ExpiresAt.Format(time.RFC3339))
+}
+
+func pendingChangeInfo() gin.H {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	out := gin.H{"pending": nil}
+	if pending != nil {
+		out["pending"] = pending.view()
+	}
+	if lastRollback != nil {
+		out["last_rollback"] = lastRollback
+	}
+	return out
+}
+
+// abortOnApplyError maps errors from applyConfirmable to a response and
+// reports whether the handler should stop.
+func abortOnApplyError(c *gin.Context, err error, msg string) bool {
+	if err == nil {
+		return false
+	}
+	var lockout *LockoutError
+	switch {
+	case errors.Is(err, errChangePending), errors.Is(err, errNoIPSetRestore):
+		c.JSON(http.StatusConflict, gin.H{"error": msg, "details": err.Error()})
+	case errors.As(err, &lockout):
+		abortOnLockout(c, err)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg, "details": err.Error()})
+	}
+	return true
+}
+
+func registerConfirmRoutes(rg *gin.RouterGroup) {
+	rg.GET("/pending", func(c *gin.Context) {
+		c.JSON(http.StatusOK, pendingChangeInfo())
+	})
+
+	rg.POST("/confirm/:id", func(c *gin.Context) {
+		if err := confirmPendingChange(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pending change not found", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Change confirmed", "id": c.Param("id")})
+	})
+
+	rg.POST("/rollback/:id", func(c *gin.Context) {
+		confirmMu.Lock()
+		found := pending != nil && pending.ID == c.Param("id")
+		confirmMu.Unlock()
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pending change not found"})
+			return
+		}
+		if err := rollbackPendingChange(c.Param("id"), "rolled back via API"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back change", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Change rolled back", "id": c.Param("id")})
+	})
+}
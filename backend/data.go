@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// dataDir holds state the backend keeps between restarts.
+func dataDir() string {
+	if dir := os.Getenv("UFW_PANEL_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "data"
+}
+
+func dataPath(name string) string {
+	return filepath.Join(dataDir(), name)
+}
+
+// readJSONFile decodes path into v. It reports false if the file does not
+// exist.
+func readJSONFile(path string, v any) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hostname rules keep a rule in place for the current addresses of a
+// dynamic-DNS name. The name is resolved periodically; rules for new
+// addresses are added and those for addresses it no longer resolves to are
+// deleted. A failed lookup keeps the last known-good rules.
+
+const (
+	hostRulesFile       = "hostname-rules.json"
+	defaultHostInterval = 5 * time.Minute
+	minHostInterval     = time.Minute
+	maxHostInterval     = 24 * time.Hour
+	hostResolveTimeout  = 10 * time.Second
+	maxHostAddresses    = 32
+	hostCommentPrefix   = "ddns "
+)
+
+var reHostname = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9\-]{0,61}[A-Za-z0-9])?\.)+[A-Za-z]{2,63}\.?$`)
+
+type hostRule struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname"`
+	Action       string    `json:"action"`
+	PortProtocol string    `json:"port_protocol,omitempty"`
+	Interval     string    `json:"interval"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// Addresses are those whose rules are applied: the last known-good
+	// resolution.
+	Addresses []string `json:"addresses"`
+	// Owned are the addresses whose rule was added for this hostname.
+	Owned        []string   `json:"owned,omitempty"`
+	LastResolved *time.Time `json:"last_resolved,omitempty"`
+	LastChanged  *time.Time `json:"last_changed,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Failures     int        `json:"failures"`
+
+	interval  time.Duration
+	timer     *time.Timer
+	nextCheck time.Time
+	syncing   bool
+}
+
+var (
+	hostRuleMu sync.Mutex
+	hostRules  []*hostRule
+)
+
+func (h *hostRule) binding() *groupBinding {
+	return &groupBinding{Action: h.Action, PortProtocol: h.PortProtocol, Comment: hostCommentPrefix + h.Hostname, Owned: h.Owned}
+}
+
+// resolveHost returns the addresses of hostname, sorted and canonical.
+func resolveHost(hostname string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hostResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, a := range addrs {
+		if a.IP.IsUnspecified() || a.IP.IsLoopback() {
+			continue
+		}
+		s := canonicalAddr(a.IP.String())
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no usable addresses")
+	}
+	if len(out) > maxHostAddresses {
+		return nil, fmt.Errorf("resolves to %d addresses, at most %d are allowed", len(out), maxHostAddresses)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func saveHostRulesLocked() {
+	if err := writeJSONFile(dataPath(hostRulesFile), hostRules); err != nil {
+		log.Printf("WARN: hostname rules: failed to save %s: %v", hostRulesFile, err)
+	}
+}
+
+func findHostRuleLocked(id string) (int, *hostRule) {
+	for i, h := range hostRules {
+		if h.ID == id {
+			return i, h
+		}
+	}
+	return -1, nil
+}
+
+func armHostTimerLocked(h *hostRule, delay time.Duration) {
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	h.nextCheck = time.Now().Add(delay).UTC()
+	id := h.ID
+	h.timer = time.AfterFunc(delay, func() { refreshHostRule(id) })
+}
+
+// recordHostResultLocked stores the outcome of a resolution and the rule
+// changes it led to.
+func recordHostResultLocked(h *hostRule, addrs []string, changed bool, err error) {
+	now := time.Now().UTC()
+	if err != nil {
+		h.LastError = err.Error()
+		h.Failures++
+		return
+	}
+	h.LastResolved, h.LastError, h.Failures = &now, "", 0
+	if changed {
+		h.LastChanged = &now
+	}
+	h.Addresses = addrs
+}
+
+// refreshHostRule resolves the hostname again and updates the rules if its
+// addresses changed. hostRuleMu is not held during the lookup or while ufw
+// runs.
+func refreshHostRule(id string) {
+	hostRuleMu.Lock()
+	_, h := findHostRuleLocked(id)
+	if h == nil || h.syncing {
+		hostRuleMu.Unlock()
+		return
+	}
+	h.syncing = true
+	hostname, current, b := h.Hostname, h.Addresses, h.binding()
+	hostRuleMu.Unlock()
+
+	addrs, err := resolveHost(hostname)
+	var add, remove []string
+	var owned [][]string
+	if err == nil {
+		add, remove = diffEntries(current, addrs)
+		if len(add) > 0 || len(remove) > 0 {
+			err = auditSystem("refresh hostname rule "+id, func() error {
+				_, aerr := applyWithSnapshot("refresh hostname rule "+id, 0, func() error {
+					var err error
+					owned, err = expandGroupRules([]*groupBinding{b}, add, remove, false)
+					return err
+				})
+				return aerr
+			})
+		}
+	}
+
+	hostRuleMu.Lock()
+	defer hostRuleMu.Unlock()
+	h.syncing = false
+	if _, cur := findHostRuleLocked(id); cur != h {
+		return
+	}
+	changed := len(add) > 0 || len(remove) > 0
+	switch {
+	case err != nil:
+		log.Printf("WARN: hostname rule %s (%s): keeping %d addresses: %v", id, hostname, len(current), err)
+	case changed:
+		log.Printf("Hostname rule %s (%s): now %s", id, hostname, strings.Join(addrs, ", "))
+	}
+	recordHostResultLocked(h, addrs, changed, err)
+	if err == nil && owned != nil {
+		h.Owned = owned[0]
+	}
+	saveHostRulesLocked()
+	armHostTimerLocked(h, h.interval)
+}
+
+// startHostRules loads the hostname rules and resolves each of them.
+func startHostRules() {
+	hostRuleMu.Lock()
+	defer hostRuleMu.Unlock()
+	if _, err := readJSONFile(dataPath(hostRulesFile), &hostRules); err != nil {
+		log.Printf("WARN: hostname rules: ignoring unreadable %s: %v", hostRulesFile, err)
+		hostRules = nil
+	}
+	for _, h := range hostRules {
+		d, err := time.ParseDuration(h.Interval)
+		if err != nil {
+			d = defaultHostInterval
+		}
+		h.interval = d
+		armHostTimerLocked(h, 0)
+	}
+}
+
+func (h *hostRule) view() gin.H {
+	return gin.H{
+		"id":            h.ID,
+		"hostname":      h.Hostname,
+		"action":        h.Action,
+		"port_protocol": h.PortProtocol,
+		"comment":       hostCommentPrefix + h.Hostname,
+		"interval":      h.Interval,
+		"created_by":    h.CreatedBy,
+		"created_at":    h.CreatedAt,
+		"addresses":     h.Addresses,
+		"last_resolved": h.LastResolved,
+		"last_changed":  h.LastChanged,
+		"last_error":    h.LastError,
+		"failures":      h.Failures,
+		"next_check":    h.nextCheck,
+	}
+}
+
+func registerHostRuleRoutes(rg *gin.RouterGroup) {
+	rg.GET("/ddns", func(c *gin.Context) {
+		hostRuleMu.Lock()
+		defer hostRuleMu.Unlock()
+		out := make([]gin.H, 0, len(hostRules))
+		for _, h := range hostRules {
+			out = append(out, h.view())
+		}
+		c.JSON(http.StatusOK, gin.H{"rules": out})
+	})
+
+	type CreateHostRuleRequest struct {
+		Hostname     string `json:"hostname" binding:"required"`
+		Action       string `json:"action" binding:"required"`
+		PortProtocol string `json:"port_protocol"`
+		Interval     string `json:"interval"`
+	}
+	// POST /ddns resolves the hostname and adds a rule for each address.
+	// Unless ?force=true it is refused if a protected port would be left
+	// uncovered.
+	rg.POST("/ddns", func(c *gin.Context) {
+		var req CreateHostRuleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		hostname := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(req.Hostname)), ".")
+		if !reHostname.MatchString(hostname) || len(hostname) > 253 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hostname"})
+			return
+		}
+		if req.Action != "allow" && req.Action != "deny" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action", "details": "action must be allow or deny"})
+			return
+		}
+		h := &hostRule{
+			ID:           newID(),
+			Hostname:     hostname,
+			Action:       req.Action,
+			PortProtocol: strings.TrimSpace(req.PortProtocol),
+			CreatedBy:    c.GetString(ctxKeyName),
+			CreatedAt:    time.Now().UTC(),
+			interval:     defaultHostInterval,
+		}
+		if _, err := h.binding().args("192.0.2.1"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule", "details": err.Error()})
+			return
+		}
+		if req.Interval != "" {
+			d, err := time.ParseDuration(req.Interval)
+			if err != nil || d < minHostInterval || d > maxHostInterval {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval", "details": "interval must be between 1m and 24h"})
+				return
+			}
+			h.interval = d
+		}
+		h.Interval = h.interval.String()
+
+		hostRuleMu.Lock()
+		defer hostRuleMu.Unlock()
+		for _, other := range hostRules {
+			if other.Hostname == h.Hostname && other.Action == h.Action && other.PortProtocol == h.PortProtocol {
+				c.JSON(http.StatusConflict, gin.H{"error": "Rule already exists", "id": other.ID})
+				return
+			}
+		}
+		addrs, err := resolveHost(h.Hostname)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to resolve hostname", "details": err.Error()})
+			return
+		}
+		var owned [][]string
+		_, err = applyWithSnapshot("add hostname rule "+h.Hostname, 0, func() error {
+			var err error
+			owned, err = expandGroupRules([]*groupBinding{h.binding()}, addrs, nil, forceRequested(c))
+			return err
+		})
+		if abortOnApplyError(c, err, "Failed to add rules; previous state restored") {
+			return
+		}
+		h.Owned = owned[0]
+		recordHostResultLocked(h, addrs, true, nil)
+		hostRules = append(hostRules, h)
+		saveHostRulesLocked()
+		armHostTimerLocked(h, h.interval)
+		c.JSON(http.StatusOK, gin.H{"message": "Hostname rule created successfully", "rule": h.view()})
+	})
+
+	rg.GET("/ddns/:id", func(c *gin.Context) {
+		hostRuleMu.Lock()
+		defer hostRuleMu.Unlock()
+		_, h := findHostRuleLocked(c.Param("id"))
+		if h == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Hostname rule not found"})
+			return
+		}
+		c.JSON(http.StatusOK, h.view())
+	})
+
+	// POST /ddns/:id/resolve resolves the hostname now instead of waiting
+	// for the interval.
+	rg.POST("/ddns/:id/resolve", func(c *gin.Context) {
+		hostRuleMu.Lock()
+		defer hostRuleMu.Unlock()
+		_, h := findHostRuleLocked(c.Param("id"))
+		if h == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Hostname rule not found"})
+			return
+		}
+		if h.syncing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Refresh already in progress"})
+			return
+		}
+		armHostTimerLocked(h, 0)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Refresh started", "id": h.ID})
+	})
+
+	// DELETE /ddns/:id deletes the rules of the last known addresses.
+	rg.DELETE("/ddns/:id", func(c *gin.Context) {
+		hostRuleMu.Lock()
+		defer hostRuleMu.Unlock()
+		i, h := findHostRuleLocked(c.Param("id"))
+		if h == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Hostname rule not found"})
+			return
+		}
+		if h.syncing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Refresh in progress", "details": "try again once it has finished"})
+			return
+		}
+		_, err := applyWithSnapshot("delete hostname rule "+h.Hostname, 0, func() error {
+			_, err := expandGroupRules([]*groupBinding{h.binding()}, nil, h.Addresses, forceRequested(c))
+			return err
+		})
+		if abortOnApplyError(c, err, "Failed to delete rules; previous state restored") {
+			return
+		}
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		hostRules = append(hostRules[:i], hostRules[i+1:]...)
+		saveHostRulesLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Hostname rule deleted successfully", "id": h.ID, "rules_removed": len(h.Owned)})
+	})
+}
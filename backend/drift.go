@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	driftFileName  = "drift.json"
+	maxDriftEvents = 200
+)
+
+// driftWatchedFiles are compared against the last state the backend itself
+// produced; any other change was made outside the API.
+var driftWatchedFiles = []string{ufwUserRules, ufwUser6Rules}
+
+type driftEvent struct {
+	ID             string     `json:"id"`
+	DetectedAt     time.Time  `json:"detected_at"`
+	File           string     `json:"file"`
+	Diff           string     `json:"diff"`
+	Acknowledged   bool       `json:"acknowledged"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+}
+
+// driftSummary is reported in /status.
+type driftSummary struct {
+	Unacknowledged int        `json:"unacknowledged"`
+	LastDetectedAt *time.Time `json:"last_detected_at,omitempty"`
+}
+
+// driftState is persisted so changes made while the backend was down are
+// reported on the next start.
+type driftState struct {
+	Baseline map[string]string `json:"baseline"`
+	Events   []driftEvent      `json:"events"`
+}
+
+var (
+	driftMu      sync.Mutex
+	drift        driftState
+	driftStarted bool
+	// selfChanges counts ufw commands and file writes in progress on
+	// behalf of the API; changes seen meanwhile are our own.
+	selfChanges int
+)
+
+func driftPollInterval() time.Duration {
+	if v := os.Getenv("UFW_DRIFT_POLL_SEC"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 3600 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 30 * time.Second
+}
+
+func readDriftFiles() (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range driftWatchedFiles {
+		data, err := readUFWFile(p)
+		if err != nil {
+			return nil, err
+		}
+		out[p] = string(data)
+	}
+	return out, nil
+}
+
+// beginSelfChange and endSelfChange bracket a change made through the API.
+// Changes made outside the API before it are reported first, so that only
+// the API's own change is taken into the new baseline once none is in
+// progress.
+func beginSelfChange() {
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	if selfChanges == 0 && driftStarted {
+		checkDriftLocked()
+	}
+	selfChanges++
+}
+
+func endSelfChange() {
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	selfChanges--
+	if selfChanges > 0 || !driftStarted {
+		return
+	}
+	files, err := readDriftFiles()
+	if err != nil {
+		log.Printf("WARN: drift detection: failed to read rules: %v", err)
+		return
+	}
+	drift.Baseline = files
+	saveDriftStateLocked()
+}
+
+func saveDriftStateLocked() {
+	if err := writeJSONFile(dataPath(driftFileName), &drift); err != nil {
+		log.Printf("WARN: drift detection: failed to save state: %v", err)
+	}
+}
+
+// checkDrift compares the watched files with the baseline and records an
+// event for each one that changed.
+func checkDrift() {
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	if selfChanges > 0 {
+		return
+	}
+	checkDriftLocked()
+}
+
+func checkDriftLocked() {
+	files, err := readDriftFiles()
+	if err != nil {
+		log.Printf("WARN: drift detection: failed to read rules: %v", err)
+		return
+	}
+
+	changed := false
+	for _, p := range driftWatchedFiles {
+		old, cur := drift.Baseline[p], files[p]
+		if old == cur {
+			continue
+		}
+		ev := driftEvent{
+			ID:         newID(),
+			DetectedAt: time.Now().UTC(),
+			File:       p,
+			Diff:       unifiedDiff("a"+p, "b"+p, old, cur),
+		}
+		drift.Events = append(drift.Events, ev)
+		publishEvent("drift", ev)
+		log.Printf("WARN: %s was changed outside the API", p)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if n := len(drift.Events); n > maxDriftEvents {
+		drift.Events = append([]driftEvent(nil), drift.Events[n-maxDriftEvents:]...)
+	}
+	drift.Baseline = files
+	saveDriftStateLocked()
+}
+
+// startDriftDetection loads the saved baseline, reports changes made since,
+// and watches the rules directory with inotify, polling where that is not
+// available.
+func startDriftDetection() {
+	driftMu.Lock()
+	found, err := readJSONFile(dataPath(driftFileName), &drift)
+	if err != nil {
+		log.Printf("WARN: drift detection: ignoring unreadable %s: %v", driftFileName, err)
+		found = false
+	}
+	if !found || drift.Baseline == nil {
+		files, err := readDriftFiles()
+		if err != nil {
+			driftMu.Unlock()
+			log.Printf("WARN: drift detection disabled: %v", err)
+			return
+		}
+		drift = driftState{Baseline: files}
+		saveDriftStateLocked()
+	}
+	driftStarted = true
+	driftMu.Unlock()
+
+	checkDrift()
+
+	go func() {
+		var debounce *time.Timer
+		err := watchFiles(filepath.Dir(ufwUserRules), driftWatchedFiles, func() {
+			// ufw rewrites both files per command; check once they settle.
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.AfterFunc(500*time.Millisecond, checkDrift)
+		})
+		log.Printf("WARN: drift detection: file watch unavailable (%v), polling every %s", err, driftPollInterval())
+		for range time.Tick(driftPollInterval()) {
+			checkDrift()
+		}
+	}()
+}
+
+func currentDriftSummary() *driftSummary {
+	driftMu.Lock()
+	defer driftMu.Unlock()
+	if !driftStarted {
+		return nil
+	}
+	s := &driftSummary{}
+	for i := range drift.Events {
+		if !drift.Events[i].Acknowledged {
+			s.Unacknowledged++
+		}
+	}
+	if n := len(drift.Events); n > 0 {
+		t := drift.Events[n-1].DetectedAt
+		s.LastDetectedAt = &t
+	}
+	return s
+}
+
+func registerDriftRoutes(rg *gin.RouterGroup) {
+	// GET /drift lists out-of-band changes, newest first; ?all=true also
+	// includes acknowledged ones.
+	rg.GET("/drift", func(c *gin.Context) {
+		all, _ := strconv.ParseBool(c.Query("all"))
+		driftMu.Lock()
+		events := []driftEvent{}
+		for i := len(drift.Events) - 1; i >= 0; i-- {
+			if all || !drift.Events[i].Acknowledged {
+				events = append(events, drift.Events[i])
+			}
+		}
+		driftMu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"events": events, "summary": currentDriftSummary()})
+	})
+
+	type AckRequest struct {
+		IDs []string `json:"ids"`
+	}
+	// POST /drift/ack acknowledges the given events, or all of them if ids
+	// is empty.
+	rg.POST("/drift/ack", func(c *gin.Context) {
+		var req AckRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+				return
+			}
+		}
+		ids := map[string]bool{}
+		for _, id := range req.IDs {
+			ids[id] = true
+		}
+
+		driftMu.Lock()
+		now := time.Now().UTC()
+		acked := 0
+		for i := range drift.Events {
+			ev := &drift.Events[i]
+			if ev.Acknowledged || (len(ids) > 0 && !ids[ev.ID]) {
+				continue
+			}
+			ev.Acknowledged = true
+			ev.AcknowledgedAt = &now
+			acked++
+		}
+		if acked > 0 {
+			saveDriftStateLocked()
+		}
+		driftMu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"message": "Drift acknowledged", "acknowledged": acked})
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The event stream pushes what happens to the firewall as Server-Sent
+// Events: packets logged by ufw ("traffic"), bans ("ban"), audited changes
+// that ran ufw commands ("change") and rule files changed outside the API
+// ("drift"). The ufw log is only followed while someone is subscribed.
+// Recent events are kept so a client reconnecting with Last-Event-ID does
+// not miss any.
+
+const (
+	eventBacklog       = 256
+	eventSubscriberCap = 256
+	eventHeartbeat     = 15 * time.Second
+)
+
+var eventTypes = []string{"traffic", "ban", "change", "drift"}
+
+type streamEvent struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+type eventSubscriber struct {
+	ch      chan *streamEvent
+	dropped int
+}
+
+var (
+	eventMu      sync.Mutex
+	eventSeq     uint64
+	eventRecent  []*streamEvent
+	eventSubs    = map[*eventSubscriber]struct{}{}
+	eventLogStop chan struct{}
+)
+
+// publishEvent sends an event to every subscriber. A subscriber too slow to
+// keep up misses events rather than holding up the publisher.
+func publishEvent(typ string, data any) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventSeq++
+	ev := &streamEvent{ID: eventSeq, Type: typ, Time: time.Now().UTC(), Data: data}
+	eventRecent = append(eventRecent, ev)
+	if len(eventRecent) > eventBacklog {
+		eventRecent = eventRecent[len(eventRecent)-eventBacklog:]
+	}
+	for s := range eventSubs {
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// subscribeEvents registers a subscriber and returns the kept events after
+// lastID, starting to follow the ufw log for the first subscriber.
+func subscribeEvents(lastID uint64) (*eventSubscriber, []*streamEvent) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	s := &eventSubscriber{ch: make(chan *streamEvent, eventSubscriberCap)}
+	eventSubs[s] = struct{}{}
+	if eventLogStop == nil {
+		eventLogStop = make(chan struct{})
+		followFile(ufwLogPath(), eventLogStop, func(line string) {
+			if ev, ok := parseUFWLogLine(line, time.Now()); ok {
+				publishEvent("traffic", ev)
+			}
+		})
+	}
+	var backlog []*streamEvent
+	if lastID > 0 {
+		for _, ev := range eventRecent {
+			if ev.ID > lastID {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	return s, backlog
+}
+
+// unsubscribe removes s, and stops following the ufw log after the last
+// subscriber.
+func (s *eventSubscriber) unsubscribe() {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	delete(eventSubs, s)
+	if len(eventSubs) == 0 && eventLogStop != nil {
+		close(eventLogStop)
+		eventLogStop = nil
+	}
+}
+
+// takeDropped returns and resets the number of events s missed.
+func (s *eventSubscriber) takeDropped() int {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+// eventFilter selects events by type and, for traffic, by the filters of
+// the traffic endpoints. src also applies to the address of a ban.
+type eventFilter struct {
+	types   map[string]bool
+	traffic *trafficFilter
+}
+
+func parseEventFilter(c *gin.Context) (*eventFilter, error) {
+	tf, err := parseTrafficFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	f := &eventFilter{types: map[string]bool{}, traffic: tf}
+	if v := c.Query("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			known := false
+			for _, et := range eventTypes {
+				known = known || t == et
+			}
+			if !known {
+				return nil, fmt.Errorf("types: unknown event type %q, use %s", t, strings.Join(eventTypes, ", "))
+			}
+			f.types[t] = true
+		}
+	} else {
+		for _, et := range eventTypes {
+			f.types[et] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *eventFilter) match(ev *streamEvent) bool {
+	if !f.types[ev.Type] {
+		return false
+	}
+	switch data := ev.Data.(type) {
+	case ufwLogEvent:
+		return f.traffic.match(data)
+	case banRecord:
+		return f.traffic.src == nil || f.traffic.src.Contains(net.ParseIP(data.IP))
+	}
+	return true
+}
+
+func writeStreamEvent(c *gin.Context, id uint64, typ string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", typ, payload)
+	return err
+}
+
+func registerEventRoutes(rg *gin.RouterGroup) {
+	// GET /events/stream?types=&action=&src=&dst=&port=&proto=&in= streams
+	// events as text/event-stream until the client disconnects. types is a
+	// comma-separated subset of traffic, ban, change and drift; the other
+	// filters are those of /traffic/events. A Last-Event-ID header, or
+	// last_event_id, replays the kept events after that ID.
+	rg.GET("/events/stream", func(c *gin.Context) {
+		f, err := parseEventFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter", "details": err.Error()})
+			return
+		}
+		var lastID uint64
+		if v := c.GetHeader("Last-Event-ID"); v != "" {
+			lastID, _ = strconv.ParseUint(v, 10, 64)
+		} else if v := c.Query("last_event_id"); v != "" {
+			if lastID, err = strconv.ParseUint(v, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last_event_id"})
+				return
+			}
+		}
+
+		sub, backlog := subscribeEvents(lastID)
+		defer sub.unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		if _, err := fmt.Fprintf(c.Writer, "retry: %d\n\n", (5 * time.Second).Milliseconds()); err != nil {
+			return
+		}
+		for _, ev := range backlog {
+			if f.match(ev) {
+				if err := writeStreamEvent(c, ev.ID, ev.Type, ev); err != nil {
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case ev := <-sub.ch:
+				if n := sub.takeDropped(); n > 0 {
+					if err := writeStreamEvent(c, 0, "dropped", gin.H{"count": n}); err != nil {
+						return
+					}
+				}
+				if !f.match(ev) {
+					continue
+				}
+				if err := writeStreamEvent(c, ev.ID, ev.Type, ev); err != nil {
+					return
+				}
+			}
+			c.Writer.Flush()
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rules created with a ttl or expires_at are recorded here and deleted once
+// they expire. The records are persisted so a restart does not keep them.
+
+const (
+	expiringRulesFile = "expiring-rules.json"
+	minRuleTTL        = time.Minute
+	maxRuleTTL        = 365 * 24 * time.Hour
+	expiryRetryDelay  = time.Minute
+	maxExpiryRetry    = time.Hour
+)
+
+var errRuleNotExpiring = errors.New("rule already exists without expiry")
+
+// ruleExpiry is embedded in the requests that create rules. At most one of
+// TTL (a Go duration such as "30m") and ExpiresAt (RFC 3339) may be set.
+type ruleExpiry struct {
+	TTL       string `json:"ttl,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+func (e ruleExpiry) isSet() bool {
+	return e.TTL != "" || e.ExpiresAt != ""
+}
+
+// resolve returns the expiry time, or the zero time if none was requested.
+func (e ruleExpiry) resolve() (time.Time, error) {
+	now := time.Now().UTC()
+	var at time.Time
+	switch {
+	case e.TTL != "" && e.ExpiresAt != "":
+		return time.Time{}, fmt.Errorf("set either ttl or expires_at, not both")
+	case e.TTL != "":
+		d, err := time.ParseDuration(e.TTL)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid ttl: %w", err)
+		}
+		at = now.Add(d)
+	case e.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, e.ExpiresAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires_at: expected an RFC 3339 time")
+		}
+		at = t.UTC()
+	default:
+		return time.Time{}, nil
+	}
+	if d := at.Sub(now); d < minRuleTTL || d > maxRuleTTL {
+		return time.Time{}, fmt.Errorf("expiry must be between 1 minute and 365 days from now")
+	}
+	return at, nil
+}
+
+type tempRule struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule"`
+	Args      []string  `json:"args"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// retryAt delays the next attempt after a failed removal; the delay
+	// doubles with each failure in a row, up to maxExpiryRetry.
+	retryAt  time.Time
+	failures int
+}
+
+func (t *tempRule) retryDelay() time.Duration {
+	d := expiryRetryDelay
+	for i := 1; i < t.failures && d < maxExpiryRetry; i++ {
+		d *= 2
+	}
+	return min(d, maxExpiryRetry)
+}
+
+// expiringRuleStatus is reported in /status. Numbers are the rules currently
+// matching it, IPv4 and IPv6, found on a best-effort basis.
+type expiringRuleStatus struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Numbers   []int     `json:"numbers"`
+}
+
+var (
+	expiryMu    sync.Mutex
+	tempRules   []*tempRule
+	expiryTimer *time.Timer
+)
+
+func sameArgs(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func saveTempRulesLocked() {
+	if err := writeJSONFile(dataPath(expiringRulesFile), tempRules); err != nil {
+		log.Printf("WARN: rule expiry: failed to save %s: %v", expiringRulesFile, err)
+	}
+}
+
+func findTempRuleLocked(args []string) *tempRule {
+	for _, t := range tempRules {
+		if sameArgs(t.Args, args) {
+			return t
+		}
+	}
+	return nil
+}
+
+func hasRuleExpiry(args []string) bool {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	return findTempRuleLocked(ruleArgsWithoutComment(args)) != nil
+}
+
+// setRuleExpiry schedules the removal of the rule added with args, replacing
+// the expiry of an existing record for the same rule.
+func setRuleExpiry(args []string, expiresAt time.Time, createdBy string) tempRule {
+	args = ruleArgsWithoutComment(args)
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+
+	t := findTempRuleLocked(args)
+	if t == nil {
+		t = &tempRule{
+			ID:        newID(),
+			Rule:      "ufw " + strings.Join(args, " "),
+			Args:      args,
+			CreatedBy: createdBy,
+			CreatedAt: time.Now().UTC(),
+		}
+		tempRules = append(tempRules, t)
+	}
+	t.ExpiresAt, t.retryAt, t.failures, t.LastError = expiresAt, time.Time{}, 0, ""
+	saveTempRulesLocked()
+	scheduleExpiryLocked()
+	return *t
+}
+
+// clearRuleExpiry drops the expiry of the rule added with args, if it has
+// one, so the rule stays.
+func clearRuleExpiry(args []string) {
+	args = ruleArgsWithoutComment(args)
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+
+	for i, t := range tempRules {
+		if sameArgs(t.Args, args) {
+			log.Printf("Rule %s re-added without expiry; expiry %s cancelled", t.Rule, t.ID)
+			tempRules = append(tempRules[:i], tempRules[i+1:]...)
+			saveTempRulesLocked()
+			scheduleExpiryLocked()
+			return
+		}
+	}
+}
+
+// scheduleExpiryLocked arms a single timer for the earliest pending removal.
+func scheduleExpiryLocked() {
+	if expiryTimer != nil {
+		expiryTimer.Stop()
+		expiryTimer = nil
+	}
+	var next time.Time
+	for _, t := range tempRules {
+		at := t.ExpiresAt
+		if t.retryAt.After(at) {
+			at = t.retryAt
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	expiryTimer = time.AfterFunc(time.Until(next), expireDueRules)
+}
+
+// expireDueRules removes the rules whose expiry has passed. A rule whose
+// removal would leave a protected port uncovered is kept and retried, so an
+// expiry cannot lock out the admin; since nothing changed, the refusal is
+// not audited. Failed attempts back off up to maxExpiryRetry. expiryMu is
+// not held while ufw runs, since auditSystem waits for API changes in
+// progress.
+func expireDueRules() {
+	now := time.Now()
+	expiryMu.Lock()
+	var due []tempRule
+	for _, t := range tempRules {
+		if !now.Before(t.ExpiresAt) && !now.Before(t.retryAt) {
+			due = append(due, *t)
+		}
+	}
+	expiryMu.Unlock()
+
+	for i := range due {
+		t := &due[i]
+		var lockout error
+		err := auditSystem("expire rule "+t.ID, func() error {
+			if lockout = checkRuleDeleteLockout(t.Rule); lockout != nil {
+				return nil
+			}
+			return deleteRuleByArgs(t.Args)
+		})
+		if err == nil {
+			err = lockout
+		}
+
+		expiryMu.Lock()
+		for j, cur := range tempRules {
+			if cur.ID != t.ID {
+				continue
+			}
+			if err != nil {
+				cur.failures++
+				delay := cur.retryDelay()
+				cur.retryAt = time.Now().Add(delay)
+				if cur.LastError != err.Error() {
+					log.Printf("WARN: rule expiry: failed to remove %s (%s), retrying in %s: %v", t.ID, t.Rule, delay, err)
+					cur.LastError = err.Error()
+					saveTempRulesLocked()
+				}
+			} else {
+				log.Printf("Expired rule %s removed: %s", t.ID, t.Rule)
+				tempRules = append(tempRules[:j], tempRules[j+1:]...)
+				saveTempRulesLocked()
+			}
+			break
+		}
+		expiryMu.Unlock()
+	}
+
+	expiryMu.Lock()
+	scheduleExpiryLocked()
+	expiryMu.Unlock()
+}
+
+// startRuleExpiry loads the recorded rules; those that expired while the
+// backend was stopped are removed right away.
+func startRuleExpiry() {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	if _, err := readJSONFile(dataPath(expiringRulesFile), &tempRules); err != nil {
+		log.Printf("WARN: rule expiry: ignoring unreadable %s: %v", expiringRulesFile, err)
+		tempRules = nil
+	}
+	scheduleExpiryLocked()
+}
+
+func expiringRulesStatus(status *UFWStatus) []expiringRuleStatus {
+	expiryMu.Lock()
+	list := make([]tempRule, 0, len(tempRules))
+	for _, t := range tempRules {
+		list = append(list, *t)
+	}
+	expiryMu.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+
+	live := parseStatusRules(status.Rules)
+	out := make([]expiringRuleStatus, 0, len(list))
+	for _, t := range list {
+		out = append(out, expiringRuleStatus{ID: t.ID, Rule: t.Rule, ExpiresAt: t.ExpiresAt, Numbers: ruleNumbers(t.Rule, live)})
+	}
+	return out
+}
+
+// ruleNumbers returns the numbers of the live rules matching rule, a
+// "ufw ..." command line.
+func ruleNumbers(rule string, live []statusRule) []int {
+	numbers := []int{}
+	if want, ok := parseAddedRule(rule); ok {
+		for _, r := range live {
+			if r.Action == want.Action && r.Direction == want.Direction &&
+				canonicalAddr(r.To) == canonicalAddr(want.To) && canonicalAddr(r.From) == canonicalAddr(want.From) {
+				numbers = append(numbers, r.Number)
+			}
+		}
+	}
+	return numbers
+}
+
+// checkRuleDeleteLockout runs checkDeleteLockout for each live rule matching
+// rule.
+func checkRuleDeleteLockout(rule string) error {
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	for _, n := range ruleNumbers(rule, parseStatusRules(status.Rules)) {
+		if err := checkDeleteLockout(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRuleWithExpiry adds the rule built by one of the *RuleArgs functions and
+// schedules its removal if the request set an expiry. On failure it writes
+// the response and returns false; a rule without expiry yields nil.
+func addRuleWithExpiry(c *gin.Context, exp ruleExpiry, errMsg string, args []string, err error) (*tempRule, bool) {
+	expiresAt, expErr := exp.resolve()
+	if expErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry", "details": expErr.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errMsg, "details": err.Error()})
+		return nil, false
+	}
+	added, err := addUFWRule(args)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errMsg, "details": err.Error()})
+		return nil, false
+	}
+	if expiresAt.IsZero() {
+		// Adding a rule without expiry makes it permanent, even if it
+		// was temporary.
+		clearRuleExpiry(args)
+		return nil, true
+	}
+	if !added && !hasRuleExpiry(args) {
+		c.JSON(http.StatusConflict, gin.H{"error": errMsg, "details": errRuleNotExpiring.Error()})
+		return nil, false
+	}
+	t := setRuleExpiry(args, expiresAt, c.GetString(ctxKeyName))
+	return &t, true
+}
+
+// withExpiry adds the expiry of a temporary rule to a response.
+func withExpiry(resp gin.H, t *tempRule) gin.H {
+	if t != nil {
+		resp["expiry_id"] = t.ID
+		resp["expires_at"] = t.ExpiresAt
+	}
+	return resp
+}
+
+func registerExpiryRoutes(rg *gin.RouterGroup) {
+	rg.GET("/rules/expiring", func(c *gin.Context) {
+		expiryMu.Lock()
+		list := make([]tempRule, 0, len(tempRules))
+		for _, t := range tempRules {
+			list = append(list, *t)
+		}
+		expiryMu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"rules": list})
+	})
+
+	// POST /rules/expiring/:id/extend sets a new expiry; ttl counts from now.
+	rg.POST("/rules/expiring/:id/extend", func(c *gin.Context) {
+		var req ruleExpiry
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !req.isSet() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry", "details": "ttl or expires_at is required"})
+			return
+		}
+		expiresAt, err := req.resolve()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry", "details": err.Error()})
+			return
+		}
+
+		expiryMu.Lock()
+		defer expiryMu.Unlock()
+		for _, t := range tempRules {
+			if t.ID != c.Param("id") {
+				continue
+			}
+			t.ExpiresAt, t.retryAt, t.failures, t.LastError = expiresAt, time.Time{}, 0, ""
+			saveTempRulesLocked()
+			scheduleExpiryLocked()
+			c.JSON(http.StatusOK, gin.H{"message": "Expiry updated successfully", "rule": *t})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Expiring rule not found"})
+	})
+
+	// DELETE /rules/expiring/:id makes the rule permanent; with ?remove=true
+	// the rule is deleted now instead, unless it is the last one allowing a
+	// protected port and force is not set.
+	rg.DELETE("/rules/expiring/:id", func(c *gin.Context) {
+		remove, _ := strconv.ParseBool(c.Query("remove"))
+		id := c.Param("id")
+
+		expiryMu.Lock()
+		var found *tempRule
+		for _, t := range tempRules {
+			if t.ID == id {
+				found = t
+				break
+			}
+		}
+		expiryMu.Unlock()
+		if found == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expiring rule not found"})
+			return
+		}
+		if remove {
+			if !forceRequested(c) && abortOnLockout(c, checkRuleDeleteLockout(found.Rule)) {
+				return
+			}
+			if err := deleteRuleByArgs(found.Args); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove rule", "details": err.Error()})
+				return
+			}
+		}
+
+		expiryMu.Lock()
+		for j, t := range tempRules {
+			if t.ID == id {
+				tempRules = append(tempRules[:j], tempRules[j+1:]...)
+				saveTempRulesLocked()
+				scheduleExpiryLocked()
+				break
+			}
+		}
+		expiryMu.Unlock()
+
+		msg := "Expiry cancelled; rule kept"
+		if remove {
+			msg = "Rule removed"
+		}
+		c.JSON(http.StatusOK, gin.H{"message": msg, "id": id, "rule": found.Rule})
+	})
+}
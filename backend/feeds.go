@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A feed is a published blocklist (Spamhaus DROP/EDROP, FireHOL netsets or
+// any list with one address or CIDR per line) fetched from a URL or read
+// from a local file. Its entries are kept in two ipsets of its own, one per
+// family, so they are dropped like any other managed set. Every sync diffs
+// the fetched list against the entries applied and only loads the changes.
+
+const (
+	feedsFile           = "feeds.json"
+	feedSetPrefix       = "feed-"
+	defaultFeedInterval = time.Hour
+	minFeedInterval     = 5 * time.Minute
+	maxFeedInterval     = 7 * 24 * time.Hour
+	feedRetryDelay      = 10 * time.Minute
+	feedFetchTimeout    = time.Minute
+	maxFeedSize         = 64 << 20
+
+	// Entries broader than these prefixes are skipped: a feed must never
+	// drop a large part of the address space, let alone all of it.
+	minFeedPrefix4 = 8
+	minFeedPrefix6 = 16
+)
+
+var (
+	reFeedName = regexp.MustCompile(`^[a-z0-9_\-]{1,12}$`)
+
+	errNotModified = errors.New("source not modified")
+
+	feedClient = &http.Client{Timeout: feedFetchTimeout}
+)
+
+type feed struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Interval  string    `json:"interval"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	LastSync    *time.Time `json:"last_sync,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Entries     int        `json:"entries"`
+	Skipped     int        `json:"skipped"`
+	Added       int        `json:"added"`
+	Removed     int        `json:"removed"`
+
+	// Validators of the last fetch, sent back so an unchanged source is
+	// not downloaded and parsed again.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	interval time.Duration
+	timer    *time.Timer
+	nextSync time.Time
+	syncing  bool
+}
+
+var (
+	feedMu sync.Mutex
+	feeds  = map[string]*feed{}
+)
+
+func feedSetName(name, family string) string {
+	if family == "inet6" {
+		return feedSetPrefix + name + "-6"
+	}
+	return feedSetPrefix + name
+}
+
+// validateSource accepts an http(s) URL or an absolute file path.
+func validateSource(source string) error {
+	if filepath.IsAbs(source) {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("source must be an http(s) URL or an absolute file path")
+	}
+	return nil
+}
+
+// sourceData is the content of a source along with the validators used to
+// detect that it did not change.
+type sourceData struct {
+	Body         []byte
+	ETag         string
+	LastModified string
+}
+
+// fetchSource downloads or reads source. It returns errNotModified when the
+// validators of the previous fetch still match.
+func fetchSource(source, etag, lastModified string) (*sourceData, error) {
+	if filepath.IsAbs(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		mod := st.ModTime().UTC().Format(time.RFC3339Nano)
+		if mod == lastModified {
+			return nil, errNotModified
+		}
+		body, err := readSourceBody(f)
+		if err != nil {
+			return nil, err
+		}
+		return &sourceData{Body: body, LastModified: mod}, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	req.Header.Set("User-Agent", "ufw-panel")
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, errNotModified
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	body, err := readSourceBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceData{Body: body, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+func readSourceBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxFeedSize+1))
+	if err == nil && len(body) > maxFeedSize {
+		err = fmt.Errorf("source larger than %d bytes", maxFeedSize)
+	}
+	return body, err
+}
+
+// parseFeedEntries extracts the addresses of a blocklist, split by family.
+// Comments start with # (plain lists, FireHOL) or ; (Spamhaus), and only the
+// first field of a line is used. Lines holding a JSON object, as in the
+// Spamhaus JSON feeds, take the address from "cidr". Invalid and overly
+// broad entries are counted in skipped.
+func parseFeedEntries(body []byte) (v4, v6 []string, skipped int) {
+	for _, ln := range strings.Split(string(body), "\n") {
+		ln = strings.TrimSpace(ln)
+		if strings.HasPrefix(ln, "{") {
+			var obj struct {
+				CIDR string `json:"cidr"`
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal([]byte(ln), &obj); err != nil || obj.CIDR == "" {
+				if obj.Type != "metadata" {
+					skipped++
+				}
+				continue
+			}
+			ln = obj.CIDR
+		}
+		if i := strings.IndexAny(ln, "#;"); i != -1 {
+			ln = ln[:i]
+		}
+		fields := strings.Fields(ln)
+		if len(fields) == 0 {
+			continue
+		}
+		switch e := fields[0]; feedEntryFamily(e) {
+		case "inet":
+			v4 = append(v4, e)
+		case "inet6":
+			v6 = append(v6, e)
+		default:
+			skipped++
+		}
+	}
+	return v4, v6, skipped
+}
+
+// feedEntryFamily returns the family of an address or CIDR taken from a
+// source, or "" if it is invalid or broader than the minimum prefix.
+func feedEntryFamily(e string) string {
+	if e == "" || validateIPorCIDR(e) != nil {
+		return ""
+	}
+	ip, ipnet, err := net.ParseCIDR(e)
+	if err != nil {
+		ip = net.ParseIP(e)
+	}
+	family, minPrefix := "inet6", minFeedPrefix6
+	if ip.To4() != nil {
+		family, minPrefix = "inet", minFeedPrefix4
+	}
+	if ipnet != nil {
+		if ones, _ := ipnet.Mask.Size(); ones < minPrefix {
+			return ""
+		}
+	}
+	return family
+}
+
+// diffEntries returns the entries of want missing from have and those of
+// have missing from want. Both lists must be sorted.
+func diffEntries(have, want []string) (add, remove []string) {
+	i, j := 0, 0
+	for i < len(have) || j < len(want) {
+		switch {
+		case j == len(want) || (i < len(have) && have[i] < want[j]):
+			remove = append(remove, have[i])
+			i++
+		case i == len(have) || want[j] < have[i]:
+			add = append(add, want[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return add, remove
+}
+
+// applyFeedEntries brings the feed's sets in line with the fetched entries.
+// It must be called with mutationMu held.
+func applyFeedEntries(name string, entries map[string][]string) (added, removed int, err error) {
+	ipsetMu.Lock()
+	defer ipsetMu.Unlock()
+	for _, family := range []string{"inet", "inet6"} {
+		s := ipsets[feedSetName(name, family)]
+		if s == nil {
+			return added, removed, fmt.Errorf("set %s is missing", feedSetName(name, family))
+		}
+		a, r, err := syncIPSetEntriesLocked(s, entries[family])
+		if err != nil {
+			return added, removed, err
+		}
+		added += a
+		removed += r
+	}
+	return added, removed, nil
+}
+
+func saveFeedsLocked() {
+	list := make([]*feed, 0, len(feeds))
+	for _, f := range feeds {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := writeJSONFile(dataPath(feedsFile), list); err != nil {
+		log.Printf("WARN: feeds: failed to save %s: %v", feedsFile, err)
+	}
+}
+
+// armFeedTimerLocked schedules the next sync of f after delay.
+func armFeedTimerLocked(f *feed, delay time.Duration) {
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	f.nextSync = time.Now().Add(delay).UTC()
+	name := f.Name
+	f.timer = time.AfterFunc(delay, func() { syncFeed(name) })
+}
+
+// syncFeed fetches the feed and applies the difference. feedMu is not held
+// while the source is fetched or the sets change, so a slow source does not
+// block the API.
+func syncFeed(name string) {
+	feedMu.Lock()
+	f := feeds[name]
+	if f == nil || f.syncing {
+		feedMu.Unlock()
+		return
+	}
+	f.syncing = true
+	source, etag, lastModified := f.Source, f.ETag, f.LastModified
+	feedMu.Unlock()
+
+	var added, removed, count, skipped int
+	data, err := fetchSource(source, etag, lastModified)
+	if err == nil {
+		var v4, v6 []string
+		v4, v6, skipped = parseFeedEntries(data.Body)
+		entries := map[string][]string{}
+		if entries["inet"], err = normalizeIPSetEntries("inet", v4); err == nil {
+			entries["inet6"], err = normalizeIPSetEntries("inet6", v6)
+		}
+		count = len(entries["inet"]) + len(entries["inet6"])
+		if err == nil && count == 0 && skipped > 0 {
+			// Most likely an error page rather than an emptied list.
+			err = fmt.Errorf("no valid entries found, %d lines skipped", skipped)
+		}
+		if err == nil {
+			err = auditSystem("sync feed "+name, func() error {
+				var aerr error
+				added, removed, aerr = applyFeedEntries(name, entries)
+				return aerr
+			})
+		}
+	}
+
+	feedMu.Lock()
+	defer feedMu.Unlock()
+	f.syncing = false
+	if feeds[name] != f {
+		return // deleted meanwhile
+	}
+	now := time.Now().UTC()
+	f.LastSync = &now
+	switch {
+	case errors.Is(err, errNotModified):
+		f.LastSuccess, f.LastError = &now, ""
+		f.Added, f.Removed = 0, 0
+	case err != nil:
+		log.Printf("WARN: feed %s: sync failed: %v", name, err)
+		f.LastError = err.Error()
+	default:
+		if added > 0 || removed > 0 {
+			log.Printf("Feed %s synced: %d entries, %d added, %d removed", name, count, added, removed)
+		}
+		f.LastSuccess, f.LastError = &now, ""
+		f.Entries, f.Skipped, f.Added, f.Removed = count, skipped, added, removed
+		f.ETag, f.LastModified = data.ETag, data.LastModified
+	}
+	saveFeedsLocked()
+
+	delay := f.interval
+	if err != nil && !errors.Is(err, errNotModified) && feedRetryDelay < delay {
+		delay = feedRetryDelay
+	}
+	armFeedTimerLocked(f, delay)
+}
+
+// startFeeds loads the saved feeds and schedules their next sync; feeds
+// that were due while the backend was stopped sync right away. It must run
+// after startIPSets.
+func startFeeds() {
+	feedMu.Lock()
+	defer feedMu.Unlock()
+	var list []*feed
+	if _, err := readJSONFile(dataPath(feedsFile), &list); err != nil {
+		log.Printf("WARN: feeds: ignoring unreadable %s: %v", feedsFile, err)
+		return
+	}
+	for _, f := range list {
+		d, err := time.ParseDuration(f.Interval)
+		if err != nil {
+			log.Printf("WARN: feed %s: invalid interval %q, using %s", f.Name, f.Interval, defaultFeedInterval)
+			d = defaultFeedInterval
+		}
+		f.interval = d
+		feeds[f.Name] = f
+		delay := time.Duration(0)
+		if f.LastSync != nil {
+			delay = time.Until(f.LastSync.Add(d))
+		}
+		armFeedTimerLocked(f, delay)
+	}
+}
+
+func (f *feed) view() gin.H {
+	return gin.H{
+		"name":          f.Name,
+		"source":        f.Source,
+		"interval":      f.Interval,
+		"ipsets":        []string{ipsetPrefix + feedSetName(f.Name, "inet"), ipsetPrefix + feedSetName(f.Name, "inet6")},
+		"created_by":    f.CreatedBy,
+		"created_at":    f.CreatedAt,
+		"last_sync":     f.LastSync,
+		"last_success":  f.LastSuccess,
+		"last_error":    f.LastError,
+		"entries_count": f.Entries,
+		"skipped":       f.Skipped,
+		"added":         f.Added,
+		"removed":       f.Removed,
+		"syncing":       f.syncing,
+		"next_sync":     f.nextSync,
+	}
+}
+
+func registerFeedRoutes(rg *gin.RouterGroup) {
+	rg.GET("/feeds", func(c *gin.Context) {
+		feedMu.Lock()
+		defer feedMu.Unlock()
+		names := make([]string, 0, len(feeds))
+		for name := range feeds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := []gin.H{}
+		for _, name := range names {
+			out = append(out, feeds[name].view())
+		}
+		c.JSON(http.StatusOK, gin.H{"feeds": out})
+	})
+
+	type CreateFeedRequest struct {
+		Name     string `json:"name" binding:"required"`
+		Source   string `json:"source" binding:"required"`
+		Interval string `json:"interval"`
+	}
+	// POST /feeds subscribes to a blocklist. The first sync starts in the
+	// background; its outcome shows in the feed status.
+	rg.POST("/feeds", func(c *gin.Context) {
+		var req CreateFeedRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reFeedName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid feed name", "details": "1-12 lowercase letters, digits or _-"})
+			return
+		}
+		if err := validateSource(req.Source); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source", "details": err.Error()})
+			return
+		}
+		interval := defaultFeedInterval
+		if req.Interval != "" {
+			d, err := time.ParseDuration(req.Interval)
+			if err != nil || d < minFeedInterval || d > maxFeedInterval {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval", "details": "interval must be between 5m and 168h"})
+				return
+			}
+			interval = d
+		}
+
+		feedMu.Lock()
+		defer feedMu.Unlock()
+		if feeds[req.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Feed already exists"})
+			return
+		}
+
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		now := time.Now().UTC()
+		var created []*ipSet
+		for _, family := range []string{"inet", "inet6"} {
+			s := &ipSet{Name: feedSetName(req.Name, family), Family: family, Feed: req.Name, MaxElem: minIPSetMaxElem, Entries: []string{}, CreatedAt: now, UpdatedAt: now}
+			if ipsets[s.Name] != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "Set already exists", "details": s.Name})
+				return
+			}
+			if err := createIPSetLocked(s); err != nil {
+				for _, prev := range created {
+					if derr := deleteIPSetLocked(prev); derr != nil {
+						log.Printf("WARN: feed %s: failed to remove set %s: %v", req.Name, prev.Name, derr)
+					}
+				}
+				abortOnApplyError(c, err, "Failed to create feed sets; previous state restored")
+				return
+			}
+			created = append(created, s)
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+
+		f := &feed{
+			Name:      req.Name,
+			Source:    req.Source,
+			Interval:  interval.String(),
+			CreatedBy: c.GetString(ctxKeyName),
+			CreatedAt: now,
+			interval:  interval,
+		}
+		feeds[f.Name] = f
+		saveFeedsLocked()
+		armFeedTimerLocked(f, 0)
+		c.JSON(http.StatusOK, gin.H{"message": "Feed created; first sync started", "feed": f.view()})
+	})
+
+	rg.GET("/feeds/:name", func(c *gin.Context) {
+		feedMu.Lock()
+		defer feedMu.Unlock()
+		f := feeds[c.Param("name")]
+		if f == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+			return
+		}
+		c.JSON(http.StatusOK, f.view())
+	})
+
+	// POST /feeds/:name/sync starts a sync now instead of waiting for the
+	// interval.
+	rg.POST("/feeds/:name/sync", func(c *gin.Context) {
+		feedMu.Lock()
+		defer feedMu.Unlock()
+		f := feeds[c.Param("name")]
+		if f == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+			return
+		}
+		if f.syncing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Sync already in progress"})
+			return
+		}
+		armFeedTimerLocked(f, 0)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Sync started", "name": f.Name})
+	})
+
+	rg.DELETE("/feeds/:name", func(c *gin.Context) {
+		feedMu.Lock()
+		defer feedMu.Unlock()
+		f := feeds[c.Param("name")]
+		if f == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+			return
+		}
+
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		for _, family := range []string{"inet", "inet6"} {
+			s := ipsets[feedSetName(f.Name, family)]
+			if s == nil {
+				continue
+			}
+			if err := deleteIPSetLocked(s); err != nil {
+				_ = saveIPSetsLocked()
+				abortOnApplyError(c, err, "Failed to delete feed sets; previous state restored")
+				return
+			}
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		delete(feeds, f.Name)
+		saveFeedsLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Feed deleted successfully", "name": f.Name})
+	})
+}
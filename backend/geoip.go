@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeoIP rules restrict ports by country. The countries are expanded into
+// their networks from a local database, either a MaxMind DB file (.mmdb)
+// or a CSV file, and kept in a pair of IP sets per rule: a deny rule drops
+// the countries' sources, an allow rule drops every source outside them.
+// The database file is polled and the sets are updated when it changes.
+
+const (
+	geoipRulesFile    = "geoip-rules.json"
+	geoSetPrefix      = "geo-"
+	geoipPollInterval = time.Minute
+	maxGeoCountries   = 64
+)
+
+var (
+	reGeoRuleName = regexp.MustCompile(`^[a-z0-9_\-]{1,12}$`)
+	reCountryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+type geoDB struct {
+	Path       string    `json:"path"`
+	Format     string    `json:"format"`
+	Type       string    `json:"type,omitempty"`
+	BuildEpoch uint64    `json:"build_epoch,omitempty"`
+	ModTime    time.Time `json:"mod_time"`
+	Size       int64     `json:"size"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	Networks   int       `json:"networks"`
+	Countries  int       `json:"countries"`
+	Skipped    int       `json:"skipped,omitempty"`
+
+	// networks lists the networks of each country by family.
+	networks map[string]map[string][]string
+}
+
+type geoRule struct {
+	Name         string    `json:"name"`
+	Countries    []string  `json:"countries"`
+	Action       string    `json:"action"`
+	PortProtocol string    `json:"port_protocol,omitempty"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+var (
+	geoMu      sync.Mutex
+	geoRules   = map[string]*geoRule{}
+	geoData    *geoDB
+	geoLoadErr string
+)
+
+func geoipDBPath() string {
+	return os.Getenv("GEOIP_DB_PATH")
+}
+
+func geoSetName(name, family string) string {
+	if family == "inet6" {
+		return geoSetPrefix + name + "-6"
+	}
+	return geoSetPrefix + name
+}
+
+// loadGeoDB reads the database at path: a MaxMind DB file if it carries
+// MaxMind metadata, CSV otherwise.
+func loadGeoDB(path string) (*geoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	db := &geoDB{Path: path, ModTime: st.ModTime().UTC(), Size: st.Size(), networks: map[string]map[string][]string{}}
+	add := func(cc string, p netip.Prefix) {
+		family := "inet6"
+		if p.Addr().Is4() {
+			family = "inet"
+		}
+		if db.networks[cc] == nil {
+			db.networks[cc] = map[string][]string{}
+		}
+		db.networks[cc][family] = append(db.networks[cc][family], p.String())
+		db.Networks++
+	}
+
+	r, err := openMMDB(data)
+	if err != nil && bytes.Contains(data, mmdbMetadataMarker) {
+		// A MaxMind DB file that fails to parse is not a CSV file either.
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err == nil {
+		db.Format, db.Type, db.BuildEpoch = "mmdb", r.dbType, r.buildEpoch
+		// Many networks share a data record; decode each record once.
+		countries := map[uint64]string{}
+		err = r.walk(func(p netip.Prefix, off uint64) error {
+			cc, ok := countries[off]
+			if !ok {
+				v, err := r.decodeAt(off)
+				if err != nil {
+					return err
+				}
+				cc = mmdbCountry(v)
+				countries[off] = cc
+			}
+			if cc == "" {
+				db.Skipped++
+				return nil
+			}
+			add(cc, p)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+	} else {
+		db.Format = "csv"
+		if err := readGeoCSV(data, db, add); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+	if db.Networks == 0 {
+		return nil, fmt.Errorf("%s: no networks found", path)
+	}
+	db.Countries = len(db.networks)
+	db.LoadedAt = time.Now().UTC()
+	return db, nil
+}
+
+// mmdbCountry returns the country of a GeoIP2 Country record, falling back
+// to the registered country for networks without one.
+func mmdbCountry(v any) string {
+	rec, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && reCountryCode.MatchString(code) {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// readGeoCSV reads rows of "network,country" or "first,last,country", where
+// addresses may also be given as decimal integers (IP2Location). Rows that
+// do not parse, such as a header, are skipped.
+func readGeoCSV(data []byte, db *geoDB, add func(string, netip.Prefix)) error {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) < 2 {
+			db.Skipped++
+			continue
+		}
+		if p, err := netip.ParsePrefix(strings.TrimSpace(rec[0])); err == nil {
+			cc := strings.ToUpper(strings.TrimSpace(rec[1]))
+			if !reCountryCode.MatchString(cc) || cc == "ZZ" {
+				db.Skipped++
+				continue
+			}
+			add(cc, p.Masked())
+			continue
+		}
+		if len(rec) < 3 {
+			db.Skipped++
+			continue
+		}
+		first, ok1 := parseGeoAddr(rec[0])
+		last, ok2 := parseGeoAddr(rec[1])
+		cc := strings.ToUpper(strings.TrimSpace(rec[2]))
+		if !ok1 || !ok2 || first.Is4() != last.Is4() || last.Less(first) || !reCountryCode.MatchString(cc) || cc == "ZZ" {
+			db.Skipped++
+			continue
+		}
+		for _, p := range rangePrefixes(first, last) {
+			add(cc, p)
+		}
+	}
+}
+
+func parseGeoAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.Unmap(), true
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return netip.Addr{}, false
+	}
+	var b [16]byte
+	n.FillBytes(b[:])
+	if n.BitLen() <= 32 {
+		return netip.AddrFrom4([4]byte(b[12:])), true
+	}
+	return netip.AddrFrom16(b).Unmap(), true
+}
+
+// lastAddr returns the highest address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().As16()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		a = a.Unmap()
+	}
+	return a
+}
+
+// rangePrefixes splits the range first..last into the fewest prefixes.
+func rangePrefixes(first, last netip.Addr) []netip.Prefix {
+	var out []netip.Prefix
+	for first.IsValid() && !last.Less(first) {
+		bits := first.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(first, bits-1)
+			if p.Masked().Addr() != first || last.Less(lastAddr(p)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(first, bits)
+		out = append(out, p)
+		first = lastAddr(p).Next()
+	}
+	return out
+}
+
+// geoEntries returns the networks of countries for family, normalized for
+// an IP set.
+func (db *geoDB) geoEntries(countries []string, family string) ([]string, error) {
+	var list []string
+	for _, cc := range countries {
+		list = append(list, db.networks[cc][family]...)
+	}
+	return normalizeIPSetEntries(family, list)
+}
+
+func saveGeoRulesLocked() {
+	list := make([]*geoRule, 0, len(geoRules))
+	for _, r := range geoRules {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := writeJSONFile(dataPath(geoipRulesFile), list); err != nil {
+		log.Printf("WARN: geoip: failed to save %s: %v", geoipRulesFile, err)
+	}
+}
+
+// reloadGeoDB loads the database again if its file changed since it was
+// last loaded, or unconditionally with force. It reports whether a new
+// database is in use.
+func reloadGeoDB(force bool) (bool, error) {
+	path := geoipDBPath()
+	if path == "" {
+		return false, errors.New("no GeoIP database configured; set GEOIP_DB_PATH")
+	}
+	st, err := os.Stat(path)
+	if err == nil && !force {
+		geoMu.Lock()
+		cur := geoData
+		geoMu.Unlock()
+		if cur != nil && cur.ModTime.Equal(st.ModTime().UTC()) && cur.Size == st.Size() {
+			return false, nil
+		}
+	}
+	var db *geoDB
+	if err == nil {
+		db, err = loadGeoDB(path)
+	}
+
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	if err != nil {
+		// Keep using the previous database, if any.
+		geoLoadErr = err.Error()
+		return false, err
+	}
+	geoData, geoLoadErr = db, ""
+	log.Printf("GeoIP database loaded: %s (%s, %d networks in %d countries)", db.Path, db.Format, db.Networks, db.Countries)
+	return true, nil
+}
+
+// applyGeoRules brings the sets of every GeoIP rule in line with the
+// database. It must be called with mutationMu held.
+func applyGeoRules() {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	if geoData == nil {
+		return
+	}
+	ipsetMu.Lock()
+	defer ipsetMu.Unlock()
+	for _, r := range geoRules {
+		r.LastError = ""
+		for _, family := range []string{"inet", "inet6"} {
+			s := ipsets[geoSetName(r.Name, family)]
+			if s == nil {
+				r.LastError = fmt.Sprintf("set %s is missing", geoSetName(r.Name, family))
+				break
+			}
+			entries, err := geoData.geoEntries(r.Countries, family)
+			if err == nil {
+				_, _, err = syncIPSetEntriesLocked(s, entries)
+			}
+			if err != nil {
+				log.Printf("WARN: geoip rule %s: failed to update %s: %v", r.Name, s.Name, err)
+				r.LastError = err.Error()
+				break
+			}
+		}
+	}
+	saveGeoRulesLocked()
+}
+
+// startGeoIP loads the GeoIP rules and database, updates the rules' sets
+// from it and starts polling the database file. It must run after
+// startIPSets.
+func startGeoIP() {
+	geoMu.Lock()
+	var list []*geoRule
+	if _, err := readJSONFile(dataPath(geoipRulesFile), &list); err != nil {
+		log.Printf("WARN: geoip: ignoring unreadable %s: %v", geoipRulesFile, err)
+	}
+	for _, r := range list {
+		geoRules[r.Name] = r
+	}
+	geoMu.Unlock()
+
+	if geoipDBPath() == "" {
+		return
+	}
+	if _, err := reloadGeoDB(true); err != nil {
+		log.Printf("WARN: geoip: %v", err)
+	}
+	if len(list) > 0 {
+		refreshGeoRules()
+	}
+	go func() {
+		for range time.Tick(geoipPollInterval) {
+			changed, err := reloadGeoDB(false)
+			if err != nil {
+				log.Printf("WARN: geoip: %v", err)
+				continue
+			}
+			if changed {
+				refreshGeoRules()
+			}
+		}
+	}()
+}
+
+// refreshGeoRules brings the sets in line with the loaded database, after
+// the pending change if one awaits confirmation.
+func refreshGeoRules() {
+	err := auditSystem("refresh geoip", func() error {
+		applyGeoRules()
+		return nil
+	})
+	if errors.Is(err, errChangePending) {
+		afterPendingChange(refreshGeoRules)
+	}
+}
+
+// geoBlocksClient reports whether the sets about to be created would drop
+// the request's own client address. Only loopback is exempt from the rules;
+// private and link-local addresses belong to no country, so an allow rule
+// drops them like any other address outside its countries.
+func geoBlocksClient(c *gin.Context, sets []*ipSet) bool {
+	ip, err := netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() {
+		return false
+	}
+	for _, s := range sets {
+		if (s.Family == "inet") != ip.Is4() {
+			continue
+		}
+		in := false
+		for _, e := range s.Entries {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				a, aerr := netip.ParseAddr(e)
+				if aerr != nil {
+					continue
+				}
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+			if p.Contains(ip) {
+				in = true
+				break
+			}
+		}
+		return in != s.AllowOnly
+	}
+	return false
+}
+
+func geoDBView() gin.H {
+	return gin.H{"configured": geoipDBPath() != "", "database": geoData, "error": geoLoadErr}
+}
+
+func registerGeoIPRoutes(rg *gin.RouterGroup) {
+	// GET /geoip reports the database in use and the rules.
+	rg.GET("/geoip", func(c *gin.Context) {
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		out := geoDBView()
+		rules := make([]*geoRule, 0, len(geoRules))
+		for _, r := range geoRules {
+			rules = append(rules, r)
+		}
+		sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+		out["rules"] = rules
+		c.JSON(http.StatusOK, out)
+	})
+
+	// GET /geoip/countries lists the number of networks per country.
+	rg.GET("/geoip/countries", func(c *gin.Context) {
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		if geoData == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No GeoIP database loaded", "details": geoLoadErr})
+			return
+		}
+		out := make(map[string]gin.H, len(geoData.networks))
+		for cc, n := range geoData.networks {
+			out[cc] = gin.H{"ipv4": len(n["inet"]), "ipv6": len(n["inet6"])}
+		}
+		c.JSON(http.StatusOK, gin.H{"countries": out})
+	})
+
+	// POST /geoip/reload loads the database file again now.
+	rg.POST("/geoip/reload", func(c *gin.Context) {
+		if _, err := reloadGeoDB(true); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load GeoIP database", "details": err.Error()})
+			return
+		}
+		applyGeoRules()
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		c.JSON(http.StatusOK, geoDBView())
+	})
+
+	type CreateGeoRuleRequest struct {
+		Name         string   `json:"name" binding:"required"`
+		Countries    []string `json:"countries" binding:"required"`
+		Action       string   `json:"action" binding:"required"`
+		PortProtocol string   `json:"port_protocol"`
+	}
+	// POST /geoip/rules creates a rule for the given ISO 3166 country codes.
+	// Unless ?force=true, a rule that would drop the client's own address is
+	// refused.
+	rg.POST("/geoip/rules", func(c *gin.Context) {
+		var req CreateGeoRuleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reGeoRuleName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule name", "details": "1-12 lowercase letters, digits or _-"})
+			return
+		}
+		if req.Action != "allow" && req.Action != "deny" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action", "details": "action must be allow or deny"})
+			return
+		}
+		if req.PortProtocol != "" {
+			if err := validateIPSetPorts(req.PortProtocol); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid port_protocol", "details": err.Error()})
+				return
+			}
+		}
+		if len(req.Countries) == 0 || len(req.Countries) > maxGeoCountries {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid countries", "details": fmt.Sprintf("between 1 and %d countries are required", maxGeoCountries)})
+			return
+		}
+
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		if geoData == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No GeoIP database loaded", "details": geoLoadErr})
+			return
+		}
+		seen := map[string]bool{}
+		var countries []string
+		for _, cc := range req.Countries {
+			cc = strings.ToUpper(strings.TrimSpace(cc))
+			if !reCountryCode.MatchString(cc) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid countries", "details": fmt.Sprintf("%q is not a two-letter country code", cc)})
+				return
+			}
+			if geoData.networks[cc] == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid countries", "details": cc + " is not in the GeoIP database"})
+				return
+			}
+			if !seen[cc] {
+				seen[cc] = true
+				countries = append(countries, cc)
+			}
+		}
+		sort.Strings(countries)
+		if geoRules[req.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Rule already exists"})
+			return
+		}
+
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		now := time.Now().UTC()
+		var sets []*ipSet
+		for _, family := range []string{"inet", "inet6"} {
+			entries, err := geoData.geoEntries(countries, family)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to expand countries", "details": err.Error()})
+				return
+			}
+			s := &ipSet{
+				Name: geoSetName(req.Name, family), Family: family, Geo: req.Name,
+				Ports: req.PortProtocol, AllowOnly: req.Action == "allow",
+				MaxElem: ipsetMaxElem(len(entries)), Entries: entries, CreatedAt: now, UpdatedAt: now,
+			}
+			if ipsets[s.Name] != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "Set already exists", "details": s.Name})
+				return
+			}
+			sets = append(sets, s)
+		}
+		if !forceRequested(c) && geoBlocksClient(c, sets) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Rule would block your own address", "details": c.ClientIP() + " would be dropped; retry with force=true to proceed anyway"})
+			return
+		}
+		for i, s := range sets {
+			if err := createIPSetLocked(s); err != nil {
+				for _, prev := range sets[:i] {
+					if derr := deleteIPSetLocked(prev); derr != nil {
+						log.Printf("WARN: geoip rule %s: failed to remove set %s: %v", req.Name, prev.Name, derr)
+					}
+				}
+				abortOnApplyError(c, err, "Failed to create GeoIP rule; previous state restored")
+				return
+			}
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+
+		r := &geoRule{
+			Name:         req.Name,
+			Countries:    countries,
+			Action:       req.Action,
+			PortProtocol: req.PortProtocol,
+			CreatedBy:    c.GetString(ctxKeyName),
+			CreatedAt:    now,
+		}
+		geoRules[r.Name] = r
+		saveGeoRulesLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "GeoIP rule created successfully", "rule": r, "ipv4_networks": len(sets[0].Entries), "ipv6_networks": len(sets[1].Entries)})
+	})
+
+	rg.GET("/geoip/rules/:name", func(c *gin.Context) {
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		r := geoRules[c.Param("name")]
+		if r == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+			return
+		}
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		out := gin.H{"rule": r}
+		for _, family := range []string{"inet", "inet6"} {
+			if s := ipsets[geoSetName(r.Name, family)]; s != nil {
+				out[family] = s.view(false)
+			}
+		}
+		c.JSON(http.StatusOK, out)
+	})
+
+	rg.DELETE("/geoip/rules/:name", func(c *gin.Context) {
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		r := geoRules[c.Param("name")]
+		if r == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+			return
+		}
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		for _, family := range []string{"inet", "inet6"} {
+			s := ipsets[geoSetName(r.Name, family)]
+			if s == nil {
+				continue
+			}
+			if err := deleteIPSetLocked(s); err != nil {
+				_ = saveIPSetsLocked()
+				abortOnApplyError(c, err, "Failed to delete GeoIP rule; previous state restored")
+				return
+			}
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+		delete(geoRules, r.Name)
+		saveGeoRulesLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "GeoIP rule deleted successfully", "name": r.Name})
+	})
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Address groups are named lists of IPs and CIDRs. A rule bound to a group
+// is expanded into one ufw rule per member, and changing the members adds
+// or deletes the expanded rules of every binding.
+
+const (
+	addressGroupsFile = "address-groups.json"
+	maxGroupMembers   = 1000
+)
+
+var reGroupName = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,32}$`)
+
+// groupBinding is a rule template applied to each member of a group.
+type groupBinding struct {
+	ID           string    `json:"id"`
+	Action       string    `json:"action"`
+	PortProtocol string    `json:"port_protocol,omitempty"`
+	Comment      string    `json:"comment"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// Owned are the members whose rule the binding added. A rule that
+	// already existed is left in place when its member goes away.
+	Owned []string `json:"owned,omitempty"`
+}
+
+type addressGroup struct {
+	Name      string          `json:"name"`
+	Members   []string        `json:"members"`
+	Bindings  []*groupBinding `json:"bindings"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+var (
+	groupMu sync.Mutex
+	groups  = map[string]*addressGroup{}
+)
+
+func (b *groupBinding) args(member string) ([]string, error) {
+	return ipRuleArgs(b.Action, member, b.PortProtocol, b.Comment)
+}
+
+func (g *addressGroup) view() gin.H {
+	return gin.H{
+		"name":       g.Name,
+		"members":    g.Members,
+		"bindings":   g.Bindings,
+		"rule_count": len(g.Bindings) * len(g.Members),
+		"created_at": g.CreatedAt,
+	}
+}
+
+// normalizeMembers validates members and returns them in canonical form,
+// without duplicates.
+func normalizeMembers(members []string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	for _, m := range members {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			return nil, fmt.Errorf("member cannot be empty")
+		}
+		if err := validateIPorCIDR(m); err != nil {
+			return nil, err
+		}
+		m = canonicalAddr(m)
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func loadAddressGroups() {
+	groupMu.Lock()
+	defer groupMu.Unlock()
+	var list []*addressGroup
+	if _, err := readJSONFile(dataPath(addressGroupsFile), &list); err != nil {
+		log.Printf("WARN: address groups: ignoring unreadable %s: %v", addressGroupsFile, err)
+		return
+	}
+	for _, g := range list {
+		groups[g.Name] = g
+	}
+}
+
+func saveAddressGroupsLocked() error {
+	list := make([]*addressGroup, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return writeJSONFile(dataPath(addressGroupsFile), list)
+}
+
+// expandGroupRules adds the rules of bindings for the members in add and
+// deletes those it added for the members in remove. It returns the members
+// each binding owns afterwards; the caller stores them once the change has
+// succeeded. Unless force is set it fails if a protected port is left
+// uncovered; the caller restores the state then.
+func expandGroupRules(bindings []*groupBinding, add, remove []string, force bool) ([][]string, error) {
+	owned := make([][]string, len(bindings))
+	for i, b := range bindings {
+		own := map[string]bool{}
+		for _, m := range b.Owned {
+			own[m] = true
+		}
+		for _, m := range add {
+			args, err := b.args(m)
+			if err != nil {
+				return nil, err
+			}
+			added, err := addUFWRule(args)
+			if err != nil {
+				return nil, fmt.Errorf("add %s: %w", m, err)
+			}
+			if added {
+				own[m] = true
+			}
+		}
+		for _, m := range remove {
+			if !own[m] {
+				continue
+			}
+			args, err := b.args(m)
+			if err != nil {
+				return nil, err
+			}
+			if err := deleteRuleByArgs(args); err != nil {
+				return nil, fmt.Errorf("delete %s: %w", m, err)
+			}
+			delete(own, m)
+		}
+		owned[i] = []string{}
+		for m := range own {
+			owned[i] = append(owned[i], m)
+		}
+		sort.Strings(owned[i])
+	}
+	if force {
+		return owned, nil
+	}
+	return owned, checkActiveLockout()
+}
+
+func registerGroupRoutes(rg *gin.RouterGroup) {
+	rg.GET("/groups", func(c *gin.Context) {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := make([]gin.H, 0, len(names))
+		for _, name := range names {
+			out = append(out, groups[name].view())
+		}
+		c.JSON(http.StatusOK, gin.H{"groups": out})
+	})
+
+	type CreateGroupRequest struct {
+		Name    string   `json:"name" binding:"required"`
+		Members []string `json:"members"`
+	}
+	rg.POST("/groups", func(c *gin.Context) {
+		var req CreateGroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reGroupName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name", "details": "1-32 letters, digits or _.-"})
+			return
+		}
+		members, err := normalizeMembers(req.Members)
+		if err == nil && len(members) > maxGroupMembers {
+			err = fmt.Errorf("at most %d members are allowed", maxGroupMembers)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid members", "details": err.Error()})
+			return
+		}
+
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		if groups[req.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Group already exists"})
+			return
+		}
+		if members == nil {
+			members = []string{}
+		}
+		g := &addressGroup{Name: req.Name, Members: members, Bindings: []*groupBinding{}, CreatedAt: time.Now().UTC()}
+		groups[g.Name] = g
+		if err := saveAddressGroupsLocked(); err != nil {
+			delete(groups, g.Name)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, g.view())
+	})
+
+	rg.GET("/groups/:name", func(c *gin.Context) {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		g := groups[c.Param("name")]
+		if g == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		c.JSON(http.StatusOK, g.view())
+	})
+
+	// DELETE /groups/:name is refused while rules are bound to the group.
+	rg.DELETE("/groups/:name", func(c *gin.Context) {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		g := groups[c.Param("name")]
+		if g == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if len(g.Bindings) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Group is in use", "details": fmt.Sprintf("delete its %d bound rules first", len(g.Bindings))})
+			return
+		}
+		delete(groups, g.Name)
+		if err := saveAddressGroupsLocked(); err != nil {
+			groups[g.Name] = g
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save groups", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully", "name": g.Name})
+	})
+
+	type MembersRequest struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	// POST /groups/:name/members adds and removes members, creating and
+	// deleting the rules of every binding. A failure restores the previous
+	// firewall state.
+	rg.POST("/groups/:name/members", func(c *gin.Context) {
+		var req MembersRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		add, err := normalizeMembers(req.Add)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid members", "details": err.Error()})
+			return
+		}
+		remove, err := normalizeMembers(req.Remove)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid members", "details": err.Error()})
+			return
+		}
+
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		g := groups[c.Param("name")]
+		if g == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+
+		current := map[string]bool{}
+		for _, m := range g.Members {
+			current[m] = true
+		}
+		var added, removed []string
+		for _, m := range remove {
+			if current[m] {
+				delete(current, m)
+				removed = append(removed, m)
+			}
+		}
+		for _, m := range add {
+			if !current[m] {
+				current[m] = true
+				added = append(added, m)
+			}
+		}
+		if len(current) > maxGroupMembers {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid members", "details": fmt.Sprintf("at most %d members are allowed", maxGroupMembers)})
+			return
+		}
+
+		if len(g.Bindings) > 0 && (len(added) > 0 || len(removed) > 0) {
+			force := forceRequested(c)
+			var owned [][]string
+			_, err = applyWithSnapshot("update group "+g.Name, 0, func() error {
+				var err error
+				owned, err = expandGroupRules(g.Bindings, added, removed, force)
+				return err
+			})
+			if abortOnApplyError(c, err, "Failed to update group rules; previous state restored") {
+				return
+			}
+			for i, b := range g.Bindings {
+				b.Owned = owned[i]
+			}
+		}
+
+		members := []string{}
+		for _, m := range g.Members {
+			if current[m] {
+				members = append(members, m)
+			}
+		}
+		members = append(members, added...)
+		g.Members = members
+		if err := saveAddressGroupsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group", "details": err.Error()})
+			return
+		}
+		if added == nil {
+			added = []string{}
+		}
+		if removed == nil {
+			removed = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Group updated successfully", "group": g.view(), "added": added, "removed": removed})
+	})
+
+	type BindingRequest struct {
+		Action       string `json:"action" binding:"required"`
+		PortProtocol string `json:"port_protocol"`
+		Comment      string `json:"comment"`
+	}
+	// POST /groups/:name/rules binds a rule to the group: one rule per
+	// member, now and for members added later. The comment defaults to
+	// "group <name>".
+	rg.POST("/groups/:name/rules", func(c *gin.Context) {
+		var req BindingRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if req.Action != "allow" && req.Action != "deny" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: action must be allow or deny"})
+			return
+		}
+
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		g := groups[c.Param("name")]
+		if g == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if req.Comment == "" {
+			req.Comment = "group " + g.Name
+		}
+		b := &groupBinding{
+			ID:           newID(),
+			Action:       req.Action,
+			PortProtocol: req.PortProtocol,
+			Comment:      req.Comment,
+			CreatedBy:    c.GetString(ctxKeyName),
+			CreatedAt:    time.Now().UTC(),
+		}
+		// Validate the template once, with a placeholder member.
+		if _, err := b.args("192.0.2.1"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule", "details": err.Error()})
+			return
+		}
+		for _, other := range g.Bindings {
+			if other.Action == b.Action && other.PortProtocol == b.PortProtocol {
+				c.JSON(http.StatusConflict, gin.H{"error": "Rule already bound to group", "details": "binding " + other.ID})
+				return
+			}
+		}
+
+		force := forceRequested(c)
+		var owned [][]string
+		_, err := applyWithSnapshot("bind rule to group "+g.Name, 0, func() error {
+			var err error
+			owned, err = expandGroupRules([]*groupBinding{b}, g.Members, nil, force)
+			return err
+		})
+		if abortOnApplyError(c, err, "Failed to add group rules; previous state restored") {
+			return
+		}
+		b.Owned = owned[0]
+		g.Bindings = append(g.Bindings, b)
+		if err := saveAddressGroupsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Rule bound to group successfully", "binding": b, "rules_added": len(b.Owned)})
+	})
+
+	// DELETE /groups/:name/rules/:id unbinds a rule and deletes the expanded
+	// rules it added.
+	rg.DELETE("/groups/:name/rules/:id", func(c *gin.Context) {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		g := groups[c.Param("name")]
+		if g == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		idx := -1
+		for i, b := range g.Bindings {
+			if b.ID == c.Param("id") {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Binding not found"})
+			return
+		}
+		b := g.Bindings[idx]
+
+		force := forceRequested(c)
+		_, err := applyWithSnapshot("unbind rule from group "+g.Name, 0, func() error {
+			_, err := expandGroupRules([]*groupBinding{b}, nil, g.Members, force)
+			return err
+		})
+		if abortOnApplyError(c, err, "Failed to delete group rules; previous state restored") {
+			return
+		}
+		g.Bindings = append(g.Bindings[:idx], g.Bindings[idx+1:]...)
+		if err := saveAddressGroupsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Rule unbound from group successfully", "id": b.ID, "rules_deleted": len(b.Owned)})
+	})
+}
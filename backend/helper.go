@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The privileged helper is the same binary started as `ufw-panel-backend
+// helper`. It runs as root, listens on a Unix socket and performs a fixed set
+// of validated operations on behalf of the unprivileged API process, which
+// sets UFW_HELPER_SOCKET to reach it.
+
+const helperMaxRequestBytes = 64 << 20
+
+type helperRequest struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+	Path string   `json:"path,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+}
+
+type helperResponse struct {
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exit_code"`
+	Error    string   `json:"error,omitempty"`
+	Data     []byte   `json:"data,omitempty"`
+	Missing  bool     `json:"missing,omitempty"`
+	Names    []string `json:"names,omitempty"`
+}
+
+type helperOp func(req *helperRequest) (*helperResponse, error)
+
+var helperOps = map[string]helperOp{
+	"ufw":        helperRunUFW,
+	"read_file":  helperReadFile,
+	"write_file": helperWriteFile,
+	"list_dir":   helperListDir,
+	"ipset":      helperRunIPSet,
+}
+
+func helperSocketPath() string {
+	return os.Getenv("UFW_HELPER_SOCKET")
+}
+
+func callHelper(req *helperRequest, timeout time.Duration) (*helperResponse, error) {
+	conn, err := net.DialTimeout("unix", helperSocketPath(), 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connect to privileged helper: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("send helper request: %w", err)
+	}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		_ = uc.CloseWrite()
+	}
+
+	var resp helperResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("read helper response: %w", err)
+	}
+	return &resp, nil
+}
+
+func callHelperUFW(args []string) (*cmdResult, error) {
+	resp, err := callHelper(&helperRequest{Op: "ufw", Args: args}, ufwTimeout()+2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	res := &cmdResult{Stdout: resp.Stdout, Stderr: resp.Stderr, ExitCode: resp.ExitCode}
+	if resp.Error != "" {
+		return res, errors.New(resp.Error)
+	}
+	return res, nil
+}
+
+var (
+	helperUFWVerbs = map[string]bool{
+		"status": true, "show": true, "version": true,
+		"allow": true, "deny": true, "reject": true, "limit": true,
+		"route": true, "insert": true, "delete": true,
+		"enable": true, "disable": true, "reload": true,
+		"default": true, "logging": true,
+	}
+	reHelperArg = regexp.MustCompile(`^[A-Za-z0-9_.:/,\-]{1,64}$`)
+)
+
+// validateHelperUFWArgs only lets through ufw invocations the API can
+// legitimately produce: an optional --force, a known verb, and plain tokens.
+// The free-text comment value is checked with validateComment and application
+// names, which may contain spaces, with reAppName.
+func validateHelperUFWArgs(args []string) error {
+	if len(args) == 0 || len(args) > 32 {
+		return errors.New("invalid ufw argument count")
+	}
+	rest := args
+	if rest[0] == "--force" {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 || !helperUFWVerbs[rest[0]] {
+		return fmt.Errorf("ufw operation not permitted: %v", args)
+	}
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == "comment" && i+1 < len(rest) {
+			if err := validateComment(rest[i+1]); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		if rest[i] == "app" && i+1 < len(rest) {
+			if !reAppName.MatchString(rest[i+1]) {
+				return fmt.Errorf("invalid app name: %q", rest[i+1])
+			}
+			i++
+			continue
+		}
+		if !reHelperArg.MatchString(rest[i]) {
+			return fmt.Errorf("invalid ufw argument: %q", rest[i])
+		}
+	}
+	return nil
+}
+
+func helperRunUFW(req *helperRequest) (*helperResponse, error) {
+	if err := validateHelperUFWArgs(req.Args); err != nil {
+		return nil, err
+	}
+	res, err := execUFW(req.Args...)
+	resp := &helperResponse{}
+	if res != nil {
+		resp.Stdout, resp.Stderr, resp.ExitCode = res.Stdout, res.Stderr, res.ExitCode
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp, nil
+}
+
+func helperReadFile(req *helperRequest) (*helperResponse, error) {
+	if !ufwFileAllowed(req.Path) {
+		return nil, fmt.Errorf("access to %q not permitted", req.Path)
+	}
+	data, err := os.ReadFile(req.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &helperResponse{Missing: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &helperResponse{Data: data}, nil
+}
+
+func helperWriteFile(req *helperRequest) (*helperResponse, error) {
+	if !ufwFileWritable(req.Path) {
+		return nil, fmt.Errorf("writing %q not permitted", req.Path)
+	}
+	if err := validateUFWFileContent(req.Path, req.Data); err != nil {
+		return nil, err
+	}
+	if err := writeUFWFileLocal(req.Path, req.Data); err != nil {
+		return nil, err
+	}
+	return &helperResponse{}, nil
+}
+
+func helperListDir(req *helperRequest) (*helperResponse, error) {
+	if !ufwFileAllowed(req.Path) {
+		return nil, fmt.Errorf("access to %q not permitted", req.Path)
+	}
+	names, err := listUFWDirLocal(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &helperResponse{Names: names}, nil
+}
+
+func helperAllowedUID() (int, bool, error) {
+	v := os.Getenv("UFW_HELPER_ALLOWED_UID")
+	if v == "" {
+		return 0, false, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return n, true, nil
+	}
+	u, err := user.Lookup(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("UFW_HELPER_ALLOWED_UID: %w", err)
+	}
+	n, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, false, fmt.Errorf("UFW_HELPER_ALLOWED_UID: %w", err)
+	}
+	return n, true, nil
+}
+
+func runHelper() {
+	path := helperSocketPath()
+	if path == "" {
+		log.Fatal("FATAL: UFW_HELPER_SOCKET not set")
+	}
+	if os.Geteuid() != 0 {
+		log.Println("Warning: privileged helper is not running as root; ufw commands will likely fail")
+	}
+	allowedUID, restrictUID, err := helperAllowedUID()
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("FATAL: Failed to listen on %s: %v", path, err)
+	}
+	defer os.Remove(path)
+
+	if err := os.Chmod(path, 0o660); err != nil {
+		log.Fatalf("FATAL: Failed to set socket permissions: %v", err)
+	}
+	if groupName := os.Getenv("UFW_HELPER_GROUP"); groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			log.Fatalf("FATAL: UFW_HELPER_GROUP: %v", err)
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		if err := os.Chown(path, 0, gid); err != nil {
+			log.Fatalf("FATAL: Failed to set socket group: %v", err)
+		}
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		ln.Close()
+	}()
+
+	log.Printf("Privileged helper listening on %s", path)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("Privileged helper stopped")
+				return
+			}
+			log.Printf("WARN: helper accept: %v", err)
+			continue
+		}
+		go serveHelperConn(conn.(*net.UnixConn), allowedUID, restrictUID)
+	}
+}
+
+func serveHelperConn(conn *net.UnixConn, allowedUID int, restrictUID bool) {
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	if restrictUID {
+		if err != nil || uid != allowedUID {
+			log.Printf("WARN: helper rejected connection from uid %d: %v", uid, err)
+			return
+		}
+	}
+
+	var req helperRequest
+	if err := json.NewDecoder(io.LimitReader(conn, helperMaxRequestBytes)).Decode(&req); err != nil {
+		_ = json.NewEncoder(conn).Encode(helperResponse{Error: "invalid request"})
+		return
+	}
+
+	op, ok := helperOps[req.Op]
+	if !ok {
+		log.Printf("WARN: helper rejected unknown op %q from uid %d", req.Op, uid)
+		_ = json.NewEncoder(conn).Encode(helperResponse{Error: "operation not permitted"})
+		return
+	}
+
+	resp, err := op(&req)
+	if err != nil {
+		log.Printf("WARN: helper rejected %s %v %s from uid %d: %v", req.Op, req.Args, req.Path, uid, err)
+		resp = &helperResponse{Error: err.Error(), ExitCode: -1}
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const maxImportBytes = 4 << 20
+
+// importResult describes what an import changed, or would change on a dry
+// run.
+type importResult struct {
+	Mode     string        `json:"mode"`
+	DryRun   bool          `json:"dry_run"`
+	Added    []rulesetRule `json:"added"`
+	Updated  []rulesetRule `json:"updated"`
+	Removed  []rulesetRule `json:"removed"`
+	Defaults []string      `json:"defaults,omitempty"`
+	Logging  string        `json:"logging,omitempty"`
+	Steps    []planStep    `json:"steps,omitempty"`
+}
+
+// decodeRuleset parses a JSON or YAML document; YAML is a superset of JSON,
+// so one decoder handles both. Unknown fields are rejected to catch typos.
+func decodeRuleset(data []byte) (*ruleset, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var rs ruleset
+	if err := dec.Decode(&rs); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// bindRuleset reads and validates the ruleset document in the request body,
+// writing a 400 response if it is unusable.
+func bindRuleset(c *gin.Context) (*ruleset, bool) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxImportBytes+1))
+	if err != nil || len(body) > maxImportBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": "document missing or larger than 4 MiB"})
+		return nil, false
+	}
+	doc, err := decodeRuleset(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ruleset document", "details": err.Error()})
+		return nil, false
+	}
+	if errs := doc.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ruleset document", "details": strings.Join(errs, "; "), "errors": errs})
+		return nil, false
+	}
+	return doc, true
+}
+
+// planImport compares the document with the current configuration. In merge
+// mode existing rules are kept; in replace mode rules missing from the
+// document are removed.
+func planImport(current, doc *ruleset, mode string) *importResult {
+	res := &importResult{Mode: mode, Added: []rulesetRule{}, Updated: []rulesetRule{}, Removed: []rulesetRule{}}
+
+	existing := map[string]rulesetRule{}
+	for _, r := range current.Rules {
+		existing[r.key()] = r
+	}
+	wanted := map[string]bool{}
+	for _, r := range doc.Rules {
+		k := r.key()
+		wanted[k] = true
+		cur, ok := existing[k]
+		switch {
+		case !ok:
+			res.Added = append(res.Added, r)
+		case cur.Comment != r.Comment && (mode == "replace" || r.Comment != ""):
+			res.Updated = append(res.Updated, r)
+		}
+	}
+	if mode == "replace" {
+		for _, r := range current.Rules {
+			if !wanted[r.key()] {
+				res.Removed = append(res.Removed, r)
+			}
+		}
+	}
+
+	if d := doc.Defaults; d != nil {
+		cur := rulesetDefaults{}
+		if current.Defaults != nil {
+			cur = *current.Defaults
+		}
+		for _, p := range [][3]string{{d.Incoming, cur.Incoming, "incoming"}, {d.Outgoing, cur.Outgoing, "outgoing"}, {d.Routed, cur.Routed, "routed"}} {
+			if p[0] != "" && p[0] != p[1] {
+				res.Defaults = append(res.Defaults, p[0]+" "+p[2])
+			}
+		}
+	}
+	if doc.Logging != "" && doc.Logging != current.Logging {
+		res.Logging = doc.Logging
+	}
+	return res
+}
+
+// applyImport adds and updates rules first and removes rules last, so an
+// allow rule being replaced is never missing in between; defaults and
+// logging come at the end.
+func applyImport(res *importResult) error {
+	for _, r := range append(append([]rulesetRule{}, res.Added...), res.Updated...) {
+		if _, err := runUFW(r.args()...); err != nil && !strings.Contains(err.Error(), "Skipping adding existing rule") {
+			return fmt.Errorf("add %s: %w", strings.Join(r.args(), " "), err)
+		}
+	}
+	for _, r := range res.Removed {
+		c := r
+		c.Comment = ""
+		args := append([]string{"delete"}, c.args()...)
+		if _, err := runUFWForce(args...); err != nil {
+			return fmt.Errorf("delete %s: %w", strings.Join(c.args(), " "), err)
+		}
+	}
+	for _, d := range res.Defaults {
+		policy, direction, _ := strings.Cut(d, " ")
+		if err := SetUFWDefault(policy, direction); err != nil {
+			return err
+		}
+	}
+	if res.Logging != "" {
+		if _, err := runUFW("logging", res.Logging); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerRulesetRoutes(rg *gin.RouterGroup) {
+	// GET /export?format=json|yaml|script
+	rg.GET("/export", func(c *gin.Context) {
+		rs, err := readRuleset()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw configuration", "details": err.Error()})
+			return
+		}
+		// Comments are cleaned so the export imports again; rules are
+		// matched without their comments, so only the text differs.
+		for i := range rs.Rules {
+			rs.Rules[i].Comment = sanitizeComment(rs.Rules[i].Comment)
+		}
+		switch format := c.DefaultQuery("format", "json"); format {
+		case "json":
+			c.IndentedJSON(http.StatusOK, rs)
+		case "yaml":
+			var buf bytes.Buffer
+			enc := yaml.NewEncoder(&buf)
+			enc.SetIndent(2)
+			if err := enc.Encode(rs); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode ruleset", "details": err.Error()})
+				return
+			}
+			c.Data(http.StatusOK, "application/yaml; charset=utf-8", buf.Bytes())
+		case "script":
+			c.Data(http.StatusOK, "text/x-shellscript; charset=utf-8", []byte(rs.script()))
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format", "details": "format must be json, yaml or script"})
+		}
+	})
+
+	// POST /import?mode=merge|replace&dry_run=true with a JSON or YAML body.
+	rg.POST("/import", func(c *gin.Context) {
+		mode := c.DefaultQuery("mode", "merge")
+		if mode != "merge" && mode != "replace" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode", "details": "mode must be merge or replace"})
+			return
+		}
+		timeout, err := confirmTimeout(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		doc, ok := bindRuleset(c)
+		if !ok {
+			return
+		}
+
+		live, err := readLiveState()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw configuration", "details": err.Error()})
+			return
+		}
+		res := planImport(live.Ruleset, doc, mode)
+		// A replace also brings the rules into the document's order, which
+		// the planner works out.
+		var p *plan
+		if mode == "replace" {
+			if p, err = buildPlan(live, doc); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ruleset document", "details": err.Error()})
+				return
+			}
+			res.Steps = p.Steps
+		}
+		if dryRun, _ := strconv.ParseBool(c.Query("dry_run")); dryRun {
+			res.DryRun = true
+			c.JSON(http.StatusOK, res)
+			return
+		}
+
+		force := forceRequested(c)
+		change, err := applyWithSnapshot("import "+mode, timeout, func() error {
+			apply := func() error { return applyImport(res) }
+			if p != nil {
+				apply = p.execute
+			}
+			if err := apply(); err != nil {
+				return err
+			}
+			if force {
+				return nil
+			}
+			return checkActiveLockout()
+		})
+		if abortOnApplyError(c, err, "Failed to import ruleset") {
+			return
+		}
+		resp := gin.H{"message": "Ruleset imported successfully", "result": res}
+		if change != nil {
+			resp["pending"] = change.view()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+}
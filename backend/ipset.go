@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Large blocklists are kept in kernel ipsets instead of one ufw rule per
+// address. Every set is named with ipsetPrefix and matched by a managed
+// block in before.rules (IPv4) or before6.rules (IPv6) that drops its
+// sources, so a set costs two iptables rules however many entries it holds.
+//
+// ipsets do not survive a reboot and ufw cannot load rules that reference a
+// missing set, so the backend keeps ipsetSaveFile with the create commands
+// of every set for ufw's unit to restore before it starts; the entries are
+// loaded again when the backend starts. Sets are only created once a
+// drop-in of ufw's unit restores that file, since otherwise ufw would fail
+// at the next boot.
+
+const (
+	ipsetPrefix        = "ufwp-"
+	ipsetsFile         = "ipsets.json"
+	ipsetSaveFile      = "/etc/ufw/ufwp-ipsets.save"
+	ipsetBlockBegin    = "# BEGIN ufw-panel ipsets: managed by the API, do not edit"
+	ipsetBlockEnd      = "# END ufw-panel ipsets"
+	ipsetAnchor        = "# End required lines"
+	minIPSetMaxElem    = 65536
+	maxIPSetEntries    = 1000000
+	maxIPSetUploadSize = 32 << 20
+)
+
+// ipsetDropInDirs are where systemd looks for drop-ins of ufw's unit.
+var ipsetDropInDirs = []string{
+	"/etc/systemd/system/ufw.service.d",
+	"/run/systemd/system/ufw.service.d",
+	"/usr/lib/systemd/system/ufw.service.d",
+	"/lib/systemd/system/ufw.service.d",
+}
+
+var errNoIPSetRestore = fmt.Errorf("ufw's unit does not restore %s at boot; install the ExecStartPre drop-in first (see the README), or set UFW_IPSET_RESTORE_CHECK=0 if the sets are restored some other way", ipsetSaveFile)
+
+var (
+	reIPSetName = regexp.MustCompile(`^[a-z0-9_\-]{1,20}$`)
+	reIPSetArg  = regexp.MustCompile(`^[A-Za-z0-9_.:/\-]{1,64}$`)
+
+	ipsetFamilies = map[string]string{"inet": "/etc/ufw/before.rules", "inet6": "/etc/ufw/before6.rules"}
+)
+
+// ipSet is a managed set. Feed or Geo is set on the sets that belong to a
+// blocklist feed or a GeoIP rule; their entries only change through it.
+//
+// The set's rule drops its sources, limited to Ports (ufw's port/protocol
+// syntax) if set. AllowOnly reverses the match: sources outside the set are
+// dropped, so the ports are only reachable from the set.
+type ipSet struct {
+	Name      string    `json:"name"`
+	Family    string    `json:"family"`
+	Feed      string    `json:"feed,omitempty"`
+	Geo       string    `json:"geo,omitempty"`
+	Ports     string    `json:"ports,omitempty"`
+	AllowOnly bool      `json:"allow_only,omitempty"`
+	MaxElem   int       `json:"maxelem"`
+	Entries   []string  `json:"entries"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	ipsetMu sync.Mutex
+	ipsets  = map[string]*ipSet{}
+)
+
+func (s *ipSet) kernelName() string {
+	return ipsetPrefix + s.Name
+}
+
+func (s *ipSet) createLine(name string, maxElem int) string {
+	return fmt.Sprintf("create %s hash:net family %s maxelem %d -exist", name, s.Family, maxElem)
+}
+
+// owner describes what manages the set's entries, or "" for a plain set.
+func (s *ipSet) owner() string {
+	switch {
+	case s.Feed != "":
+		return "feed " + s.Feed
+	case s.Geo != "":
+		return "GeoIP rule " + s.Geo
+	}
+	return ""
+}
+
+// validateIPSetPorts checks a port/protocol spec such as "22/tcp" or
+// "80,443" for a set's rule.
+func validateIPSetPorts(spec string) error {
+	ports, proto, _ := strings.Cut(spec, "/")
+	if err := validatePortSpec(ports); err != nil {
+		return err
+	}
+	return validateProto(proto)
+}
+
+// ruleLines returns the rules of the set for chain, one per protocol when
+// the set is limited to ports without one. AllowOnly rules only drop new
+// connections, since they come before ufw accepts related and established
+// traffic and would otherwise drop the replies to outgoing connections.
+func (s *ipSet) ruleLines(chain string) []string {
+	match := "-m set --match-set " + s.kernelName() + " src"
+	if s.AllowOnly {
+		match = "! -i lo -m conntrack --ctstate NEW -m set ! --match-set " + s.kernelName() + " src"
+	}
+	if s.Ports == "" {
+		return []string{fmt.Sprintf("-A %s %s -j DROP", chain, match)}
+	}
+	ports, proto, _ := strings.Cut(s.Ports, "/")
+	dport := "--dport " + ports
+	if strings.Contains(ports, ",") {
+		dport = "-m multiport --dports " + ports
+	}
+	protos := []string{"tcp", "udp"}
+	if proto != "" {
+		protos = []string{strings.ToLower(proto)}
+	}
+	var out []string
+	for _, p := range protos {
+		out = append(out, fmt.Sprintf("-A %s -p %s %s %s -j DROP", chain, p, dport, match))
+	}
+	return out
+}
+
+func ipsetMaxElem(n int) int {
+	m := minIPSetMaxElem
+	for m < 2*n {
+		m *= 2
+	}
+	return m
+}
+
+// runIPSet runs ipset directly or through the helper, with stdin as the
+// input of "ipset restore".
+func runIPSet(args []string, stdin []byte) (res *cmdResult, err error) {
+	if args[0] != "list" {
+		defer func() { recordAuditCommand(append([]string{"ipset"}, args...), res, err) }()
+	}
+	if helperSocketPath() != "" {
+		resp, err := callHelper(&helperRequest{Op: "ipset", Args: args, Data: stdin}, ufwTimeout()+2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		res := &cmdResult{Stdout: resp.Stdout, Stderr: resp.Stderr, ExitCode: resp.ExitCode}
+		if resp.Error != "" {
+			return res, errors.New(resp.Error)
+		}
+		return res, nil
+	}
+	return execIPSet(args, stdin)
+}
+
+func execIPSet(args []string, stdin []byte) (*cmdResult, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, fmt.Errorf("ipset not found: %w", err)
+	}
+	return execCommand("ipset", path, args, stdin)
+}
+
+var ipsetVerbs = map[string]bool{
+	"create": true, "destroy": true, "swap": true, "list": true,
+	"add": true, "del": true, "flush": true,
+}
+
+// validateIPSetCommand only lets through ipset commands on the backend's own
+// sets: a known verb followed by plain tokens, where every set name carries
+// ipsetPrefix. "restore" is checked line by line.
+func validateIPSetCommand(tokens []string) error {
+	if len(tokens) < 2 || len(tokens) > 16 || !ipsetVerbs[tokens[0]] {
+		return fmt.Errorf("ipset operation not permitted: %v", tokens)
+	}
+	sets := 1
+	if tokens[0] == "swap" {
+		sets = 2
+	}
+	for i, t := range tokens[1:] {
+		if !reIPSetArg.MatchString(t) {
+			return fmt.Errorf("invalid ipset argument: %q", t)
+		}
+		if i < sets && !strings.HasPrefix(t, ipsetPrefix) {
+			return fmt.Errorf("ipset %q not managed by the panel", t)
+		}
+	}
+	return nil
+}
+
+func validateIPSetArgs(args []string, stdin []byte) error {
+	if len(args) == 1 && args[0] == "restore" {
+		sc := bufio.NewScanner(strings.NewReader(string(stdin)))
+		for sc.Scan() {
+			if err := validateIPSetCommand(strings.Fields(sc.Text())); err != nil {
+				return err
+			}
+		}
+		return sc.Err()
+	}
+	if stdin != nil {
+		return errors.New("ipset input only allowed for restore")
+	}
+	// "list" takes -terse after the set name.
+	if len(args) == 3 && args[0] == "list" && args[2] == "-terse" {
+		args = args[:2]
+	}
+	return validateIPSetCommand(args)
+}
+
+func helperRunIPSet(req *helperRequest) (*helperResponse, error) {
+	if err := validateIPSetArgs(req.Args, req.Data); err != nil {
+		return nil, err
+	}
+	res, err := execIPSet(req.Args, req.Data)
+	resp := &helperResponse{}
+	if res != nil {
+		resp.Stdout, resp.Stderr, resp.ExitCode = res.Stdout, res.Stderr, res.ExitCode
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp, nil
+}
+
+// normalizeIPSetEntries validates entries for a set of the given family and
+// returns them in canonical form, sorted and without duplicates.
+func normalizeIPSetEntries(family string, entries []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if err := validateIPorCIDR(e); err != nil || e == "" {
+			return nil, fmt.Errorf("invalid entry: %q", e)
+		}
+		ip, _, err := net.ParseCIDR(e)
+		if err != nil {
+			ip = net.ParseIP(e)
+		}
+		if (ip.To4() != nil) != (family == "inet") {
+			return nil, fmt.Errorf("entry %s does not match set family %s", e, family)
+		}
+		e = canonicalAddr(e)
+		if !seen[e] {
+			seen[e] = true
+			out = append(out, e)
+		}
+	}
+	if len(out) > maxIPSetEntries {
+		return nil, fmt.Errorf("at most %d entries are allowed", maxIPSetEntries)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// loadIPSetEntries replaces the set's entries in one step: they are loaded
+// into a temporary set that is then swapped with the live one.
+func loadIPSetEntries(s *ipSet, entries []string) error {
+	live, tmp := s.kernelName(), s.kernelName()+"-t"
+	maxElem := ipsetMaxElem(len(entries))
+	if maxElem < s.MaxElem {
+		maxElem = s.MaxElem
+	}
+	var b strings.Builder
+	b.WriteString(s.createLine(live, s.MaxElem) + "\n")
+	b.WriteString(s.createLine(tmp, maxElem) + "\n")
+	b.WriteString("flush " + tmp + "\n")
+	for _, e := range entries {
+		b.WriteString("add " + tmp + " " + e + "\n")
+	}
+	if _, err := runIPSet([]string{"restore"}, []byte(b.String())); err != nil {
+		return err
+	}
+	if _, err := runIPSet([]string{"swap", tmp, live}, nil); err != nil {
+		return err
+	}
+	if _, err := runIPSet([]string{"destroy", tmp}, nil); err != nil {
+		log.Printf("WARN: ipset: failed to remove %s: %v", tmp, err)
+	}
+	s.MaxElem = maxElem
+	return nil
+}
+
+// updateIPSetEntries adds and removes entries in place, falling back to a
+// full load when the set would outgrow its maxelem.
+func updateIPSetEntries(s *ipSet, add, remove []string) ([]string, error) {
+	current := map[string]bool{}
+	for _, e := range s.Entries {
+		current[e] = true
+	}
+	for _, e := range remove {
+		delete(current, e)
+	}
+	for _, e := range add {
+		current[e] = true
+	}
+	if len(current) > maxIPSetEntries {
+		return nil, fmt.Errorf("at most %d entries are allowed", maxIPSetEntries)
+	}
+	entries := make([]string, 0, len(current))
+	for e := range current {
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+
+	if len(entries) > s.MaxElem {
+		return entries, loadIPSetEntries(s, entries)
+	}
+	var b strings.Builder
+	for _, e := range remove {
+		b.WriteString("del " + s.kernelName() + " " + e + " -exist\n")
+	}
+	for _, e := range add {
+		b.WriteString("add " + s.kernelName() + " " + e + " -exist\n")
+	}
+	if b.Len() == 0 {
+		return entries, nil
+	}
+	_, err := runIPSet([]string{"restore"}, []byte(b.String()))
+	return entries, err
+}
+
+// syncIPSetEntriesLocked brings the entries of s in line with want, which
+// must be normalized, loading only the difference.
+func syncIPSetEntriesLocked(s *ipSet, want []string) (added, removed int, err error) {
+	add, remove := diffEntries(s.Entries, want)
+	if len(add) == 0 && len(remove) == 0 {
+		return 0, 0, nil
+	}
+	oldMax := s.MaxElem
+	updated, err := updateIPSetEntries(s, add, remove)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := storeIPSetEntriesLocked(s, updated, oldMax); err != nil {
+		return 0, 0, err
+	}
+	return len(add), len(remove), nil
+}
+
+// ipsetKernelSize returns the number of entries the kernel reports for a
+// set, or -1 if it cannot be read.
+func ipsetKernelSize(s *ipSet) int {
+	res, err := runIPSet([]string{"list", s.kernelName(), "-terse"}, nil)
+	if err != nil {
+		return -1
+	}
+	for _, ln := range strings.Split(res.Stdout, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(ln), "Number of entries:"); ok {
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				return n
+			}
+		}
+	}
+	return -1
+}
+
+// renderIPSetBlock returns the managed block for a before.rules file, or ""
+// if no set of the family exists.
+func renderIPSetBlock(family string, sets []*ipSet) string {
+	var b strings.Builder
+	for _, s := range sets {
+		if s.Family != family {
+			continue
+		}
+		chains := []string{"ufw-before-input", "ufw-before-forward"}
+		if s.AllowOnly {
+			// Only the host's own ports are limited to the set; routed
+			// traffic, such as containers' outgoing connections, is not.
+			chains = chains[:1]
+		}
+		for _, chain := range chains {
+			for _, ln := range s.ruleLines(chain) {
+				b.WriteString(ln + "\n")
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return ipsetBlockBegin + "\n" + b.String() + ipsetBlockEnd + "\n"
+}
+
+// replaceIPSetBlock removes any managed block from content and inserts block
+// right after ufw's required lines, ahead of its accept rules.
+func replaceIPSetBlock(content, block string) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+	var out []string
+	skipping := false
+	for _, ln := range lines {
+		switch strings.TrimSpace(ln) {
+		case ipsetBlockBegin:
+			skipping = true
+			continue
+		case ipsetBlockEnd:
+			skipping = false
+			continue
+		}
+		if !skipping {
+			out = append(out, ln)
+		}
+	}
+	if block == "" {
+		return strings.Join(out, ""), nil
+	}
+	for i, ln := range out {
+		if strings.TrimSpace(ln) == ipsetAnchor {
+			if !strings.HasSuffix(ln, "\n") {
+				out[i] = ln + "\n"
+			}
+			return strings.Join(out[:i+1], "") + block + strings.Join(out[i+1:], ""), nil
+		}
+	}
+	return "", fmt.Errorf("%q not found", ipsetAnchor)
+}
+
+// writeIPSetRules brings before.rules, before6.rules and ipsetSaveFile in
+// line with sets and reloads ufw if it is running.
+func writeIPSetRules(sets []*ipSet) error {
+	changed := false
+	for _, family := range []string{"inet", "inet6"} {
+		path := ipsetFamilies[family]
+		data, err := readUFWFile(path)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("%s does not exist", path)
+		}
+		updated, err := replaceIPSetBlock(string(data), renderIPSetBlock(family, sets))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if updated == string(data) {
+			continue
+		}
+		if err := writeUFWFile(path, []byte(updated)); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	var save strings.Builder
+	for _, s := range sets {
+		save.WriteString(s.createLine(s.kernelName(), s.MaxElem) + "\n")
+	}
+	old, err := readUFWFile(ipsetSaveFile)
+	if err != nil {
+		return err
+	}
+	if string(old) != save.String() {
+		if err := writeUFWFile(ipsetSaveFile, []byte(save.String())); err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	if status.Status != "active" {
+		return nil
+	}
+	_, err = runUFW("reload")
+	return err
+}
+
+// checkIPSetRestore fails unless a drop-in of ufw's unit runs ipset restore
+// on ipsetSaveFile before ufw starts.
+func checkIPSetRestore() error {
+	if os.Getenv("UFW_IPSET_RESTORE_CHECK") == "0" {
+		return nil
+	}
+	for _, dir := range ipsetDropInDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+		for _, m := range matches {
+			data, err := os.ReadFile(m)
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "ExecStartPre=") && strings.Contains(line, "ipset restore") && strings.Contains(line, ipsetSaveFile) {
+					return nil
+				}
+			}
+		}
+	}
+	return errNoIPSetRestore
+}
+
+func sortedIPSetsLocked() []*ipSet {
+	list := make([]*ipSet, 0, len(ipsets))
+	for _, s := range ipsets {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func saveIPSetsLocked() error {
+	return writeJSONFile(dataPath(ipsetsFile), sortedIPSetsLocked())
+}
+
+// createIPSetLocked loads s into the kernel and adds it to the managed rules.
+// On failure the set is destroyed again and the rules are restored.
+func createIPSetLocked(s *ipSet) error {
+	if err := checkIPSetRestore(); err != nil {
+		return err
+	}
+	_, err := applyWithSnapshot("create ipset "+s.Name, 0, func() error {
+		if err := loadIPSetEntries(s, s.Entries); err != nil {
+			return err
+		}
+		return writeIPSetRules(append(sortedIPSetsLocked(), s))
+	})
+	if err != nil {
+		_, _ = runIPSet([]string{"destroy", s.kernelName()}, nil)
+		return err
+	}
+	ipsets[s.Name] = s
+	return nil
+}
+
+// deleteIPSetLocked removes s from the managed rules and destroys it.
+func deleteIPSetLocked(s *ipSet) error {
+	var rest []*ipSet
+	for _, other := range sortedIPSetsLocked() {
+		if other != s {
+			rest = append(rest, other)
+		}
+	}
+	_, err := applyWithSnapshot("delete ipset "+s.Name, 0, func() error {
+		return writeIPSetRules(rest)
+	})
+	if err != nil {
+		return err
+	}
+	// The set can only be destroyed once no rule references it.
+	if _, err := runIPSet([]string{"destroy", s.kernelName()}, nil); err != nil {
+		log.Printf("WARN: ipset: failed to destroy %s: %v", s.kernelName(), err)
+	}
+	delete(ipsets, s.Name)
+	return nil
+}
+
+// storeIPSetEntriesLocked records the entries just loaded into s, rewriting
+// ipsetSaveFile if the load had to grow the set beyond oldMax.
+func storeIPSetEntriesLocked(s *ipSet, entries []string, oldMax int) error {
+	if s.MaxElem != oldMax {
+		if err := writeIPSetRules(sortedIPSetsLocked()); err != nil {
+			log.Printf("WARN: ipset: failed to update %s: %v", ipsetSaveFile, err)
+		}
+	}
+	s.Entries, s.UpdatedAt = entries, time.Now().UTC()
+	return saveIPSetsLocked()
+}
+
+// changeableIPSetLocked returns the set named in the request, or writes the
+// response and returns nil if it does not exist or belongs to a feed.
+func changeableIPSetLocked(c *gin.Context) *ipSet {
+	s := ipsets[c.Param("name")]
+	switch {
+	case s == nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Set not found"})
+		return nil
+	case s.owner() != "":
+		c.JSON(http.StatusConflict, gin.H{"error": "Set is managed by " + s.owner(), "details": "change or delete it instead"})
+		return nil
+	}
+	return s
+}
+
+// startIPSets loads the saved sets into the kernel.
+func startIPSets() {
+	ipsetMu.Lock()
+	defer ipsetMu.Unlock()
+	var list []*ipSet
+	if _, err := readJSONFile(dataPath(ipsetsFile), &list); err != nil {
+		log.Printf("WARN: ipsets: ignoring unreadable %s: %v", ipsetsFile, err)
+		return
+	}
+	if len(list) == 0 {
+		return
+	}
+	for _, s := range list {
+		ipsets[s.Name] = s
+	}
+	if err := checkIPSetRestore(); err != nil {
+		log.Printf("WARN: ipsets: %v", err)
+	}
+	_ = auditSystem("load ipsets", func() error {
+		for _, s := range list {
+			if err := loadIPSetEntries(s, s.Entries); err != nil {
+				log.Printf("WARN: ipset %s: failed to load %d entries: %v", s.Name, len(s.Entries), err)
+			}
+		}
+		// Rules written by an earlier version are brought up to date.
+		if err := writeIPSetRules(sortedIPSetsLocked()); err != nil {
+			log.Printf("WARN: ipsets: failed to update the managed rules: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *ipSet) view(withEntries bool) gin.H {
+	out := gin.H{
+		"name":           s.Name,
+		"ipset":          s.kernelName(),
+		"family":         s.Family,
+		"maxelem":        s.MaxElem,
+		"entries_count":  len(s.Entries),
+		"kernel_entries": ipsetKernelSize(s),
+		"created_at":     s.CreatedAt,
+		"updated_at":     s.UpdatedAt,
+	}
+	if s.Feed != "" {
+		out["feed"] = s.Feed
+	}
+	if s.Geo != "" {
+		out["geo"] = s.Geo
+	}
+	if s.Ports != "" {
+		out["ports"] = s.Ports
+	}
+	if s.AllowOnly {
+		out["allow_only"] = true
+	}
+	if withEntries {
+		out["entries"] = s.Entries
+	}
+	return out
+}
+
+// bindIPSetEntries reads a bulk upload: a JSON body {"entries": [...]} or
+// plain text with one entry per line, where # starts a comment.
+func bindIPSetEntries(c *gin.Context) ([]string, bool) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIPSetUploadSize+1))
+	if err == nil && len(body) > maxIPSetUploadSize {
+		err = fmt.Errorf("body larger than %d bytes", maxIPSetUploadSize)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return nil, false
+	}
+	if strings.HasPrefix(c.ContentType(), "text/") {
+		var entries []string
+		for _, ln := range strings.Split(string(body), "\n") {
+			if i := strings.IndexByte(ln, '#'); i != -1 {
+				ln = ln[:i]
+			}
+			if ln = strings.TrimSpace(ln); ln != "" {
+				entries = append(entries, ln)
+			}
+		}
+		return entries, true
+	}
+	var req struct {
+		Entries []string `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return nil, false
+	}
+	return req.Entries, true
+}
+
+func registerIPSetRoutes(rg *gin.RouterGroup) {
+	rg.GET("/ipsets", func(c *gin.Context) {
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		out := []gin.H{}
+		for _, s := range sortedIPSetsLocked() {
+			out = append(out, s.view(false))
+		}
+		c.JSON(http.StatusOK, gin.H{"ipsets": out})
+	})
+
+	type CreateIPSetRequest struct {
+		Name    string   `json:"name" binding:"required"`
+		Family  string   `json:"family"`
+		Entries []string `json:"entries"`
+	}
+	// POST /ipsets creates a set whose sources are dropped, optionally with
+	// initial entries. family is inet (default) or inet6.
+	rg.POST("/ipsets", func(c *gin.Context) {
+		var req CreateIPSetRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reIPSetName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid set name", "details": "1-20 lowercase letters, digits or _-"})
+			return
+		}
+		if strings.HasPrefix(req.Name, feedSetPrefix) || strings.HasPrefix(req.Name, geoSetPrefix) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid set name", "details": "names starting with " + feedSetPrefix + " or " + geoSetPrefix + " are reserved"})
+			return
+		}
+		if req.Family == "" {
+			req.Family = "inet"
+		}
+		if ipsetFamilies[req.Family] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid family", "details": "family must be inet or inet6"})
+			return
+		}
+		entries, err := normalizeIPSetEntries(req.Family, req.Entries)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entries", "details": err.Error()})
+			return
+		}
+
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		if ipsets[req.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Set already exists"})
+			return
+		}
+		now := time.Now().UTC()
+		s := &ipSet{Name: req.Name, Family: req.Family, MaxElem: ipsetMaxElem(len(entries)), Entries: entries, CreatedAt: now, UpdatedAt: now}
+		if abortOnApplyError(c, createIPSetLocked(s), "Failed to create set; previous state restored") {
+			return
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, s.view(false))
+	})
+
+	rg.GET("/ipsets/:name", func(c *gin.Context) {
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		s := ipsets[c.Param("name")]
+		if s == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Set not found"})
+			return
+		}
+		c.JSON(http.StatusOK, s.view(true))
+	})
+
+	rg.DELETE("/ipsets/:name", func(c *gin.Context) {
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		s := changeableIPSetLocked(c)
+		if s == nil {
+			return
+		}
+		if abortOnApplyError(c, deleteIPSetLocked(s), "Failed to delete set; previous state restored") {
+			return
+		}
+		if err := saveIPSetsLocked(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Set deleted successfully", "name": s.Name})
+	})
+
+	type EntriesRequest struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	// POST /ipsets/:name/entries adds and removes individual entries.
+	rg.POST("/ipsets/:name/entries", func(c *gin.Context) {
+		var req EntriesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		s := changeableIPSetLocked(c)
+		if s == nil {
+			return
+		}
+		add, err := normalizeIPSetEntries(s.Family, req.Add)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entries", "details": err.Error()})
+			return
+		}
+		remove, err := normalizeIPSetEntries(s.Family, req.Remove)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entries", "details": err.Error()})
+			return
+		}
+		oldMax := s.MaxElem
+		entries, err := updateIPSetEntries(s, add, remove)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update set", "details": err.Error()})
+			return
+		}
+		if err := storeIPSetEntriesLocked(s, entries, oldMax); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Set updated successfully", "name": s.Name, "entries_count": len(s.Entries)})
+	})
+
+	// PUT /ipsets/:name/entries replaces all entries at once; see
+	// bindIPSetEntries for the accepted formats.
+	rg.PUT("/ipsets/:name/entries", func(c *gin.Context) {
+		raw, ok := bindIPSetEntries(c)
+		if !ok {
+			return
+		}
+		ipsetMu.Lock()
+		defer ipsetMu.Unlock()
+		s := changeableIPSetLocked(c)
+		if s == nil {
+			return
+		}
+		entries, err := normalizeIPSetEntries(s.Family, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entries", "details": err.Error()})
+			return
+		}
+		oldMax := s.MaxElem
+		if err := loadIPSetEntries(s, entries); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load set", "details": err.Error()})
+			return
+		}
+		if err := storeIPSetEntriesLocked(s, entries, oldMax); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sets", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Set loaded successfully", "name": s.Name, "entries_count": len(s.Entries)})
+	})
+}
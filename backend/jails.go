@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Jails watch a log for failed logins, like fail2ban: each line is matched
+// against the jail's patterns, failures are counted per address over a
+// sliding window of find_time, and an address reaching max_retry is banned
+// through banIP for ban_time. Patterns mark the address with <HOST>.
+
+const (
+	jailsFile        = "jails.json"
+	defaultJailLog   = "/var/log/auth.log"
+	defaultMaxRetry  = 5
+	defaultFindTime  = 10 * time.Minute
+	defaultBanTime   = time.Hour
+	maxJailPatterns  = 32
+	maxJailTracked   = 10000
+	jailHostGroup    = `(?P<host>[0-9A-Fa-f.:]{2,45})`
+	jailHostTemplate = "<HOST>"
+	jailSSHDPrefix   = `^(?:\S.*? sshd(?:-session)?\[\d+\]: )?`
+)
+
+var (
+	reJailName = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+	// The sshd patterns are anchored at both ends, like fail2ban's: a
+	// line may carry a syslog prefix (files) or not (the journal's
+	// MESSAGE), and everything after the address is fixed text sshd
+	// writes itself. The user name before it is greedy, so a name such as
+	// "x from 192.0.2.9" can only push the real address further right,
+	// never take its place.
+	jailPresets = map[string][]string{
+		"sshd": {
+			jailSSHDPrefix + `(?:error: )?Failed (?:password|publickey) for (?:invalid user )?.* from <HOST> port \d+(?: ssh\d*)?(?:: \S+ \S+)?$`,
+			jailSSHDPrefix + `(?:error: )?Invalid user (?:.* )?from <HOST> port \d+$`,
+			jailSSHDPrefix + `pam_unix\(sshd:auth\): +authentication failure;(?: +(?:logname|e?uid|tty)=\S*){0,4} +ruser=\S* +rhost=<HOST>(?: +user=\S*)? *$`,
+			jailSSHDPrefix + `(?:error: )?maximum authentication attempts exceeded for (?:invalid user )?.* from <HOST> port \d+(?: ssh\d*)?(?: \[preauth\])?$`,
+			jailSSHDPrefix + `Connection (?:closed|reset) by (?:invalid|authenticating) user .* <HOST> port \d+ \[preauth\]$`,
+			jailSSHDPrefix + `Did not receive identification string from <HOST>(?: port \d+)?$`,
+		},
+	}
+)
+
+type jail struct {
+	Name         string    `json:"name"`
+	LogPath      string    `json:"log_path,omitempty"`
+	Journal      bool      `json:"journal,omitempty"`
+	JournalUnits []string  `json:"journal_units,omitempty"`
+	Patterns     []string  `json:"patterns"`
+	MaxRetry     int       `json:"max_retry"`
+	FindTime     string    `json:"find_time"`
+	BanTime      string    `json:"ban_time"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	Bans         int       `json:"bans"`
+
+	res      []*regexp.Regexp
+	findTime time.Duration
+	banTime  time.Duration
+	failures map[string][]time.Time
+	// nextPrune is when the oldest tracked address expires; pruning
+	// earlier would find nothing to forget.
+	nextPrune time.Time
+	matches   uint64
+	stop      chan struct{}
+	follower  *logFollower
+}
+
+var (
+	jailMu sync.Mutex
+	jails  = map[string]*jail{}
+)
+
+func compileJailPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 || len(patterns) > maxJailPatterns {
+		return nil, fmt.Errorf("between 1 and %d patterns are required", maxJailPatterns)
+	}
+	var out []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(strings.ReplaceAll(p, jailHostTemplate, jailHostGroup))
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+		if re.SubexpIndex("host") == -1 {
+			return nil, fmt.Errorf("pattern %q: %s missing", p, jailHostTemplate)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+// matchJailLine returns the address of a failure logged in line, if any.
+// When a pattern matches more than once, the last match wins: text a client
+// controls, such as a user name, comes before the address sshd appends.
+func matchJailLine(res []*regexp.Regexp, line string) (string, bool) {
+	for _, re := range res {
+		all := re.FindAllStringSubmatch(line, -1)
+		if all == nil {
+			continue
+		}
+		m := all[len(all)-1]
+		if ip := net.ParseIP(m[re.SubexpIndex("host")]); ip != nil {
+			return ip.String(), true
+		}
+	}
+	return "", false
+}
+
+// prepare derives the runtime state of a jail from its settings.
+func (j *jail) prepare() error {
+	res, err := compileJailPatterns(j.Patterns)
+	if err != nil {
+		return err
+	}
+	findTime, err := time.ParseDuration(j.FindTime)
+	if err != nil || findTime <= 0 {
+		return fmt.Errorf("invalid find_time %q", j.FindTime)
+	}
+	banTime, err := time.ParseDuration(j.BanTime)
+	if err != nil || banTime < 0 {
+		return fmt.Errorf("invalid ban_time %q: use a duration, or 0 to ban for good", j.BanTime)
+	}
+	if j.MaxRetry < 1 {
+		return fmt.Errorf("max_retry must be at least 1")
+	}
+	if !j.Journal && !filepath.IsAbs(j.LogPath) {
+		return fmt.Errorf("log_path must be an absolute path")
+	}
+	j.res, j.findTime, j.banTime = res, findTime, banTime
+	j.failures = map[string][]time.Time{}
+	return nil
+}
+
+func (j *jail) source() string {
+	if j.Journal {
+		if len(j.JournalUnits) == 0 {
+			return "journal"
+		}
+		return "journal:" + strings.Join(j.JournalUnits, ",")
+	}
+	return j.LogPath
+}
+
+// startLocked starts following the jail's log.
+func (j *jail) startLocked() {
+	j.stop = make(chan struct{})
+	if j.Journal {
+		j.follower = followJournal(j.JournalUnits, j.stop, j.handleLine)
+	} else {
+		j.follower = followFile(j.LogPath, j.stop, j.handleLine)
+	}
+}
+
+func (j *jail) handleLine(line string) {
+	ip, ok := matchJailLine(j.res, line)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	jailMu.Lock()
+	defer jailMu.Unlock()
+	if jails[j.Name] != j {
+		return
+	}
+	j.matches++
+	if _, tracked := j.failures[ip]; !tracked && len(j.failures) >= maxJailTracked {
+		if !now.Before(j.nextPrune) {
+			j.pruneLocked(now)
+		}
+		if len(j.failures) >= maxJailTracked {
+			// New addresses are ignored until tracked ones expire.
+			return
+		}
+	}
+	times := j.failures[ip][:0]
+	for _, t := range j.failures[ip] {
+		if now.Sub(t) < j.findTime {
+			times = append(times, t)
+		}
+	}
+	times = append(times, now)
+	if len(times) < j.MaxRetry {
+		j.failures[ip] = times
+		return
+	}
+	delete(j.failures, ip)
+	reason := fmt.Sprintf("AUTO BLOCK: jail %s, %d fails/%s", j.Name, len(times), j.FindTime)
+	if banIP(ip, "jail "+j.Name, reason, j.banTime) {
+		j.Bans++
+		saveJailsLocked()
+	}
+}
+
+// pruneLocked forgets failures older than find_time.
+func (j *jail) pruneLocked(now time.Time) {
+	j.nextPrune = time.Time{}
+	for ip, times := range j.failures {
+		last := times[len(times)-1]
+		if now.Sub(last) >= j.findTime {
+			delete(j.failures, ip)
+		} else if expires := last.Add(j.findTime); j.nextPrune.IsZero() || expires.Before(j.nextPrune) {
+			j.nextPrune = expires
+		}
+	}
+}
+
+func saveJailsLocked() {
+	list := make([]*jail, 0, len(jails))
+	for _, j := range jails {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	if err := writeJSONFile(dataPath(jailsFile), list); err != nil {
+		log.Printf("WARN: jails: failed to save %s: %v", jailsFile, err)
+	}
+}
+
+// startJails loads the saved jails and starts watching their logs.
+func startJails() {
+	jailMu.Lock()
+	defer jailMu.Unlock()
+	var list []*jail
+	if _, err := readJSONFile(dataPath(jailsFile), &list); err != nil {
+		log.Printf("WARN: jails: ignoring unreadable %s: %v", jailsFile, err)
+		return
+	}
+	for _, j := range list {
+		if err := j.prepare(); err != nil {
+			log.Printf("WARN: jail %s disabled: %v", j.Name, err)
+			continue
+		}
+		jails[j.Name] = j
+		j.startLocked()
+	}
+}
+
+func (j *jail) view() gin.H {
+	lines, errMsg := j.follower.status()
+	now := time.Now()
+	tracked := 0
+	for _, times := range j.failures {
+		if now.Sub(times[len(times)-1]) < j.findTime {
+			tracked++
+		}
+	}
+	return gin.H{
+		"name":       j.Name,
+		"source":     j.source(),
+		"patterns":   j.Patterns,
+		"max_retry":  j.MaxRetry,
+		"find_time":  j.FindTime,
+		"ban_time":   j.BanTime,
+		"created_by": j.CreatedBy,
+		"created_at": j.CreatedAt,
+		"lines_read": lines,
+		"matches":    j.matches,
+		"tracked":    tracked,
+		"bans":       j.Bans,
+		"error":      errMsg,
+	}
+}
+
+func registerJailRoutes(rg *gin.RouterGroup) {
+	rg.GET("/jails", func(c *gin.Context) {
+		jailMu.Lock()
+		defer jailMu.Unlock()
+		names := make([]string, 0, len(jails))
+		for name := range jails {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := []gin.H{}
+		for _, name := range names {
+			out = append(out, jails[name].view())
+		}
+		c.JSON(http.StatusOK, gin.H{"jails": out, "presets": jailPresets})
+	})
+
+	type CreateJailRequest struct {
+		Name         string   `json:"name" binding:"required"`
+		Preset       string   `json:"preset"`
+		LogPath      string   `json:"log_path"`
+		Journal      bool     `json:"journal"`
+		JournalUnits []string `json:"journal_units"`
+		Patterns     []string `json:"patterns"`
+		MaxRetry     int      `json:"max_retry"`
+		FindTime     string   `json:"find_time"`
+		BanTime      string   `json:"ban_time"`
+	}
+	// POST /jails starts watching a log. preset fills in the patterns of a
+	// known service; log_path defaults to /var/log/auth.log unless journal
+	// is set.
+	rg.POST("/jails", func(c *gin.Context) {
+		var req CreateJailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reJailName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid jail name", "details": "1-32 lowercase letters, digits or _-"})
+			return
+		}
+		j := &jail{
+			Name:         req.Name,
+			LogPath:      req.LogPath,
+			Journal:      req.Journal,
+			JournalUnits: req.JournalUnits,
+			Patterns:     req.Patterns,
+			MaxRetry:     req.MaxRetry,
+			FindTime:     req.FindTime,
+			BanTime:      req.BanTime,
+			CreatedBy:    c.GetString(ctxKeyName),
+			CreatedAt:    time.Now().UTC(),
+		}
+		if req.Preset != "" {
+			preset, ok := jailPresets[req.Preset]
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown preset", "details": req.Preset})
+				return
+			}
+			j.Patterns = append(append([]string(nil), preset...), j.Patterns...)
+		}
+		if j.Journal {
+			j.LogPath = ""
+		} else if j.LogPath == "" {
+			j.LogPath = defaultJailLog
+		}
+		if j.MaxRetry == 0 {
+			j.MaxRetry = defaultMaxRetry
+		}
+		if j.FindTime == "" {
+			j.FindTime = defaultFindTime.String()
+		}
+		if j.BanTime == "" {
+			j.BanTime = defaultBanTime.String()
+		}
+		if err := j.prepare(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid jail", "details": err.Error()})
+			return
+		}
+
+		jailMu.Lock()
+		defer jailMu.Unlock()
+		if jails[j.Name] != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Jail already exists"})
+			return
+		}
+		jails[j.Name] = j
+		j.startLocked()
+		saveJailsLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Jail created successfully", "jail": j.view()})
+	})
+
+	type TestJailRequest struct {
+		Preset   string   `json:"preset"`
+		Patterns []string `json:"patterns"`
+		Lines    []string `json:"lines" binding:"required"`
+	}
+	// POST /jails/test reports the address each line yields, to try out
+	// patterns before creating a jail.
+	rg.POST("/jails/test", func(c *gin.Context) {
+		var req TestJailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		patterns := append(append([]string(nil), jailPresets[req.Preset]...), req.Patterns...)
+		res, err := compileJailPatterns(patterns)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patterns", "details": err.Error()})
+			return
+		}
+		out := make([]gin.H, 0, len(req.Lines))
+		for _, ln := range req.Lines {
+			ip, ok := matchJailLine(res, ln)
+			out = append(out, gin.H{"line": ln, "matched": ok, "ip": ip})
+		}
+		c.JSON(http.StatusOK, gin.H{"results": out})
+	})
+
+	rg.GET("/jails/:name", func(c *gin.Context) {
+		jailMu.Lock()
+		defer jailMu.Unlock()
+		j := jails[c.Param("name")]
+		if j == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Jail not found"})
+			return
+		}
+		c.JSON(http.StatusOK, j.view())
+	})
+
+	// DELETE /jails/:name stops watching the log; bans already issued
+	// stay until they expire.
+	rg.DELETE("/jails/:name", func(c *gin.Context) {
+		jailMu.Lock()
+		defer jailMu.Unlock()
+		j := jails[c.Param("name")]
+		if j == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Jail not found"})
+			return
+		}
+		close(j.stop)
+		delete(jails, j.Name)
+		saveJailsLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Jail deleted successfully", "name": j.Name})
+	})
+}
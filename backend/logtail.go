@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log followers feed the lines of a log, as they are written, to the log
+// watchers. Files are followed like `tail -F`; the journal is read from
+// `journalctl -f -o export`.
+
+const (
+	logPollInterval    = time.Second
+	journalRestartWait = 5 * time.Second
+	maxLogLine         = 64 << 10
+)
+
+// logFollower reports the state of a follower for status endpoints.
+type logFollower struct {
+	mu    sync.Mutex
+	lines uint64
+	err   string
+}
+
+func (f *logFollower) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		f.err = ""
+	} else {
+		f.err = err.Error()
+	}
+}
+
+func (f *logFollower) count() {
+	f.mu.Lock()
+	f.lines++
+	f.mu.Unlock()
+}
+
+// status returns the number of lines read and the last error, if any.
+func (f *logFollower) status() (uint64, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lines, f.err
+}
+
+// followFile calls fn for each line appended to path until stop is closed.
+// It starts at the end of the file and reopens it from the start when it
+// is rotated or truncated.
+func followFile(path string, stop <-chan struct{}, fn func(string)) *logFollower {
+	fl := &logFollower{}
+	go func() {
+		var f *os.File
+		var r *bufio.Reader
+		var offset int64
+		var partial strings.Builder
+		atEnd := true
+		ticker := time.NewTicker(logPollInterval)
+		defer ticker.Stop()
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
+		for {
+			if f == nil {
+				var err error
+				if f, err = os.Open(path); err != nil {
+					fl.setErr(err)
+					f = nil
+				} else {
+					fl.setErr(nil)
+					offset = 0
+					if atEnd {
+						if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+							offset = 0
+						}
+					}
+					r = bufio.NewReaderSize(f, maxLogLine)
+					partial.Reset()
+				}
+				atEnd = false
+			}
+			if f != nil {
+				for {
+					chunk, err := r.ReadString('\n')
+					offset += int64(len(chunk))
+					if err != nil {
+						if partial.Len() < maxLogLine {
+							partial.WriteString(chunk)
+						}
+						break
+					}
+					partial.WriteString(chunk)
+					fl.count()
+					fn(strings.TrimRight(partial.String(), "\r\n"))
+					partial.Reset()
+				}
+				cur, cerr := f.Stat()
+				st, serr := os.Stat(path)
+				if cerr != nil || serr != nil || !os.SameFile(cur, st) || st.Size() < offset {
+					f.Close()
+					f = nil
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return fl
+}
+
+// followJournal calls fn with the MESSAGE of each new journal entry of the
+// given units (all units if none) until stop is closed. journalctl is
+// restarted if it exits.
+func followJournal(units []string, stop <-chan struct{}, fn func(string)) *logFollower {
+	var filter []string
+	for _, u := range units {
+		filter = append(filter, "-u", u)
+	}
+	return followJournalFilter(filter, stop, fn)
+}
+
+// followKernelJournal is followJournal for the messages the kernel logged
+// itself. Their _TRANSPORT=kernel is set by journald, so other programs
+// cannot write messages that pass the filter.
+func followKernelJournal(stop <-chan struct{}, fn func(string)) *logFollower {
+	return followJournalFilter([]string{"_TRANSPORT=kernel"}, stop, fn)
+}
+
+// followJournalFilter follows the journal entries selected by filter, a list
+// of journalctl arguments.
+func followJournalFilter(filter []string, stop <-chan struct{}, fn func(string)) *logFollower {
+	fl := &logFollower{}
+	go func() {
+		for {
+			err := runJournal(filter, stop, func(msg string) {
+				fl.count()
+				fn(msg)
+			})
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err != nil {
+				log.Printf("WARN: journal: %v, restarting in %s", err, journalRestartWait)
+				fl.setErr(err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(journalRestartWait):
+			}
+		}
+	}()
+	return fl
+}
+
+func runJournal(filter []string, stop <-chan struct{}, fn func(string)) error {
+	path, err := exec.LookPath("journalctl")
+	if err != nil {
+		return fmt.Errorf("journalctl not found: %w", err)
+	}
+	args := append([]string{"-f", "-n", "0", "-o", "export", "-q"}, filter...)
+	cmd := exec.Command(path, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			_ = cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	rerr := readJournalExport(out, fn)
+	werr := cmd.Wait()
+	if rerr != nil {
+		return rerr
+	}
+	return werr
+}
+
+// readJournalExport parses the journal export format: entries of
+// "FIELD=value" lines separated by an empty line, where binary values are
+// written as the field name, a little-endian 64-bit length and the data.
+func readJournalExport(r io.Reader, fn func(string)) error {
+	br := bufio.NewReaderSize(r, maxLogLine)
+	msg := ""
+	for {
+		ln, err := br.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		ln = bytes.TrimSuffix(ln, []byte("\n"))
+		if len(ln) == 0 {
+			if msg != "" {
+				fn(msg)
+			}
+			msg = ""
+			continue
+		}
+		if i := bytes.IndexByte(ln, '='); i != -1 {
+			if string(ln[:i]) == "MESSAGE" {
+				msg = string(ln[i+1:])
+			}
+			continue
+		}
+		var size uint64
+		if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size > maxLogLine {
+			if _, err := io.CopyN(io.Discard, br, int64(size)+1); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		if string(ln) == "MESSAGE" {
+			msg = string(data[:size])
+		}
+	}
+}
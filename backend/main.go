@@ -1,14 +1,9 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"net/url"
@@ -23,12 +18,7 @@ import (
 	"github.com/joho/godotenv"
 )
 
-const (
-	certFileName = "server.crt"
-	keyFileName  = "server.key"
-)
-
-var expectedAPIKey string
+var errInvalidAPIKey = errors.New("invalid or missing API key")
 
 type failInfo struct {
 	Count int
@@ -57,75 +47,18 @@ func init() {
 	}
 }
 
-func ensureSelfSignedCert(certPath, keyPath string) error {
-	if _, err := os.Stat(certPath); err == nil {
-		if _, err = os.Stat(keyPath); err == nil {
-			log.Printf("Detected existing self-signed certificate, skipping generation (%s, %s)", certPath, keyPath)
-			return nil
-		}
-	}
-
-	log.Println("No self-signed certificate found, starting generation…")
-
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("failed to generate private key: %w", err)
-	}
-
-	max := new(big.Int)
-	max.Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, max)
-	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %w", err)
-	}
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"UFW-Panel"},
-			CommonName:   "localhost",
-		},
-		NotBefore: time.Now().Add(-time.Hour),
-		NotAfter:  time.Now().AddDate(10, 0, 0),
-
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		DNSNames:              []string{"localhost"},
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return fmt.Errorf("failed to generate certificate: %w", err)
-	}
-
-	certOut, err := os.Create(certPath)
-	if err != nil {
-		return fmt.Errorf("failed to create certificate file: %w", err)
-	}
-	defer certOut.Close()
-	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return fmt.Errorf("failed to write certificate: %w", err)
-	}
-
-	keyOut, err := os.Create(keyPath)
-	if err != nil {
-		return fmt.Errorf("failed to create private key file: %w", err)
-	}
-	defer keyOut.Close()
-	if err = pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
-		return fmt.Errorf("failed to write private key: %w", err)
-	}
-
-	log.Printf("Self-signed certificate created (%s, %s)", certPath, keyPath)
-	return nil
-}
-
 func AuthMiddleware() gin.HandlerFunc {
-	expectedAPIKey = os.Getenv("UFW_API_KEY")
-	if expectedAPIKey == "" {
-		log.Fatal("FATAL: UFW_API_KEY not set")
+	var err error
+	if apiKeys, err = loadAPIKeys(); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	if len(apiKeys) == 0 {
+		if !mtlsEnabled() {
+			log.Fatal("FATAL: UFW_API_KEY not set")
+		}
+		log.Println("UFW_API_KEY not set, authenticating clients by TLS client certificate only")
 	}
+	go pruneNoncesLoop()
 
 	return func(c *gin.Context) {
 		if c.Request.Method == http.MethodOptions {
@@ -141,8 +74,26 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		apiKey := c.GetHeader("X-API-KEY")
-		if apiKey == "" || apiKey != expectedAPIKey {
+		if cn, ok := verifiedClientCert(c); ok && len(apiKeys) == 0 {
+			c.Set(ctxKeyName, "cert:"+cn)
+			c.Next()
+			return
+		}
+
+		var authErr error
+		keyName := ""
+		if len(apiKeys) == 0 {
+			authErr = errors.New("client certificate required")
+		} else if hasSignature(c.Request) {
+			keyName, authErr = verifyRequestSignature(c.Writer, c.Request, apiKeys)
+		} else if signatureRequired() {
+			authErr = errors.New("request signature required")
+		} else if name, ok := lookupAPIKey(c.GetHeader("X-API-KEY")); ok {
+			keyName = name
+		} else {
+			authErr = errInvalidAPIKey
+		}
+		if authErr != nil {
 			now := time.Now()
 			val, _ := failedAttempts.LoadOrStore(ip, &failInfo{Count: 0, First: now})
 			fi := val.(*failInfo)
@@ -154,32 +105,51 @@ func AuthMiddleware() gin.HandlerFunc {
 				fi.Count++
 			}
 
-			if fi.Count >= maxFails {
-				blockedIPs.Store(ip, struct{}{})
-				go func() {
-					if err := DenyUFWFromIP(ip, "", fmt.Sprintf("AUTO BLOCK: %d fails/m", maxFails)); err != nil {
-						log.Printf("WARN: failed to add UFW deny rule for %s: %v", ip, err)
-					}
-				}()
+			if fi.Count >= maxFails && banIP(ip, "api", fmt.Sprintf("AUTO BLOCK: %d fails/m", maxFails), 0) {
 				c.JSON(http.StatusForbidden, gin.H{"error": "Too many failed attempts, IP blocked"})
-			} else {
+			} else if errors.Is(authErr, errInvalidAPIKey) {
 				c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or missing API key"})
+			} else {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Invalid request signature", "details": authErr.Error()})
 			}
 			c.Abort()
 			return
 		}
 
 		failedAttempts.Delete(ip)
+		c.Set(ctxKeyName, keyName)
 		c.Next()
 	}
 }
 
+// trustedProxies returns the IPs/CIDRs listed in TRUSTED_PROXIES.
+func trustedProxies() []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if vv := strings.TrimSpace(v); vv != "" {
+			out = append(out, vv)
+		}
+	}
+	return out
+}
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: Could not load .env file:", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "helper" {
+		runHelper()
+		return
+	}
+
 	router := gin.Default()
+	// Client IPs decide lockouts, bans and the audit log, so forwarding
+	// headers are only believed from the proxies listed in TRUSTED_PROXIES.
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("FATAL: invalid TRUSTED_PROXIES: %v", err)
+	}
+	router.Use(requestIDMiddleware())
 
 	allowedOriginsEnv := os.Getenv("CORS_ALLOWED_ORIGINS")
 	rawItems := []string{}
@@ -231,31 +201,43 @@ func main() {
 	router.Use(cors.New(cors.Config{
 		AllowOriginFunc:  allowOriginFunc,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "X-API-KEY", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "X-API-KEY", "Authorization", headerTimestamp, headerNonce, headerSignature, headerRequestID},
+		ExposeHeaders:    []string{"Content-Length", headerRequestID},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
+	var certs *certReloader
+
 	authorized := router.Group("/")
-	authorized.Use(AuthMiddleware())
+	authorized.Use(AuthMiddleware(), auditMiddleware())
 	{
 		authorized.GET("/ping", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": "pong"})
 		})
 
+		authorized.GET("/tls/certificate", func(c *gin.Context) {
+			c.JSON(http.StatusOK, certs.info())
+		})
+
 		authorized.GET("/status", func(c *gin.Context) {
 			status, err := GetUFWStatus()
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get UFW status", "details": err.Error()})
 				return
 			}
+			if status.Protected, err = statusProtectedPorts(status); err != nil {
+				log.Printf("WARN: failed to check protected ports: %v", err)
+			}
+			status.Drift = currentDriftSummary()
+			status.Expiring = expiringRulesStatus(status)
 			c.JSON(http.StatusOK, status)
 		})
 
 		type AllowRuleRequest struct {
 			Rule    string `json:"rule" binding:"required"`
 			Comment string `json:"comment"`
+			ruleExpiry
 		}
 		authorized.POST("/rules/allow", func(c *gin.Context) {
 			var req AllowRuleRequest
@@ -263,16 +245,18 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
 				return
 			}
-			if err := AllowUFWPort(req.Rule, req.Comment); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add allow rule", "details": err.Error()})
+			args, err := portRuleArgs("allow", req.Rule, req.Comment)
+			t, ok := addRuleWithExpiry(c, req.ruleExpiry, "Failed to add allow rule", args, err)
+			if !ok {
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"message": "Rule added successfully", "rule": req.Rule, "comment": req.Comment})
+			c.JSON(http.StatusOK, withExpiry(gin.H{"message": "Rule added successfully", "rule": req.Rule, "comment": req.Comment}, t))
 		})
 
 		type DenyRuleRequest struct {
 			Rule    string `json:"rule" binding:"required"`
 			Comment string `json:"comment"`
+			ruleExpiry
 		}
 		authorized.POST("/rules/deny", func(c *gin.Context) {
 			var req DenyRuleRequest
@@ -280,11 +264,12 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
 				return
 			}
-			if err := DenyUFWPort(req.Rule, req.Comment); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add deny rule", "details": err.Error()})
+			args, err := portRuleArgs("deny", req.Rule, req.Comment)
+			t, ok := addRuleWithExpiry(c, req.ruleExpiry, "Failed to add deny rule", args, err)
+			if !ok {
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"message": "Deny rule added successfully", "rule": req.Rule, "comment": req.Comment})
+			c.JSON(http.StatusOK, withExpiry(gin.H{"message": "Deny rule added successfully", "rule": req.Rule, "comment": req.Comment}, t))
 		})
 
 		authorized.DELETE("/rules/delete/:number", func(c *gin.Context) {
@@ -293,6 +278,11 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Rule number parameter is required"})
 				return
 			}
+			if n, err := strconv.Atoi(ruleNumber); err == nil && !forceRequested(c) {
+				if abortOnLockout(c, checkDeleteLockout(n)) {
+					return
+				}
+			}
 			if err := DeleteUFWByNumber(ruleNumber); err != nil {
 				if strings.Contains(err.Error(), "not found") {
 					c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found", "details": err.Error()})
@@ -306,13 +296,27 @@ func main() {
 
 		authorized.POST("/enable", func(c *gin.Context) {
 			log.Println("Attempting to enable UFW via API endpoint...")
-			if err := EnableUFW(); err != nil {
+			timeout, err := confirmTimeout(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+				return
+			}
+			if !forceRequested(c) && abortOnLockout(c, checkEnableLockout()) {
+				return
+			}
+			change, err := applyConfirmable("enable", timeout, EnableUFW)
+			if err != nil {
 				log.Printf("Error enabling UFW via API: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable UFW", "details": err.Error()})
+			}
+			if abortOnApplyError(c, err, "Failed to enable UFW") {
 				return
 			}
 			log.Println("UFW enabled successfully via API.")
-			c.JSON(http.StatusOK, gin.H{"message": "UFW enabled successfully"})
+			resp := gin.H{"message": "UFW enabled successfully"}
+			if change != nil {
+				resp["pending"] = change.view()
+			}
+			c.JSON(http.StatusOK, resp)
 		})
 
 		authorized.POST("/disable", func(c *gin.Context) {
@@ -323,10 +327,46 @@ func main() {
 			c.JSON(http.StatusOK, gin.H{"message": "UFW disabled successfully (or was already inactive)"})
 		})
 
+		type DefaultPolicyRequest struct {
+			Direction string `json:"direction" binding:"required"`
+			Policy    string `json:"policy" binding:"required"`
+		}
+		authorized.POST("/default", func(c *gin.Context) {
+			var req DefaultPolicyRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+				return
+			}
+			if !ufwDefaultPolicies[req.Policy] || !ufwDefaultDirections[req.Direction] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: policy must be allow, deny or reject and direction incoming, outgoing or routed"})
+				return
+			}
+			timeout, err := confirmTimeout(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+				return
+			}
+			if !forceRequested(c) && abortOnLockout(c, checkDefaultLockout(req.Policy, req.Direction)) {
+				return
+			}
+			change, err := applyConfirmable("default "+req.Policy+" "+req.Direction, timeout, func() error {
+				return SetUFWDefault(req.Policy, req.Direction)
+			})
+			if abortOnApplyError(c, err, "Failed to set default policy") {
+				return
+			}
+			resp := gin.H{"message": "Default policy updated successfully", "direction": req.Direction, "policy": req.Policy}
+			if change != nil {
+				resp["pending"] = change.view()
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
 		type IPRuleRequest struct {
 			IPAddress    string `json:"ip_address" binding:"required"`
 			PortProtocol string `json:"port_protocol"`
 			Comment      string `json:"comment"`
+			ruleExpiry
 		}
 		authorized.POST("/rules/allow/ip", func(c *gin.Context) {
 			var req IPRuleRequest
@@ -334,11 +374,12 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
 				return
 			}
-			if err := AllowUFWFromIP(req.IPAddress, req.PortProtocol, req.Comment); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add allow rule from IP", "details": err.Error()})
+			args, err := ipRuleArgs("allow", req.IPAddress, req.PortProtocol, req.Comment)
+			t, ok := addRuleWithExpiry(c, req.ruleExpiry, "Failed to add allow rule from IP", args, err)
+			if !ok {
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"message": "Allow rule from IP added successfully", "ip_address": req.IPAddress, "port_protocol": req.PortProtocol, "comment": req.Comment})
+			c.JSON(http.StatusOK, withExpiry(gin.H{"message": "Allow rule from IP added successfully", "ip_address": req.IPAddress, "port_protocol": req.PortProtocol, "comment": req.Comment}, t))
 		})
 		authorized.POST("/rules/deny/ip", func(c *gin.Context) {
 			var req IPRuleRequest
@@ -346,11 +387,12 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
 				return
 			}
-			if err := DenyUFWFromIP(req.IPAddress, req.PortProtocol, req.Comment); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add deny rule from IP", "details": err.Error()})
+			args, err := ipRuleArgs("deny", req.IPAddress, req.PortProtocol, req.Comment)
+			t, ok := addRuleWithExpiry(c, req.ruleExpiry, "Failed to add deny rule from IP", args, err)
+			if !ok {
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"message": "Deny rule from IP added successfully", "ip_address": req.IPAddress, "port_protocol": req.PortProtocol, "comment": req.Comment})
+			c.JSON(http.StatusOK, withExpiry(gin.H{"message": "Deny rule from IP added successfully", "ip_address": req.IPAddress, "port_protocol": req.PortProtocol, "comment": req.Comment}, t))
 		})
 
 		type RouteAllowRuleRequest struct {
@@ -359,6 +401,7 @@ func main() {
 			ToIP     string `json:"to_ip"`
 			Port     string `json:"port"`
 			Comment  string `json:"comment"`
+			ruleExpiry
 		}
 		authorized.POST("/rules/route/allow", func(c *gin.Context) {
 			var req RouteAllowRuleRequest
@@ -370,43 +413,74 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: Protocol or Port must be specified for a route rule."})
 				return
 			}
-			if err := RouteAllowUFW(req.Protocol, req.FromIP, req.ToIP, req.Port, req.Comment); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add route allow rule", "details": err.Error()})
+			args, err := routeAllowArgs(req.Protocol, req.FromIP, req.ToIP, req.Port, req.Comment)
+			t, ok := addRuleWithExpiry(c, req.ruleExpiry, "Failed to add route allow rule", args, err)
+			if !ok {
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{
+			c.JSON(http.StatusOK, withExpiry(gin.H{
 				"message":  "Route allow rule added successfully",
 				"protocol": req.Protocol,
 				"from_ip":  req.FromIP,
 				"to_ip":    req.ToIP,
 				"port":     req.Port,
 				"comment":  req.Comment,
-			})
+			}, t))
 		})
-	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "30737"
+		registerBatchRoutes(authorized)
+		registerConfirmRoutes(authorized)
+		registerSnapshotRoutes(authorized)
+		registerRulesetRoutes(authorized)
+		registerPlanRoutes(authorized)
+		registerDriftRoutes(authorized)
+		registerAuditRoutes(authorized)
+		registerExpiryRoutes(authorized)
+		registerScheduleRoutes(authorized)
+		registerGroupRoutes(authorized)
+		registerIPSetRoutes(authorized)
+		registerFeedRoutes(authorized)
+		registerAllowlistRoutes(authorized)
+		registerGeoIPRoutes(authorized)
+		registerHostRuleRoutes(authorized)
+		registerBanRoutes(authorized)
+		registerJailRoutes(authorized)
+		registerPortScanRoutes(authorized)
+		registerTrafficRoutes(authorized)
+		registerEventRoutes(authorized)
 	}
-	apiRule := port + "/tcp"
 
-	log.Printf("Attempting to add allow rule for API port %s during startup...", apiRule)
-	if startupErr := AllowUFWPort(apiRule, ""); startupErr != nil {
-		if strings.Contains(startupErr.Error(), "Skipping adding existing rule") {
-			log.Printf("Rule for API port '%s' already exists or skipping message detected.", apiRule)
-		} else {
-			log.Printf("WARNING: Error adding allow rule for API port '%s' during startup: %v. Ensure the server is run with sudo if needed.", apiRule, startupErr)
-		}
-	} else {
-		log.Printf("Successfully added or ensured allow rule for API port: %s", apiRule)
+	port := apiPort()
+	apiSources, err := apiAllowedSources()
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
 	}
+	bindAddr, err := bindAddress()
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	startDriftDetection()
+	loadAuditLog()
+	loadAddressGroups()
+	startIPSets()
+	startFeeds()
+	startAllowlists()
+	startGeoIP()
+	startHostRules()
+	startJails()
+	startPortScan()
+	resumePendingChange()
+	startRuleExpiry()
+	startSchedules()
+	ensureAPIPortRulesAudited(port, apiSources)
 
 	log.Printf("Starting server on port %s", port)
 
 	// Check for custom TLS certificate paths
 	certPath := os.Getenv("TLS_CERT_PATH")
 	keyPath := os.Getenv("TLS_KEY_PATH")
+	selfSigned := false
 	
 	if certPath != "" && keyPath != "" {
 		// Validate custom certificate files exist
@@ -421,13 +495,35 @@ func main() {
 		// Use self-signed certificate
 		certPath = certFileName
 		keyPath = keyFileName
+		selfSigned = true
 		if err := ensureSelfSignedCert(certPath, keyPath); err != nil {
 			log.Fatalf("FATAL: Failed to ensure self-signed certificate: %v", err)
 		}
 	}
 
+	certs, err = newCertReloader(certPath, keyPath, selfSigned)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	go certs.watch()
+
+	tlsConfig, err := buildServerTLSConfig()
+	if err != nil {
+		log.Fatalf("FATAL: Failed to configure TLS: %v", err)
+	}
+	tlsConfig.GetCertificate = certs.GetCertificate
+	if mtlsEnabled() {
+		log.Printf("Mutual TLS enabled, requiring client certificates signed by %s", clientCAPath())
+	}
+
+	server := &http.Server{
+		Addr:      net.JoinHostPort(bindAddr, port),
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+
 	log.Printf("Attempting to start HTTPS server on port %s using %s and %s", port, certPath, keyPath)
-	if err := router.RunTLS(":"+port, certPath, keyPath); err != nil {
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		log.Fatalf("FATAL: Failed to start HTTPS server: %v", err)
 	}
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// A minimal reader for MaxMind DB files (GeoLite2/GeoIP2 Country and
+// compatible databases such as DB-IP's), enough to list the networks of
+// each country. It decodes the metadata and walks the whole search tree;
+// see https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMMDBDepth limits the nesting of maps, arrays and pointers in a data
+// record, so a corrupt file cannot recurse without end.
+const maxMMDBDepth = 32
+
+type mmdbReader struct {
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	dbType     string
+	buildEpoch uint64
+	// dataStart is the offset of the data section in data.
+	dataStart uint64
+}
+
+func openMMDB(data []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, errors.New("not a MaxMind DB file: metadata not found")
+	}
+	d := mmdbDecoder{buf: data[i+len(mmdbMetadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata: not a map")
+	}
+	r := &mmdbReader{data: data[:i]}
+	r.nodeCount, _ = meta["node_count"].(uint64)
+	r.recordSize, _ = meta["record_size"].(uint64)
+	r.ipVersion, _ = meta["ip_version"].(uint64)
+	r.dbType, _ = meta["database_type"].(string)
+	r.buildEpoch, _ = meta["build_epoch"].(uint64)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.nodeCount == 0 || r.nodeCount > uint64(len(r.data))*4/r.recordSize {
+		return nil, errors.New("search tree larger than file")
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint64(len(r.data)) {
+		return nil, errors.New("search tree larger than file")
+	}
+	r.dataStart = treeSize + 16
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) record(node uint64, bit int) uint64 {
+	b := r.data[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// walk calls fn for every network in the tree with the offset of its data
+// record. In IPv6 databases the IPv4 space lives under ::/96 and is
+// reported as IPv4; the aliases MaxMind adds for it are skipped.
+func (r *mmdbReader) walk(fn func(netip.Prefix, uint64) error) error {
+	if r.ipVersion != 6 {
+		return r.walkNode(0, [16]byte{}, 0, 32, 0, fn)
+	}
+	v4 := uint64(0)
+	for i := 0; i < 96 && v4 < r.nodeCount; i++ {
+		v4 = r.record(v4, 0)
+	}
+	if v4 < r.nodeCount {
+		if err := r.walkNode(v4, [16]byte{}, 0, 32, 0, fn); err != nil {
+			return err
+		}
+	}
+	return r.walkNode(0, [16]byte{}, 0, 128, v4, fn)
+}
+
+func (r *mmdbReader) walkNode(node uint64, ip [16]byte, depth, bits int, skip uint64, fn func(netip.Prefix, uint64) error) error {
+	for bit := 0; bit < 2; bit++ {
+		next := ip
+		if bit == 1 {
+			next[depth/8] |= 0x80 >> (depth % 8)
+		}
+		rec := r.record(node, bit)
+		switch {
+		case rec < r.nodeCount:
+			if (rec == skip && skip != 0) || depth+1 >= bits {
+				continue
+			}
+			if err := r.walkNode(rec, next, depth+1, bits, skip, fn); err != nil {
+				return err
+			}
+		case rec > r.nodeCount:
+			var addr netip.Addr
+			if bits == 32 {
+				addr = netip.AddrFrom4([4]byte(next[:4]))
+			} else {
+				addr = netip.AddrFrom16(next)
+			}
+			if err := fn(netip.PrefixFrom(addr, depth+1), rec-r.nodeCount-16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeAt decodes the data record at offset in the data section.
+func (r *mmdbReader) decodeAt(offset uint64) (any, error) {
+	d := mmdbDecoder{buf: r.data[r.dataStart:]}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) bytesAt(off, n uint64) ([]byte, error) {
+	if off+n > uint64(len(d.buf)) || off+n < off {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[off : off+n], nil
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decode returns the value at off and the offset following it. Integers
+// of every width are returned as uint64 (int32 as int64), maps as
+// map[string]any and arrays as []any.
+func (d *mmdbDecoder) decode(off uint64) (any, uint64, error) {
+	return d.decodeDepth(off, 0)
+}
+
+func (d *mmdbDecoder) decodeDepth(off uint64, depth int) (any, uint64, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	b, err := d.bytesAt(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		size := uint64(ctrl>>3) & 0x3
+		n := size + 1
+		pb, err := d.bytesAt(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		p := beUint(pb)
+		switch size {
+		case 0:
+			p |= uint64(ctrl&0x7) << 8
+		case 1:
+			p = (p | uint64(ctrl&0x7)<<16) + 2048
+		case 2:
+			p = (p | uint64(ctrl&0x7)<<24) + 526336
+		}
+		// A pointer may not point to another pointer.
+		tb, err := d.bytesAt(p, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if tb[0]>>5 == 1 {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		v, _, err := d.decodeDepth(p, depth+1)
+		return v, off + n, err
+	}
+	if typ == 0 {
+		eb, err := d.bytesAt(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(eb[0])
+		off++
+	}
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		sb, err := d.bytesAt(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + beUint(sb)
+		case 2:
+			size = 285 + beUint(sb)
+		default:
+			size = 65821 + beUint(sb)
+		}
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, min(size, uint64(len(d.buf))))
+		for i := uint64(0); i < size; i++ {
+			k, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, uint64(len(d.buf))))
+		for i := uint64(0); i < size; i++ {
+			v, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean, stored in the size
+		return size != 0, off, nil
+	}
+
+	vb, err := d.bytesAt(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(vb), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(vb)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(vb))), off, nil
+	case 4: // bytes
+		return vb, off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		return beUint(vb), off, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errors.New("invalid int32")
+		}
+		shift := 32 - 8*size
+		return int64(int32(uint32(beUint(vb))<<shift) >> shift), off, nil
+	case 10: // uint128, not needed here
+		return vb, off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func clientCAPath() string {
+	return os.Getenv("TLS_CLIENT_CA_PATH")
+}
+
+func mtlsEnabled() bool {
+	return clientCAPath() != ""
+}
+
+// clientPins are the client certificates accepted under MTLS_ALLOWED_CLIENTS:
+// SHA-256 fingerprints of the public key (SPKI) and common names.
+type clientPins struct {
+	fingerprints map[string]bool
+	names        map[string]bool
+}
+
+// mtlsAllowedClients parses MTLS_ALLOWED_CLIENTS, a comma-separated list of
+// SPKI fingerprints (hex, colons and a "sha256:" prefix allowed) or common
+// names. The CA signs certificates for every backend, so without a pin a
+// certificate issued for one backend would be accepted by all of them.
+func mtlsAllowedClients() (*clientPins, error) {
+	pins := &clientPins{fingerprints: map[string]bool{}, names: map[string]bool{}}
+	for _, item := range strings.Split(os.Getenv("MTLS_ALLOWED_CLIENTS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fp := strings.NewReplacer(":", "", " ", "").Replace(strings.TrimPrefix(strings.ToLower(item), "sha256:"))
+		if _, err := hex.DecodeString(fp); err == nil && len(fp) == sha256.Size*2 {
+			pins.fingerprints[fp] = true
+		} else {
+			pins.names[item] = true
+		}
+	}
+	if len(pins.fingerprints) == 0 && len(pins.names) == 0 {
+		return nil, errors.New("MTLS_ALLOWED_CLIENTS must list the client certificates allowed when TLS_CLIENT_CA_PATH is set")
+	}
+	return pins, nil
+}
+
+func (p *clientPins) allows(cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return p.fingerprints[hex.EncodeToString(sum[:])] || p.names[cert.Subject.CommonName]
+}
+
+func buildServerTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if !mtlsEnabled() {
+		return cfg, nil
+	}
+
+	pemData, err := os.ReadFile(clientCAPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAPath())
+	}
+	pins, err := mtlsAllowedClients()
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 || !pins.allows(cs.PeerCertificates[0]) {
+			return errors.New("client certificate is not listed in MTLS_ALLOWED_CLIENTS")
+		}
+		return nil
+	}
+	return cfg, nil
+}
+
+// verifiedClientCert reports whether the client presented a certificate that
+// was verified against TLS_CLIENT_CA_PATH and MTLS_ALLOWED_CLIENTS, and its
+// common name.
+func verifiedClientCert(c *gin.Context) (string, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return c.Request.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	planTTL  = time.Hour
+	maxPlans = 32
+
+	familyV4 = "v4"
+	familyV6 = "v6"
+)
+
+var familyWildcard = map[string]string{familyV4: "0.0.0.0/0", familyV6: "::/0"}
+
+// liveState is the configuration a plan is computed against. ufw keeps the
+// IPv4 and IPv6 rules in separate ordered lists, so both are kept as read.
+type liveState struct {
+	Ruleset *ruleset      `json:"ruleset"`
+	V4      []rulesetRule `json:"v4"`
+	V6      []rulesetRule `json:"v6"`
+	IPv6    bool          `json:"ipv6"`
+}
+
+func readLiveState() (*liveState, error) {
+	rs, err := readRuleset()
+	if err != nil {
+		return nil, err
+	}
+	v4, v6, err := readUserRuleFamilies()
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := readUFWFile(ufwDefaults)
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := !strings.EqualFold(parseShellVars(string(defaults))["IPV6"], "no")
+	return &liveState{Ruleset: rs, V4: v4, V6: v6, IPv6: ipv6}, nil
+}
+
+func (l *liveState) hash() string {
+	data, _ := json.Marshal(l)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// planStep is one ufw command of a plan. Position is the rule number passed
+// to `ufw insert`, counted like `ufw status numbered` does.
+type planStep struct {
+	Op        string       `json:"op"`
+	Family    string       `json:"family,omitempty"`
+	Position  int          `json:"position,omitempty"`
+	Moved     bool         `json:"moved,omitempty"`
+	Rule      *rulesetRule `json:"rule,omitempty"`
+	Policy    string       `json:"policy,omitempty"`
+	Direction string       `json:"direction,omitempty"`
+	Logging   string       `json:"logging,omitempty"`
+	Command   string       `json:"command"`
+
+	args []string
+}
+
+type planSummary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Moved    int `json:"moved"`
+	Updated  int `json:"updated"`
+	Defaults int `json:"defaults"`
+	Logging  int `json:"logging"`
+}
+
+// plan is the reviewed set of steps that turns the live state with hash
+// BaseHash into the desired ruleset. Lockout lists the protected ports the
+// desired rules and defaults leave uncovered.
+type plan struct {
+	ID        string          `json:"id"`
+	BaseHash  string          `json:"base_hash"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Steps     []planStep      `json:"steps"`
+	Summary   planSummary     `json:"summary"`
+	Lockout   []protectedPort `json:"lockout,omitempty"`
+}
+
+func newStep(op string, args ...string) planStep {
+	s := planStep{Op: op, args: args}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	s.Command = "ufw " + strings.Join(quoted, " ")
+	return s
+}
+
+// ruleFamilies reports which IP versions a normalized rule applies to.
+func ruleFamilies(r rulesetRule) []string {
+	for _, a := range []string{r.From, r.To} {
+		if a == "any" {
+			continue
+		}
+		if strings.Contains(a, ":") {
+			return []string{familyV6}
+		}
+		return []string{familyV4}
+	}
+	return []string{familyV4, familyV6}
+}
+
+// familyForm writes the family's wildcard address as "any", the form rules
+// take within the list of one IP version.
+func familyForm(r rulesetRule, family string) rulesetRule {
+	w := familyWildcard[family]
+	if r.From == w {
+		r.From = "any"
+	}
+	if r.To == w {
+		r.To = "any"
+	}
+	return r
+}
+
+// familyArgs returns ufw arguments that address only the family's copy of r.
+func familyArgs(r rulesetRule, family string) []string {
+	if r.From == "any" && r.To == "any" {
+		r.From = familyWildcard[family]
+	}
+	return r.args()
+}
+
+// insertArgs places the position after "insert", which follows "route" for
+// route rules.
+func insertArgs(args []string, position int) []string {
+	pos := strconv.Itoa(position)
+	if len(args) > 0 && args[0] == "route" {
+		return append([]string{"route", "insert", pos}, args[1:]...)
+	}
+	return append([]string{"insert", pos}, args...)
+}
+
+// buildPlan computes the steps that turn live into doc. Rules are planned
+// per IP version: rules missing from doc are deleted, rules out of order are
+// deleted and inserted again at their position, and the order kept is the
+// longest common subsequence of both lists. The IPv6 steps follow the IPv4
+// ones, so their positions are offset by the final number of IPv4 rules.
+func buildPlan(live *liveState, doc *ruleset) (*plan, error) {
+	want := map[string][]rulesetRule{}
+	seen := map[string]int{}
+	for i, r := range doc.Rules {
+		if prev, ok := seen[r.key()]; ok {
+			return nil, fmt.Errorf("rule %d duplicates rule %d", i, prev)
+		}
+		seen[r.key()] = i
+
+		families := ruleFamilies(r)
+		if !live.IPv6 {
+			if len(families) == 1 && families[0] == familyV6 {
+				return nil, fmt.Errorf("rule %d: IPv6 is disabled in %s", i, ufwDefaults)
+			}
+			families = []string{familyV4}
+		}
+		for _, f := range families {
+			want[f] = append(want[f], familyForm(r, f))
+		}
+	}
+
+	p := &plan{Steps: []planStep{}}
+	p.planFamily(familyV4, live.V4, want[familyV4], 0)
+	if live.IPv6 {
+		p.planFamily(familyV6, live.V6, want[familyV6], len(want[familyV4]))
+	}
+
+	cur := rulesetDefaults{}
+	if live.Ruleset.Defaults != nil {
+		cur = *live.Ruleset.Defaults
+	}
+	if d := doc.Defaults; d != nil {
+		for _, c := range []struct{ want, have, direction string }{
+			{d.Incoming, cur.Incoming, "incoming"},
+			{d.Outgoing, cur.Outgoing, "outgoing"},
+			{d.Routed, cur.Routed, "routed"},
+		} {
+			if c.want != "" && c.want != c.have {
+				s := newStep("default", "default", c.want, c.direction)
+				s.Policy, s.Direction = c.want, c.direction
+				p.Steps = append(p.Steps, s)
+				p.Summary.Defaults++
+			}
+		}
+	}
+	if doc.Logging != "" && doc.Logging != live.Ruleset.Logging {
+		s := newStep("logging", "logging", doc.Logging)
+		s.Logging = doc.Logging
+		p.Steps = append(p.Steps, s)
+		p.Summary.Logging++
+	}
+
+	var final []statusRule
+	for _, f := range []string{familyV4, familyV6} {
+		for _, r := range want[f] {
+			s := r.statusRule()
+			s.V6 = f == familyV6
+			final = append(final, s)
+		}
+	}
+	incoming := cur.Incoming
+	if d := doc.Defaults; d != nil && d.Incoming != "" {
+		incoming = d.Incoming
+	}
+	if incoming == "" {
+		incoming = "deny"
+	}
+	p.Lockout = uncoveredPorts(protectedPortStatus(final, incoming))
+	return p, nil
+}
+
+func (p *plan) planFamily(family string, current, want []rulesetRule, offset int) {
+	wantKeys := make([]string, len(want))
+	wanted := map[string]bool{}
+	for i, r := range want {
+		wantKeys[i] = r.key()
+		wanted[wantKeys[i]] = true
+	}
+
+	add := func(s planStep, r rulesetRule) {
+		s.Family = family
+		s.Rule = &r
+		p.Steps = append(p.Steps, s)
+	}
+
+	existing := map[string]rulesetRule{}
+	var keptKeys []string
+	for _, r := range current {
+		r = familyForm(r, family)
+		k := r.key()
+		if _, dup := existing[k]; dup || !wanted[k] {
+			add(deleteStep(r, family), r)
+			p.Summary.Removed++
+			continue
+		}
+		existing[k] = r
+		keptKeys = append(keptKeys, k)
+	}
+
+	moved := map[string]bool{}
+	var order []string
+	for _, op := range diffLines(keptKeys, wantKeys) {
+		switch op.Kind {
+		case ' ':
+			order = append(order, op.Line)
+		case '-':
+			r := existing[op.Line]
+			s := deleteStep(r, family)
+			s.Moved = true
+			add(s, r)
+			moved[op.Line] = true
+			p.Summary.Moved++
+		}
+	}
+
+	for i, r := range want {
+		k := wantKeys[i]
+		if i < len(order) && order[i] == k {
+			continue
+		}
+		s := placeStep(r, family, offset+i+1, i == len(order))
+		s.Moved = moved[k]
+		add(s, r)
+		if !moved[k] {
+			p.Summary.Added++
+		}
+		order = append(order[:i], append([]string{k}, order[i:]...)...)
+	}
+
+	for i, r := range want {
+		cur, ok := existing[wantKeys[i]]
+		if !ok || moved[wantKeys[i]] || cur.Comment == r.Comment {
+			continue
+		}
+		p.Summary.Updated++
+		if r.Comment != "" {
+			add(newStep("update", familyArgs(r, family)...), r)
+			continue
+		}
+		// Adding a rule again without a comment keeps the old one, so the
+		// rule is replaced in place instead.
+		add(deleteStep(cur, family), cur)
+		add(placeStep(r, family, offset+i+1, i == len(want)-1), r)
+	}
+}
+
+func deleteStep(r rulesetRule, family string) planStep {
+	r.Comment = ""
+	return newStep("delete", append([]string{"delete"}, familyArgs(r, family)...)...)
+}
+
+// placeStep adds r at rule number position, or at the end of its list if
+// last is set; ufw refuses to insert past the last rule.
+func placeStep(r rulesetRule, family string, position int, last bool) planStep {
+	if last {
+		return newStep("append", familyArgs(r, family)...)
+	}
+	s := newStep("insert", insertArgs(familyArgs(r, family), position)...)
+	s.Position = position
+	return s
+}
+
+// statusRule converts the rule to the `ufw status` column layout used by the
+// protected port checks.
+func (r *rulesetRule) statusRule() statusRule {
+	s := statusRule{Action: strings.ToUpper(r.Action), Direction: strings.ToUpper(r.Direction), From: "Anywhere", To: "Anywhere", Comment: r.Comment}
+	if r.Route {
+		s.Direction = "FWD"
+	}
+	if r.From != "any" {
+		s.From = r.From
+	}
+	if r.To != "any" {
+		s.To = r.To
+	}
+	switch {
+	case r.App != "":
+		s.To = r.App
+	case r.Port != "":
+		port := r.Port
+		if r.Proto != "any" {
+			port += "/" + r.Proto
+		}
+		if s.To == "Anywhere" {
+			s.To = port
+		} else {
+			s.To += " " + port
+		}
+	}
+	s.V6 = strings.Contains(r.From+r.To, ":")
+	return s
+}
+
+func (s *planStep) apply() error {
+	switch s.Op {
+	case "delete":
+		_, err := runUFWForce(s.args...)
+		return err
+	case "default":
+		return SetUFWDefault(s.Policy, s.Direction)
+	}
+	_, err := runUFW(s.args...)
+	return err
+}
+
+func (p *plan) execute() error {
+	for i := range p.Steps {
+		if err := p.Steps[i].apply(); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i, p.Steps[i].Command, err)
+		}
+	}
+	return nil
+}
+
+var (
+	planMu sync.Mutex
+	plans  = map[string]*plan{}
+)
+
+// storePlan keeps p until it expires, dropping the oldest plans beyond
+// maxPlans.
+func storePlan(p *plan) {
+	planMu.Lock()
+	defer planMu.Unlock()
+	now := time.Now().UTC()
+	for id, old := range plans {
+		if now.After(old.ExpiresAt) {
+			delete(plans, id)
+		}
+	}
+	if len(plans) >= maxPlans {
+		var ids []string
+		for id := range plans {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return plans[ids[i]].CreatedAt.Before(plans[ids[j]].CreatedAt) })
+		for _, id := range ids[:len(plans)-maxPlans+1] {
+			delete(plans, id)
+		}
+	}
+	p.ID = newID()
+	p.CreatedAt = now
+	p.ExpiresAt = now.Add(planTTL)
+	plans[p.ID] = p
+}
+
+func lookupPlan(id string) *plan {
+	planMu.Lock()
+	defer planMu.Unlock()
+	p := plans[id]
+	if p == nil || time.Now().After(p.ExpiresAt) {
+		return nil
+	}
+	return p
+}
+
+func dropPlan(id string) {
+	planMu.Lock()
+	defer planMu.Unlock()
+	delete(plans, id)
+}
+
+func abortOnStaleBase(c *gin.Context, p *plan, current string) {
+	c.JSON(http.StatusConflict, gin.H{
+		"error":        "Live state changed since the plan was created",
+		"details":      "create a new plan against the current configuration",
+		"base_hash":    p.BaseHash,
+		"current_hash": current,
+	})
+}
+
+func registerPlanRoutes(rg *gin.RouterGroup) {
+	// POST /plans with a JSON or YAML ruleset document describing the
+	// complete desired state.
+	rg.POST("/plans", func(c *gin.Context) {
+		doc, ok := bindRuleset(c)
+		if !ok {
+			return
+		}
+		live, err := readLiveState()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw configuration", "details": err.Error()})
+			return
+		}
+		p, err := buildPlan(live, doc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ruleset document", "details": err.Error()})
+			return
+		}
+		p.BaseHash = live.hash()
+		storePlan(p)
+		c.JSON(http.StatusOK, p)
+	})
+
+	rg.GET("/plans/:id", func(c *gin.Context) {
+		p := lookupPlan(c.Param("id"))
+		if p == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found or expired"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	rg.POST("/plans/:id/apply", func(c *gin.Context) {
+		p := lookupPlan(c.Param("id"))
+		if p == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found or expired"})
+			return
+		}
+		timeout, err := confirmTimeout(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+		// Checked before the snapshot is taken, so a stale plan is refused
+		// without touching the firewall. The handler holds mutationMu,
+		// which every change, the backend's own included, takes, so none
+		// can land between the check and the steps.
+		live, err := readLiveState()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw configuration", "details": err.Error()})
+			return
+		}
+		if h := live.hash(); h != p.BaseHash {
+			abortOnStaleBase(c, p, h)
+			return
+		}
+
+		force := forceRequested(c)
+		change, err := applyWithSnapshot("apply plan "+p.ID, timeout, func() error {
+			if err := p.execute(); err != nil {
+				return err
+			}
+			if force {
+				return nil
+			}
+			return checkActiveLockout()
+		})
+		if abortOnApplyError(c, err, "Failed to apply plan; previous state restored") {
+			return
+		}
+		dropPlan(p.ID)
+		resp := gin.H{"message": "Plan applied successfully", "id": p.ID, "applied": len(p.Steps)}
+		if change != nil {
+			resp["pending"] = change.view()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.DELETE("/plans/:id", func(c *gin.Context) {
+		if lookupPlan(c.Param("id")) == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found or expired"})
+			return
+		}
+		dropPlan(c.Param("id"))
+		c.JSON(http.StatusOK, gin.H{"message": "Plan discarded", "id": c.Param("id")})
+	})
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The port-scan detector follows the ufw log and counts, per source
+// address, the distinct destination ports it was blocked on within a
+// sliding window. A source reaching the threshold is reported as a scan
+// and, if ban is set, banned through banIP for ban_time. Only TCP
+// connection attempts are counted, leaving out replies to connections made
+// elsewhere. Blocked packets never complete a handshake, so their source
+// address proves nothing: see Ban.
+
+const (
+	portScanFile             = "portscan.json"
+	defaultPortScanThreshold = 10
+	defaultPortScanWindow    = time.Minute
+	maxPortScanTracked       = 10000
+	maxRecentDetections      = 200
+)
+
+type portScanConfig struct {
+	Enabled   bool   `json:"enabled"`
+	LogPath   string `json:"log_path,omitempty"`
+	Journal   bool   `json:"journal,omitempty"`
+	Threshold int    `json:"threshold"`
+	Window    string `json:"window"`
+	// Ban bans detected sources. Anyone who can send packets with a
+	// forged source address can then get that address banned by sending
+	// SYNs to enough ports. exempt and BAN_IGNORE_IPS protect the
+	// addresses that must never be banned.
+	Ban       bool      `json:"ban"`
+	BanTime   string    `json:"ban_time"`
+	Exempt    []string  `json:"exempt"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+type portScanDetection struct {
+	IP     string    `json:"ip"`
+	Ports  []int     `json:"ports"`
+	At     time.Time `json:"at"`
+	Banned bool      `json:"banned"`
+}
+
+type portScanner struct {
+	cfg        portScanConfig
+	window     time.Duration
+	banTime    time.Duration
+	exempt     []*net.IPNet
+	autoExempt []string
+	hosts      map[string]map[int]time.Time
+	// nextPrune is when the oldest tracked source expires.
+	nextPrune  time.Time
+	blocks     uint64
+	detections []*portScanDetection
+	stop       chan struct{}
+	follower   *logFollower
+}
+
+var (
+	portScanMu sync.Mutex
+	portScan   = &portScanner{}
+)
+
+// normalize fills in defaults and checks the settings.
+func (cfg *portScanConfig) normalize() error {
+	if cfg.Journal {
+		cfg.LogPath = ""
+	} else if cfg.LogPath == "" {
+		cfg.LogPath = ufwLogPath()
+	} else if !filepath.IsAbs(cfg.LogPath) {
+		return fmt.Errorf("log_path must be an absolute path")
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = defaultPortScanThreshold
+	}
+	if cfg.Threshold < 2 {
+		return fmt.Errorf("threshold must be at least 2")
+	}
+	if cfg.Window == "" {
+		cfg.Window = defaultPortScanWindow.String()
+	}
+	if cfg.BanTime == "" {
+		cfg.BanTime = defaultBanTime.String()
+	}
+	if cfg.Exempt == nil {
+		cfg.Exempt = []string{}
+	}
+	return nil
+}
+
+// prepare derives the runtime state of the detector from cfg.
+func (p *portScanner) prepare(cfg portScanConfig) error {
+	if err := cfg.normalize(); err != nil {
+		return err
+	}
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid window %q", cfg.Window)
+	}
+	banTime, err := time.ParseDuration(cfg.BanTime)
+	if err != nil || banTime < 0 {
+		return fmt.Errorf("invalid ban_time %q: use a duration, or 0 to ban for good", cfg.BanTime)
+	}
+	var exempt []*net.IPNet
+	for _, item := range cfg.Exempt {
+		if err := validateIPorCIDR(item); err != nil {
+			return fmt.Errorf("exempt: %w", err)
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("exempt: %w", err)
+		}
+		exempt = append(exempt, n)
+	}
+	auto := portScanAutoExempt()
+	for _, item := range auto {
+		if n, err := parseTrafficNet(item); err == nil {
+			exempt = append(exempt, n)
+		}
+	}
+	p.cfg, p.window, p.banTime, p.exempt, p.autoExempt = cfg, window, banTime, exempt, auto
+	p.hosts = map[string]map[int]time.Time{}
+	return nil
+}
+
+// portScanAutoExempt returns the sources never counted whatever the
+// settings: the API_ALLOWED_SOURCES, the TRUSTED_PROXIES the API is reached
+// through and the default gateways.
+func portScanAutoExempt() []string {
+	items := []string{}
+	sources, _ := apiAllowedSources()
+	items = append(items, sources...)
+	items = append(items, trustedProxies()...)
+	for _, gw := range defaultGateways() {
+		items = append(items, gw.String())
+	}
+	return items
+}
+
+// defaultGateways returns the gateways of the default routes from
+// /proc/net/route and /proc/net/ipv6_route, or none where those do not
+// exist.
+func defaultGateways() []net.IP {
+	var out []net.IP
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 4 || f[1] != "00000000" {
+				continue
+			}
+			flags, err := strconv.ParseUint(f[3], 16, 16)
+			gw, gerr := hex.DecodeString(f[2])
+			if err != nil || gerr != nil || flags&0x2 == 0 || len(gw) != 4 {
+				continue
+			}
+			// The kernel writes the address in host byte order.
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, binary.NativeEndian.Uint32(gw))
+			out = append(out, ip)
+		}
+	}
+	if data, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 10 || f[0] != strings.Repeat("0", 32) || f[1] != "00" {
+				continue
+			}
+			gw, err := hex.DecodeString(f[4])
+			if err != nil || len(gw) != 16 || net.IP(gw).IsUnspecified() {
+				continue
+			}
+			out = append(out, net.IP(gw))
+		}
+	}
+	return out
+}
+
+func (p *portScanner) source() string {
+	if p.cfg.Journal {
+		return "journal"
+	}
+	return p.cfg.LogPath
+}
+
+// startLocked starts following the log if the detector is enabled.
+func (p *portScanner) startLocked() {
+	if !p.cfg.Enabled {
+		return
+	}
+	p.stop = make(chan struct{})
+	if p.cfg.Journal {
+		p.follower = followKernelJournal(p.stop, func(msg string) {
+			p.handleEvent(parseUFWKernelMessage(msg, time.Now()))
+		})
+	} else {
+		p.follower = followFile(p.cfg.LogPath, p.stop, func(line string) {
+			p.handleEvent(parseUFWLogLine(line, time.Now()))
+		})
+	}
+}
+
+func (p *portScanner) stopLocked() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (p *portScanner) exemptIP(ip net.IP) bool {
+	for _, n := range p.exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *portScanner) handleEvent(ev ufwLogEvent, ok bool) {
+	now := time.Now()
+	if !ok || ev.Action != "BLOCK" || ev.DstPort == 0 || !ev.isSYN() {
+		return
+	}
+	ip := net.ParseIP(ev.Src)
+	if ip == nil {
+		return
+	}
+	src := ip.String()
+	portScanMu.Lock()
+	defer portScanMu.Unlock()
+	if portScan != p {
+		return
+	}
+	p.blocks++
+	if p.exemptIP(ip) {
+		return
+	}
+	if _, tracked := p.hosts[src]; !tracked && len(p.hosts) >= maxPortScanTracked {
+		if !now.Before(p.nextPrune) {
+			p.pruneLocked(now)
+		}
+		if len(p.hosts) >= maxPortScanTracked {
+			// New sources are ignored until tracked ones expire.
+			return
+		}
+	}
+	ports := p.hosts[src]
+	if ports == nil {
+		ports = map[int]time.Time{}
+		p.hosts[src] = ports
+	}
+	for port, t := range ports {
+		if now.Sub(t) >= p.window {
+			delete(ports, port)
+		}
+	}
+	ports[ev.DstPort] = now
+	if len(ports) < p.cfg.Threshold {
+		return
+	}
+	delete(p.hosts, src)
+
+	d := &portScanDetection{IP: src, At: now.UTC()}
+	for port := range ports {
+		d.Ports = append(d.Ports, port)
+	}
+	sort.Ints(d.Ports)
+	log.Printf("Port scan from %s: %d ports within %s", src, len(d.Ports), p.cfg.Window)
+	if p.cfg.Ban {
+		reason := fmt.Sprintf("AUTO BLOCK: port scan, %d ports/%s", len(d.Ports), p.cfg.Window)
+		d.Banned = banIP(src, "portscan", reason, p.banTime)
+	}
+	p.detections = append(p.detections, d)
+	if len(p.detections) > maxRecentDetections {
+		p.detections = p.detections[len(p.detections)-maxRecentDetections:]
+	}
+}
+
+// pruneLocked forgets sources not seen within the window.
+func (p *portScanner) pruneLocked(now time.Time) {
+	p.nextPrune = time.Time{}
+	for src, ports := range p.hosts {
+		var last time.Time
+		for _, t := range ports {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if now.Sub(last) >= p.window {
+			delete(p.hosts, src)
+		} else if expires := last.Add(p.window); p.nextPrune.IsZero() || expires.Before(p.nextPrune) {
+			p.nextPrune = expires
+		}
+	}
+}
+
+func (p *portScanner) view() gin.H {
+	var lines uint64
+	errMsg := ""
+	if p.follower != nil && p.stop != nil {
+		lines, errMsg = p.follower.status()
+	}
+	detections := make([]portScanDetection, 0, len(p.detections))
+	for i := len(p.detections) - 1; i >= 0; i-- {
+		detections = append(detections, *p.detections[i])
+	}
+	return gin.H{
+		"config":      p.cfg,
+		"auto_exempt": p.autoExempt,
+		"source":      p.source(),
+		"running":     p.stop != nil,
+		"lines_read":  lines,
+		"blocks":      p.blocks,
+		"tracked":     len(p.hosts),
+		"detections":  detections,
+		"error":       errMsg,
+	}
+}
+
+// startPortScan loads the saved settings and starts the detector if it is
+// enabled.
+func startPortScan() {
+	portScanMu.Lock()
+	defer portScanMu.Unlock()
+	var cfg portScanConfig
+	if _, err := readJSONFile(dataPath(portScanFile), &cfg); err != nil {
+		log.Printf("WARN: portscan: ignoring unreadable %s: %v", portScanFile, err)
+	}
+	if err := portScan.prepare(cfg); err != nil {
+		log.Printf("WARN: portscan disabled: %v", err)
+		cfg = portScanConfig{}
+		_ = portScan.prepare(cfg)
+		return
+	}
+	portScan.startLocked()
+}
+
+func registerPortScanRoutes(rg *gin.RouterGroup) {
+	// GET /portscan returns the settings of the detector, its counters and
+	// the most recent detections, newest first.
+	rg.GET("/portscan", func(c *gin.Context) {
+		portScanMu.Lock()
+		defer portScanMu.Unlock()
+		c.JSON(http.StatusOK, portScan.view())
+	})
+
+	// PUT /portscan replaces the settings and restarts the detector.
+	// Sources being tracked are forgotten; past detections are kept.
+	rg.PUT("/portscan", func(c *gin.Context) {
+		var cfg portScanConfig
+		if err := c.ShouldBindJSON(&cfg); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		cfg.UpdatedBy = c.GetString(ctxKeyName)
+		cfg.UpdatedAt = time.Now().UTC()
+		p := &portScanner{}
+		if err := p.prepare(cfg); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid port-scan settings", "details": err.Error()})
+			return
+		}
+
+		portScanMu.Lock()
+		defer portScanMu.Unlock()
+		if err := writeJSONFile(dataPath(portScanFile), p.cfg); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save port-scan settings", "details": err.Error()})
+			return
+		}
+		portScan.stopLocked()
+		p.detections = portScan.detections
+		portScan = p
+		p.startLocked()
+		c.JSON(http.StatusOK, gin.H{"message": "Port-scan settings updated successfully", "portscan": p.view()})
+	})
+}
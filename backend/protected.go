@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// protectedPort is a port the operator must not lose access to: the API's own
+// port and sshd's ports. Covered reports whether incoming traffic from
+// anywhere currently reaches it.
+type protectedPort struct {
+	Port    int    `json:"port"`
+	Proto   string `json:"proto"`
+	Source  string `json:"source"`
+	Covered bool   `json:"covered"`
+}
+
+func apiPort() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return port
+	}
+	return "30737"
+}
+
+func sshdConfigPath() string {
+	if p := os.Getenv("SSHD_CONFIG_PATH"); p != "" {
+		return p
+	}
+	return "/etc/ssh/sshd_config"
+}
+
+// sshPorts reads the Port directives from sshd_config and the drop-ins in
+// sshd_config.d, falling back to 22.
+func sshPorts() []int {
+	main := sshdConfigPath()
+	files := []string{main}
+	if dropIns, err := filepath.Glob(filepath.Join(filepath.Dir(main), "sshd_config.d", "*.conf")); err == nil {
+		files = append(files, dropIns...)
+	}
+
+	var ports []int
+	for _, f := range files {
+		fh, err := os.Open(f)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(fh)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) >= 2 && strings.EqualFold(fields[0], "Port") {
+				if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 && n <= 65535 {
+					ports = append(ports, n)
+				}
+			}
+		}
+		fh.Close()
+	}
+	if len(ports) == 0 {
+		ports = []int{22}
+	}
+	return ports
+}
+
+// protectedPorts lists the API port, the SSH ports and any extra entries from
+// UFW_PROTECTED_PORTS (e.g. "443/tcp,8443").
+func protectedPorts() []protectedPort {
+	var out []protectedPort
+	seen := map[string]bool{}
+	add := func(port int, proto, source string) {
+		key := fmt.Sprintf("%d/%s", port, proto)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		out = append(out, protectedPort{Port: port, Proto: proto, Source: source})
+	}
+
+	if n, err := strconv.Atoi(apiPort()); err == nil {
+		add(n, "tcp", "api")
+	}
+	for _, n := range sshPorts() {
+		add(n, "tcp", "ssh")
+	}
+	for _, item := range strings.Split(os.Getenv("UFW_PROTECTED_PORTS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		portStr, proto, _ := strings.Cut(item, "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		if n, err := strconv.Atoi(portStr); err == nil && n > 0 && n <= 65535 {
+			add(n, strings.ToLower(proto), "config")
+		}
+	}
+	return out
+}
+
+var rePortSpec = regexp.MustCompile(`^[\d,:]+(/[a-z]+)?$`)
+
+// ruleMatchesPort reports whether an incoming rule applies to all traffic
+// to port/proto. Rules limited to some sources apply only to those and never
+// count, whatever their action; application profiles are not resolved and
+// never count either.
+func ruleMatchesPort(r statusRule, port int, proto string) bool {
+	if r.Direction != "" && r.Direction != "IN" {
+		return false
+	}
+	if r.From != "" && !strings.HasPrefix(r.From, "Anywhere") {
+		return false
+	}
+
+	to := r.To
+	if i := strings.Index(to, " on "); i != -1 {
+		to = to[:i]
+	}
+	fields := strings.Fields(to)
+	if len(fields) == 0 {
+		return false
+	}
+
+	for _, f := range fields {
+		if !rePortSpec.MatchString(f) {
+			continue
+		}
+		spec, ruleProto, _ := strings.Cut(f, "/")
+		if ruleProto != "" && ruleProto != proto {
+			return false
+		}
+		return portSpecIncludes(spec, port)
+	}
+
+	// No port column: the rule covers every port if the destination is an
+	// address ("Anywhere", an IP or a CIDR), but not if it names an app.
+	return fields[0] == "Anywhere" || validateIPorCIDR(fields[0]) == nil
+}
+
+// portCovered reports whether incoming traffic from anywhere reaches
+// port/proto. As in ufw, the first rule that applies decides for its IP
+// version, and the default incoming policy for traffic no rule applies to.
+// The port counts as covered if either IP version lets traffic through.
+func portCovered(rules []statusRule, port int, proto, defaultIncoming string) bool {
+	for _, v6 := range []bool{false, true} {
+		covered := defaultIncoming == "allow"
+		for _, r := range rules {
+			if r.V6 != v6 || !ruleMatchesPort(r, port, proto) {
+				continue
+			}
+			covered = r.Action == "ALLOW" || r.Action == "LIMIT"
+			break
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultIncomingPolicy reads the default incoming policy from
+// /etc/default/ufw. If the file cannot be read, traffic is assumed to be
+// denied, so no port counts as covered by the policy alone.
+func defaultIncomingPolicy() string {
+	data, err := readUFWFile(ufwDefaults)
+	if err != nil {
+		return "deny"
+	}
+	if p := iptablesPolicyName(parseShellVars(string(data))["DEFAULT_INPUT_POLICY"]); p != "" {
+		return p
+	}
+	return "deny"
+}
+
+func portSpecIncludes(spec string, port int) bool {
+	for _, part := range strings.Split(spec, ",") {
+		lo, hi, isRange := strings.Cut(part, ":")
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			continue
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil {
+				continue
+			}
+		}
+		if port >= a && port <= b {
+			return true
+		}
+	}
+	return false
+}
+
+// addedRules returns the configured user rules via `ufw show added`, which
+// works whether or not the firewall is active, in statusRule form.
+func addedRules() ([]statusRule, error) {
+	res, err := runUFW("show", "added")
+	if err != nil {
+		return nil, err
+	}
+	var rules []statusRule
+	for _, ln := range strings.Split(res.Stdout, "\n") {
+		if r, ok := parseAddedRule(strings.TrimSpace(ln)); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// parseAddedRule converts one `ufw show added` command line, in simple
+// ("ufw allow 22/tcp") or extended ("ufw allow from X to any port 22 proto
+// tcp") syntax, to the column layout used by `ufw status`.
+func parseAddedRule(line string) (statusRule, bool) {
+	tokens := strings.Fields(line)
+	if len(tokens) < 3 || tokens[0] != "ufw" {
+		return statusRule{}, false
+	}
+	tokens = tokens[1:]
+
+	r := statusRule{Direction: "IN", From: "Anywhere"}
+	if tokens[0] == "route" {
+		r.Direction = "FWD"
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return statusRule{}, false
+	}
+	switch tokens[0] {
+	case "allow", "deny", "reject", "limit":
+		r.Action = strings.ToUpper(tokens[0])
+	default:
+		return statusRule{}, false
+	}
+	tokens = tokens[1:]
+
+	if i := indexOf(tokens, "comment"); i != -1 {
+		r.Comment = strings.Trim(strings.Join(tokens[i+1:], " "), "'")
+		tokens = tokens[:i]
+	}
+
+	if indexOf(tokens, "from") == -1 && indexOf(tokens, "to") == -1 {
+		// Simple syntax: [in|out] [on IFACE] PORT[/PROTO] or APP.
+		for len(tokens) > 0 && (tokens[0] == "in" || tokens[0] == "out" || tokens[0] == "on" || tokens[0] == "log" || tokens[0] == "log-all") {
+			switch tokens[0] {
+			case "out":
+				r.Direction = "OUT"
+			case "on":
+				tokens = tokens[1:]
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return statusRule{}, false
+		}
+		r.To = strings.Join(tokens, " ")
+		return r, true
+	}
+
+	var to, port, proto string
+	to = "Anywhere"
+	for i := 0; i < len(tokens); i++ {
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "out":
+			if r.Direction != "FWD" {
+				r.Direction = "OUT"
+			}
+		case "from":
+			if next != "any" {
+				r.From = next
+			}
+			i++
+		case "to":
+			if next != "any" {
+				to = next
+			}
+			i++
+		case "port":
+			// A port before "to" is the source port; only the
+			// destination port matters for coverage.
+			if indexOf(tokens[i:], "to") == -1 {
+				port = next
+			}
+			i++
+		case "proto":
+			proto = next
+			i++
+		case "on", "app":
+			i++
+		}
+	}
+
+	if port != "" {
+		if proto != "" {
+			port += "/" + proto
+		}
+		if to == "Anywhere" {
+			r.To = port
+		} else {
+			r.To = to + " " + port
+		}
+	} else {
+		r.To = to
+	}
+	return r, true
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// protectedPortStatus fills in Covered for every protected port, given the
+// rules in order and the default incoming policy.
+func protectedPortStatus(rules []statusRule, defaultIncoming string) []protectedPort {
+	ports := protectedPorts()
+	for i := range ports {
+		ports[i].Covered = portCovered(rules, ports[i].Port, ports[i].Proto, defaultIncoming)
+	}
+	return ports
+}
+
+func uncoveredPorts(ports []protectedPort) []protectedPort {
+	var out []protectedPort
+	for _, p := range ports {
+		if !p.Covered {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// LockoutError is returned when an operation would cut off access to a
+// protected port and the caller did not pass force.
+type LockoutError struct {
+	Reason string
+	Ports  []protectedPort
+}
+
+func (e *LockoutError) Error() string {
+	return e.Reason
+}
+
+// checkDeleteLockout refuses deleting rule number n if that leaves a
+// protected port it reaches without access from anywhere.
+func checkDeleteLockout(n int) error {
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	rules := parseStatusRules(status.Rules)
+
+	found := false
+	var rest []statusRule
+	for _, r := range rules {
+		if r.Number == n {
+			found = true
+			continue
+		}
+		rest = append(rest, r)
+	}
+	if !found {
+		return nil
+	}
+
+	policy := defaultIncomingPolicy()
+	before := protectedPortStatus(rules, policy)
+	var lost []protectedPort
+	for i, p := range protectedPortStatus(rest, policy) {
+		if before[i].Covered && !p.Covered {
+			lost = append(lost, p)
+		}
+	}
+	if len(lost) > 0 {
+		return &LockoutError{Reason: fmt.Sprintf("rule %d is the only rule allowing a protected port", n), Ports: lost}
+	}
+	return nil
+}
+
+// checkEnableLockout refuses enabling the firewall while the rules and the
+// default incoming policy leave a protected port unreachable.
+func checkEnableLockout() error {
+	rules, err := addedRules()
+	if err != nil {
+		return err
+	}
+	if lost := uncoveredPorts(protectedPortStatus(rules, defaultIncomingPolicy())); len(lost) > 0 {
+		return &LockoutError{Reason: "enabling the firewall would block protected ports", Ports: lost}
+	}
+	return nil
+}
+
+// checkActiveLockout fails if the firewall is running and a protected port
+// is unreachable. It is used after multi-step changes.
+func checkActiveLockout() error {
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	if status.Status != "active" {
+		return nil
+	}
+	return checkEnableLockout()
+}
+
+// checkDefaultLockout refuses a deny/reject incoming default policy while a
+// protected port has no rule letting traffic from anywhere through.
+func checkDefaultLockout(policy, direction string) error {
+	if direction != "incoming" || policy == "allow" {
+		return nil
+	}
+	rules, err := addedRules()
+	if err != nil {
+		return err
+	}
+	if lost := uncoveredPorts(protectedPortStatus(rules, policy)); len(lost) > 0 {
+		return &LockoutError{Reason: fmt.Sprintf("default %s incoming would block protected ports", policy), Ports: lost}
+	}
+	return nil
+}
+
+// statusProtectedPorts reports coverage for /status. While the firewall is
+// inactive `ufw status` lists no rules, so the configured rules are used.
+func statusProtectedPorts(status *UFWStatus) ([]protectedPort, error) {
+	policy := defaultIncomingPolicy()
+	if status.Status == "active" {
+		return protectedPortStatus(parseStatusRules(status.Rules), policy), nil
+	}
+	rules, err := addedRules()
+	if err != nil {
+		return nil, err
+	}
+	return protectedPortStatus(rules, policy), nil
+}
+
+func forceRequested(c *gin.Context) bool {
+	force, _ := strconv.ParseBool(c.Query("force"))
+	return force
+}
+
+// abortOnLockout writes the response for a failed lockout check and reports
+// whether the handler should stop.
+func abortOnLockout(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     "Operation would lock out protected ports",
+			"details":   lockout.Reason + "; retry with force=true to proceed anyway",
+			"protected": lockout.Ports,
+		})
+		return true
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check protected ports", "details": err.Error()})
+	return true
+}
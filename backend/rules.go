@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// statusRule is one line of `ufw status numbered`, split into its columns.
+type statusRule struct {
+	Number    int    `json:"number"`
+	To        string `json:"to"`
+	Action    string `json:"action"`
+	Direction string `json:"direction"`
+	From      string `json:"from"`
+	Comment   string `json:"comment,omitempty"`
+	V6        bool   `json:"v6"`
+}
+
+var (
+	reNumberedRule = regexp.MustCompile(`^\s*\[\s*(\d+)\s*\]\s+(.+)$`)
+	reColumnSep    = regexp.MustCompile(`\s{2,}`)
+)
+
+func parseStatusRule(line string) (statusRule, bool) {
+	m := reNumberedRule.FindStringSubmatch(line)
+	if m == nil {
+		return statusRule{}, false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return statusRule{}, false
+	}
+
+	body := m[2]
+	var comment string
+	if i := strings.Index(body, " # "); i != -1 {
+		comment = strings.TrimSpace(body[i+3:])
+		body = body[:i]
+	}
+
+	cols := reColumnSep.Split(strings.TrimSpace(body), -1)
+	if len(cols) < 3 {
+		return statusRule{}, false
+	}
+
+	r := statusRule{Number: n, To: cols[0], From: cols[2], Comment: comment}
+	actionParts := strings.Fields(cols[1])
+	r.Action = actionParts[0]
+	if len(actionParts) > 1 {
+		r.Direction = actionParts[1]
+	}
+	for _, suffix := range []string{" (log-all)", " (log)"} {
+		r.From = strings.TrimSuffix(r.From, suffix)
+	}
+	if strings.HasSuffix(r.To, " (v6)") || strings.HasSuffix(r.From, " (v6)") {
+		r.V6 = true
+		r.To = strings.TrimSuffix(r.To, " (v6)")
+		r.From = strings.TrimSuffix(r.From, " (v6)")
+	}
+	return r, true
+}
+
+func parseStatusRules(lines []string) []statusRule {
+	var rules []statusRule
+	for _, ln := range lines {
+		if r, ok := parseStatusRule(ln); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// canonicalAddr normalizes an IP or CIDR so that equal networks compare equal.
+func canonicalAddr(s string) string {
+	s = strings.TrimSpace(s)
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		if ones, bits := n.Mask.Size(); ones == bits {
+			return n.IP.String()
+		}
+		return n.String()
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
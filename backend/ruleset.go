@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ruleset is the exportable form of the ufw configuration: default policies,
+// logging level and the user rules in order.
+type ruleset struct {
+	Version  int              `json:"version" yaml:"version"`
+	Defaults *rulesetDefaults `json:"defaults,omitempty" yaml:"defaults,omitempty"`
+	Logging  string           `json:"logging,omitempty" yaml:"logging,omitempty"`
+	Rules    []rulesetRule    `json:"rules" yaml:"rules"`
+}
+
+type rulesetDefaults struct {
+	Incoming string `json:"incoming,omitempty" yaml:"incoming,omitempty"`
+	Outgoing string `json:"outgoing,omitempty" yaml:"outgoing,omitempty"`
+	Routed   string `json:"routed,omitempty" yaml:"routed,omitempty"`
+}
+
+// rulesetRule is one user rule. From/To are "any", an IP or a CIDR; a rule
+// limited to one IP version uses 0.0.0.0/0 or ::/0 instead of "any".
+type rulesetRule struct {
+	Action       string `json:"action" yaml:"action"`
+	Route        bool   `json:"route,omitempty" yaml:"route,omitempty"`
+	Direction    string `json:"direction,omitempty" yaml:"direction,omitempty"`
+	Interface    string `json:"interface,omitempty" yaml:"interface,omitempty"`
+	OutInterface string `json:"out_interface,omitempty" yaml:"out_interface,omitempty"`
+	Log          string `json:"log,omitempty" yaml:"log,omitempty"`
+	Proto        string `json:"proto,omitempty" yaml:"proto,omitempty"`
+	From         string `json:"from" yaml:"from"`
+	FromPort     string `json:"from_port,omitempty" yaml:"from_port,omitempty"`
+	FromApp      string `json:"from_app,omitempty" yaml:"from_app,omitempty"`
+	To           string `json:"to" yaml:"to"`
+	Port         string `json:"port,omitempty" yaml:"port,omitempty"`
+	App          string `json:"app,omitempty" yaml:"app,omitempty"`
+	Comment      string `json:"comment,omitempty" yaml:"comment,omitempty"`
+}
+
+const (
+	ufwUserRules  = "/etc/ufw/user.rules"
+	ufwUser6Rules = "/etc/ufw/user6.rules"
+	ufwDefaults   = "/etc/default/ufw"
+	ufwConf       = "/etc/ufw/ufw.conf"
+)
+
+var (
+	reTupleLine  = regexp.MustCompile(`^### tuple ###\s+(.*)$`)
+	reInterface  = regexp.MustCompile(`^[A-Za-z0-9_.\-+]{1,15}$`)
+	reAppName    = regexp.MustCompile(`^[A-Za-z0-9_.\-+ ]{1,64}$`)
+	rulesetProto = map[string]bool{"any": true, "tcp": true, "udp": true, "ah": true, "esp": true, "gre": true, "ipv6": true, "igmp": true}
+
+	ufwLogLevels = map[string]bool{"off": true, "on": true, "low": true, "medium": true, "high": true, "full": true}
+)
+
+// parseTupleLine parses a "### tuple ###" comment from user.rules:
+//
+//	ACTION PROTO DPORT DST SPORT SRC [DAPP SAPP] DIRECTION [comment=HEX]
+//
+// ACTION may carry a "route:" prefix and a "_log"/"_log-all" suffix, and
+// DIRECTION is "in", "out", "in_IFACE" or, for routes, "in_IF!out_IF".
+func parseTupleLine(line string) (rulesetRule, bool) {
+	m := reTupleLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return rulesetRule{}, false
+	}
+	f := strings.Fields(m[1])
+
+	var r rulesetRule
+	if len(f) > 0 && strings.HasPrefix(f[len(f)-1], "comment=") {
+		if b, err := hex.DecodeString(strings.TrimPrefix(f[len(f)-1], "comment=")); err == nil {
+			r.Comment = string(b)
+		}
+		f = f[:len(f)-1]
+	}
+	if len(f) != 7 && len(f) != 9 {
+		return rulesetRule{}, false
+	}
+
+	action := f[0]
+	if rest, ok := strings.CutPrefix(action, "route:"); ok {
+		r.Route = true
+		action = rest
+	}
+	if a, log, ok := strings.Cut(action, "_"); ok {
+		action, r.Log = a, log
+	}
+	r.Action = action
+	r.Proto = f[1]
+	r.Port, r.To, r.FromPort, r.From = f[2], f[3], f[4], f[5]
+	if len(f) == 9 {
+		if f[6] != "-" {
+			r.App = strings.ReplaceAll(f[6], "%20", " ")
+		}
+		if f[7] != "-" {
+			r.FromApp = strings.ReplaceAll(f[7], "%20", " ")
+		}
+	}
+
+	for _, part := range strings.Split(f[len(f)-1], "!") {
+		dir, iface, _ := strings.Cut(part, "_")
+		if r.Route && dir == "out" {
+			r.OutInterface = iface
+		} else {
+			r.Direction, r.Interface = dir, iface
+		}
+	}
+	if r.App != "" {
+		r.Port = ""
+	}
+	if r.FromApp != "" {
+		r.FromPort = ""
+	}
+	r.normalize()
+	return r, true
+}
+
+// normalize brings a rule into the canonical form used for comparison and
+// export.
+func (r *rulesetRule) normalize() {
+	r.Action = strings.ToLower(strings.TrimSpace(r.Action))
+	r.Direction = strings.ToLower(strings.TrimSpace(r.Direction))
+	if r.Route {
+		// Route rules are described by their interfaces alone.
+		r.Direction = ""
+	} else if r.Direction == "" {
+		r.Direction = "in"
+	}
+	r.Proto = strings.ToLower(strings.TrimSpace(r.Proto))
+	if r.Proto == "" {
+		r.Proto = "any"
+	}
+	for _, p := range []*string{&r.Port, &r.FromPort} {
+		if *p == "any" {
+			*p = ""
+		}
+	}
+	for _, a := range []*string{&r.From, &r.To} {
+		*a = strings.TrimSpace(*a)
+		if *a == "" || strings.EqualFold(*a, "any") {
+			*a = "any"
+		} else {
+			*a = canonicalAddr(*a)
+		}
+	}
+}
+
+// args returns the ufw command line (without "ufw") that creates the rule.
+func (r *rulesetRule) args() []string {
+	var args []string
+	if r.Route {
+		args = append(args, "route")
+	}
+	args = append(args, r.Action)
+	if r.Route {
+		if r.Interface != "" {
+			args = append(args, "in", "on", r.Interface)
+		}
+		if r.OutInterface != "" {
+			args = append(args, "out", "on", r.OutInterface)
+		}
+	} else {
+		args = append(args, r.Direction)
+		if r.Interface != "" {
+			args = append(args, "on", r.Interface)
+		}
+	}
+	if r.Log != "" {
+		args = append(args, r.Log)
+	}
+	if r.Proto != "any" && r.App == "" && r.FromApp == "" {
+		args = append(args, "proto", r.Proto)
+	}
+	args = append(args, "from", r.From)
+	if r.FromApp != "" {
+		args = append(args, "app", r.FromApp)
+	} else if r.FromPort != "" {
+		args = append(args, "port", r.FromPort)
+	}
+	args = append(args, "to", r.To)
+	if r.App != "" {
+		args = append(args, "app", r.App)
+	} else if r.Port != "" {
+		args = append(args, "port", r.Port)
+	}
+	if r.Comment != "" {
+		args = append(args, "comment", r.Comment)
+	}
+	return args
+}
+
+// key identifies a rule independently of its comment.
+func (r *rulesetRule) key() string {
+	c := *r
+	c.Comment = ""
+	return strings.Join(c.args(), " ")
+}
+
+func (r *rulesetRule) validate() error {
+	switch r.Action {
+	case "allow", "deny", "reject", "limit":
+	default:
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	if r.Route {
+		if r.Action == "limit" {
+			return fmt.Errorf("limit is not supported for route rules")
+		}
+	} else if r.Direction != "in" && r.Direction != "out" {
+		return fmt.Errorf("invalid direction %q", r.Direction)
+	}
+	for _, iface := range []string{r.Interface, r.OutInterface} {
+		if iface != "" && !reInterface.MatchString(iface) {
+			return fmt.Errorf("invalid interface %q", iface)
+		}
+	}
+	if r.OutInterface != "" && !r.Route {
+		return fmt.Errorf("out_interface is only valid for route rules")
+	}
+	if r.Log != "" && r.Log != "log" && r.Log != "log-all" {
+		return fmt.Errorf("invalid log %q", r.Log)
+	}
+	if !rulesetProto[r.Proto] {
+		return fmt.Errorf("invalid proto %q", r.Proto)
+	}
+	for _, a := range []string{r.From, r.To} {
+		if a != "any" {
+			if err := validateIPorCIDR(a); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range []string{r.Port, r.FromPort} {
+		if p == "" {
+			continue
+		}
+		if err := validatePortSpec(p); err != nil {
+			return err
+		}
+		if strings.ContainsAny(p, ",:") && r.Proto != "tcp" && r.Proto != "udp" {
+			return fmt.Errorf("port lists and ranges require proto tcp or udp")
+		}
+	}
+	for _, app := range []string{r.App, r.FromApp} {
+		if app != "" && !reAppName.MatchString(app) {
+			return fmt.Errorf("invalid app name %q", app)
+		}
+	}
+	if (r.App != "" && r.Port != "") || (r.FromApp != "" && r.FromPort != "") {
+		return fmt.Errorf("port and app are mutually exclusive")
+	}
+	if (r.App != "" || r.FromApp != "") && r.Proto != "any" {
+		return fmt.Errorf("proto cannot be combined with app")
+	}
+	return validateComment(r.Comment)
+}
+
+// validatePortSpec accepts ufw port lists such as "80,443,8000:8080".
+func validatePortSpec(spec string) error {
+	parts := strings.Split(spec, ",")
+	if len(parts) > 15 {
+		return fmt.Errorf("too many ports in %q", spec)
+	}
+	for _, p := range parts {
+		if err := validatePort(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *rulesetDefaults) validate() error {
+	for _, p := range []string{d.Incoming, d.Outgoing, d.Routed} {
+		if p != "" && !ufwDefaultPolicies[p] {
+			return fmt.Errorf("invalid default policy %q", p)
+		}
+	}
+	return nil
+}
+
+func (rs *ruleset) validate() []string {
+	var errs []string
+	if rs.Version != 1 {
+		errs = append(errs, fmt.Sprintf("unsupported version %d", rs.Version))
+	}
+	if rs.Defaults != nil {
+		if err := rs.Defaults.validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if rs.Logging != "" && !ufwLogLevels[rs.Logging] {
+		errs = append(errs, fmt.Sprintf("invalid logging level %q", rs.Logging))
+	}
+	for i := range rs.Rules {
+		rs.Rules[i].normalize()
+		if err := rs.Rules[i].validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("rule %d: %v", i, err))
+		}
+	}
+	return errs
+}
+
+// readUserRules parses the tuples of user.rules and user6.rules. ufw stores
+// "any" as 0.0.0.0/0 or ::/0; it is exported as "any" when the other address
+// already fixes the IP version or the rule exists for both versions. Rules
+// for any address present in only one file keep the explicit wildcard.
+func readUserRules() ([]rulesetRule, error) {
+	v4, v6, err := readUserRuleFamilies()
+	if err != nil {
+		return nil, err
+	}
+	return mergeRuleFamilies(v4, v6), nil
+}
+
+// readUserRuleFamilies returns the rules of user.rules and user6.rules in
+// file order, with wildcards simplified.
+func readUserRuleFamilies() (v4, v6 []rulesetRule, err error) {
+	v4data, err := readUFWFile(ufwUserRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	v6data, err := readUFWFile(ufwUser6Rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	v4 = simplifyWildcards(parseTuples(string(v4data)), "0.0.0.0/0")
+	v6 = simplifyWildcards(parseTuples(string(v6data)), "::/0")
+	return v4, v6, nil
+}
+
+// mergeRuleFamilies lists the IPv4 rules followed by the IPv6-only ones; a
+// rule for any address present in both files is listed once with "any".
+func mergeRuleFamilies(v4, v6 []rulesetRule) []rulesetRule {
+	bothAny := func(r rulesetRule, wildcard string) (string, bool) {
+		if r.From != wildcard || r.To != wildcard {
+			return "", false
+		}
+		r.From, r.To = "any", "any"
+		return r.key(), true
+	}
+
+	v6Any := map[string]bool{}
+	for _, r := range v6 {
+		if k, ok := bothAny(r, "::/0"); ok {
+			v6Any[k] = true
+		}
+	}
+
+	var out []rulesetRule
+	merged := map[string]bool{}
+	for _, r := range v4 {
+		if k, ok := bothAny(r, "0.0.0.0/0"); ok && v6Any[k] {
+			merged[k] = true
+			r.From, r.To = "any", "any"
+		}
+		out = append(out, r)
+	}
+	for _, r := range v6 {
+		if k, ok := bothAny(r, "::/0"); ok && merged[k] {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// simplifyWildcards replaces a wildcard address with "any" when the other
+// address of the rule is specific.
+func simplifyWildcards(rules []rulesetRule, wildcard string) []rulesetRule {
+	for i := range rules {
+		r := &rules[i]
+		switch {
+		case r.From == wildcard && r.To != wildcard:
+			r.From = "any"
+		case r.To == wildcard && r.From != wildcard:
+			r.To = "any"
+		}
+	}
+	return rules
+}
+
+func parseTuples(data string) []rulesetRule {
+	var rules []rulesetRule
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		if r, ok := parseTupleLine(sc.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseShellVars reads KEY=value lines as found in /etc/default/ufw.
+func parseShellVars(data string) map[string]string {
+	vars := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		vars[strings.TrimSpace(k)] = strings.Trim(v, `'`)
+	}
+	return vars
+}
+
+func iptablesPolicyName(v string) string {
+	switch strings.ToUpper(v) {
+	case "ACCEPT":
+		return "allow"
+	case "REJECT":
+		return "reject"
+	case "DROP":
+		return "deny"
+	}
+	return ""
+}
+
+// readRuleset builds the ruleset from the configuration files, which works
+// whether or not the firewall is active.
+func readRuleset() (*ruleset, error) {
+	rules, err := readUserRules()
+	if err != nil {
+		return nil, err
+	}
+	rs := &ruleset{Version: 1, Rules: rules}
+	if rs.Rules == nil {
+		rs.Rules = []rulesetRule{}
+	}
+
+	defaults, err := readUFWFile(ufwDefaults)
+	if err != nil {
+		return nil, err
+	}
+	vars := parseShellVars(string(defaults))
+	d := &rulesetDefaults{
+		Incoming: iptablesPolicyName(vars["DEFAULT_INPUT_POLICY"]),
+		Outgoing: iptablesPolicyName(vars["DEFAULT_OUTPUT_POLICY"]),
+		Routed:   iptablesPolicyName(vars["DEFAULT_FORWARD_POLICY"]),
+	}
+	if *d != (rulesetDefaults{}) {
+		rs.Defaults = d
+	}
+
+	conf, err := readUFWFile(ufwConf)
+	if err != nil {
+		return nil, err
+	}
+	rs.Logging = strings.ToLower(parseShellVars(string(conf))["LOGLEVEL"])
+	return rs, nil
+}
+
+var reShellSafe = regexp.MustCompile(`^[A-Za-z0-9_.:/,@%+=\-]+$`)
+
+func shellQuote(s string) string {
+	if reShellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// script renders the ruleset as ufw commands. Defaults and logging come
+// after the rules so running it over SSH does not cut the session.
+func (rs *ruleset) script() string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	sb.WriteString("# ufw ruleset exported by ufw-panel-backend.\n")
+	sb.WriteString("# Run on a host without user rules (for example after `ufw reset`).\n")
+	sb.WriteString("set -e\n\n")
+	for i := range rs.Rules {
+		args := rs.Rules[i].args()
+		quoted := make([]string, len(args))
+		for j, a := range args {
+			quoted[j] = shellQuote(a)
+		}
+		sb.WriteString("ufw " + strings.Join(quoted, " ") + "\n")
+	}
+	if d := rs.Defaults; d != nil {
+		sb.WriteString("\n")
+		for _, p := range [][2]string{{d.Incoming, "incoming"}, {d.Outgoing, "outgoing"}, {d.Routed, "routed"}} {
+			if p[0] != "" {
+				fmt.Fprintf(&sb, "ufw default %s %s\n", p[0], p[1])
+			}
+		}
+	}
+	if rs.Logging != "" {
+		fmt.Fprintf(&sb, "ufw logging %s\n", rs.Logging)
+	}
+	return sb.String()
+}
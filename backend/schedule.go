@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A schedule keeps one rule in place during recurring weekly windows, such
+// as business hours or a nightly backup. The scheduler adds the rule when a
+// window opens and deletes it when the last overlapping window closes.
+
+const (
+	schedulesFile        = "schedules.json"
+	maxScheduleWindows   = 32
+	scheduleLookahead    = 8 * 24 * time.Hour
+	scheduleRecheck      = time.Hour
+	scheduleRetryDelay   = time.Minute
+	maxTransitionsWindow = 31 * 24 * time.Hour
+)
+
+var errRuleNotScheduled = errors.New("rule already exists outside a schedule")
+
+var (
+	reScheduleName = regexp.MustCompile(`^[A-Za-z0-9_.:\- ]{1,64}$`)
+	reClock        = regexp.MustCompile(`^([01]\d|2[0-3]):([0-5]\d)$`)
+
+	weekdayNames = map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+		"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	}
+)
+
+// scheduleWindow opens at Start on each of Days (every day if empty) and
+// closes at End. An End at or before Start closes on the following day.
+type scheduleWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+type schedule struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Rule      string           `json:"rule"`
+	Args      []string         `json:"args"`
+	Windows   []scheduleWindow `json:"windows"`
+	TimeZone  string           `json:"timezone"`
+	CreatedBy string           `json:"created_by,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	// Applied records whether the scheduler last added (true) or deleted
+	// the rule.
+	Applied   bool   `json:"applied"`
+	LastError string `json:"last_error,omitempty"`
+
+	loc *time.Location
+}
+
+type scheduleTransition struct {
+	ScheduleID string    `json:"schedule_id"`
+	Name       string    `json:"name"`
+	At         time.Time `json:"at"`
+	Action     string    `json:"action"`
+}
+
+var (
+	scheduleMu    sync.Mutex
+	schedules     []*schedule
+	scheduleTimer *time.Timer
+)
+
+func parseClock(s string) (int, bool) {
+	m := reClock.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	mins, _ := strconv.Atoi(m[2])
+	return h*60 + mins, true
+}
+
+func (w *scheduleWindow) validate() error {
+	start, ok := parseClock(w.Start)
+	if !ok {
+		return fmt.Errorf("invalid start %q: expected HH:MM", w.Start)
+	}
+	end, ok := parseClock(w.End)
+	if !ok {
+		return fmt.Errorf("invalid end %q: expected HH:MM", w.End)
+	}
+	if start == end {
+		return fmt.Errorf("start and end must differ")
+	}
+	for i, d := range w.Days {
+		d = strings.ToLower(d)
+		if _, ok := weekdayNames[d]; !ok {
+			return fmt.Errorf("invalid day %q: use mon, tue, wed, thu, fri, sat or sun", w.Days[i])
+		}
+		w.Days[i] = d
+	}
+	return nil
+}
+
+func (w *scheduleWindow) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if weekdayNames[name] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// span returns when the window opens and closes if it opens on the given
+// local day. time.Date normalizes clock times skipped by DST changes.
+func (w *scheduleWindow) span(day time.Time, loc *time.Location) (time.Time, time.Time) {
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	y, m, d := day.Date()
+	from := time.Date(y, m, d, start/60, start%60, 0, 0, loc)
+	if end <= start {
+		d++
+	}
+	to := time.Date(y, m, d, end/60, end%60, 0, 0, loc)
+	return from, to
+}
+
+// eachSpan calls fn for every window opening on the local days from the day
+// before t up to the end of the lookahead.
+func (s *schedule) eachSpan(t time.Time, fn func(from, to time.Time)) {
+	lt := t.In(s.loc)
+	y, m, d := lt.Date()
+	for i := -1; i <= int(scheduleLookahead/(24*time.Hour)); i++ {
+		day := time.Date(y, m, d+i, 12, 0, 0, 0, s.loc)
+		for j := range s.Windows {
+			w := &s.Windows[j]
+			if w.onDay(day.Weekday()) {
+				from, to := w.span(day, s.loc)
+				fn(from, to)
+			}
+		}
+	}
+}
+
+// activeAt reports whether any window is open at t.
+func (s *schedule) activeAt(t time.Time) bool {
+	active := false
+	s.eachSpan(t, func(from, to time.Time) {
+		if !t.Before(from) && t.Before(to) {
+			active = true
+		}
+	})
+	return active
+}
+
+// transitions lists when the rule is added or deleted after t and up to
+// until, merging overlapping windows.
+func (s *schedule) transitions(t, until time.Time) []scheduleTransition {
+	var edges []time.Time
+	for base := t; base.Before(until); base = base.Add(scheduleLookahead - 24*time.Hour) {
+		s.eachSpan(base, func(from, to time.Time) {
+			edges = append(edges, from, to)
+		})
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].Before(edges[j]) })
+
+	var out []scheduleTransition
+	state := s.activeAt(t)
+	var last time.Time
+	for _, e := range edges {
+		if !e.After(t) || e.After(until) || e.Equal(last) {
+			continue
+		}
+		last = e
+		if now := s.activeAt(e); now != state {
+			state = now
+			action := "remove"
+			if now {
+				action = "add"
+			}
+			out = append(out, scheduleTransition{ScheduleID: s.ID, Name: s.Name, At: e.UTC(), Action: action})
+		}
+	}
+	return out
+}
+
+func (s *schedule) view(now time.Time) gin.H {
+	next := s.transitions(now, now.Add(scheduleLookahead))
+	var nt *scheduleTransition
+	if len(next) > 0 {
+		nt = &next[0]
+	}
+	return gin.H{
+		"id":              s.ID,
+		"name":            s.Name,
+		"rule":            s.Rule,
+		"windows":         s.Windows,
+		"timezone":        s.TimeZone,
+		"created_by":      s.CreatedBy,
+		"created_at":      s.CreatedAt,
+		"active":          s.activeAt(now),
+		"applied":         s.Applied,
+		"last_error":      s.LastError,
+		"next_transition": nt,
+	}
+}
+
+func saveSchedulesLocked() {
+	if err := writeJSONFile(dataPath(schedulesFile), schedules); err != nil {
+		log.Printf("WARN: schedules: failed to save %s: %v", schedulesFile, err)
+	}
+}
+
+// reconcileSchedules must be called with mutationMu held. It adds or deletes
+// each rule whose window state differs from what was last applied; with
+// all set it repeats the command for every schedule, as on startup, where
+// the firewall may have changed while the backend was stopped. A rule that is
+// the last one allowing a protected port is kept, and its removal retried.
+func reconcileSchedules(all bool) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+
+	now := time.Now()
+	changed := false
+	for _, s := range schedules {
+		want := s.activeAt(now)
+		if want == s.Applied && !all {
+			continue
+		}
+		var err error
+		if want {
+			_, err = addUFWRule(s.Args)
+		} else if err = checkRuleDeleteLockout(s.Rule); err == nil {
+			err = deleteRuleByArgs(s.Args)
+		}
+		if err != nil {
+			log.Printf("WARN: schedule %s (%s): failed to update rule: %v", s.ID, s.Name, err)
+			s.LastError = err.Error()
+		} else {
+			switch {
+			case want && !s.Applied:
+				log.Printf("Schedule %s (%s): window opened, rule added", s.ID, s.Name)
+			case !want && s.Applied:
+				log.Printf("Schedule %s (%s): window closed, rule removed", s.ID, s.Name)
+			}
+			s.Applied, s.LastError = want, ""
+		}
+		changed = true
+	}
+	if changed {
+		saveSchedulesLocked()
+	}
+	armScheduleTimerLocked(now)
+}
+
+// armScheduleTimerLocked wakes the scheduler at the next window edge, or
+// after an hour at the latest so clock changes are picked up.
+func armScheduleTimerLocked(now time.Time) {
+	if scheduleTimer != nil {
+		scheduleTimer.Stop()
+		scheduleTimer = nil
+	}
+	if len(schedules) == 0 {
+		return
+	}
+	next := now.Add(scheduleRecheck)
+	for _, s := range schedules {
+		if s.LastError != "" && now.Add(scheduleRetryDelay).Before(next) {
+			next = now.Add(scheduleRetryDelay)
+		}
+		if t := s.transitions(now, next); len(t) > 0 {
+			next = t[0].At
+		}
+	}
+	scheduleTimer = time.AfterFunc(time.Until(next), func() { applySchedules(false) })
+}
+
+// applySchedules reconciles the schedules as a system action; while a change
+// awaits confirmation it runs once the change is settled.
+func applySchedules(all bool) {
+	action := "apply schedules"
+	if all {
+		action = "reconcile schedules"
+	}
+	err := auditSystem(action, func() error {
+		reconcileSchedules(all)
+		return nil
+	})
+	if errors.Is(err, errChangePending) {
+		afterPendingChange(func() { applySchedules(all) })
+	}
+}
+
+// startSchedules loads the saved schedules and brings every rule in line
+// with its windows.
+func startSchedules() {
+	scheduleMu.Lock()
+	if _, err := readJSONFile(dataPath(schedulesFile), &schedules); err != nil {
+		log.Printf("WARN: schedules: ignoring unreadable %s: %v", schedulesFile, err)
+		schedules = nil
+	}
+	kept := schedules[:0]
+	for _, s := range schedules {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			log.Printf("WARN: schedule %s (%s) disabled: %v", s.ID, s.Name, err)
+			continue
+		}
+		s.loc = loc
+		kept = append(kept, s)
+	}
+	schedules = kept
+	scheduleMu.Unlock()
+
+	applySchedules(true)
+}
+
+func findScheduleLocked(id string) (int, *schedule) {
+	for i, s := range schedules {
+		if s.ID == id {
+			return i, s
+		}
+	}
+	return -1, nil
+}
+
+func registerScheduleRoutes(rg *gin.RouterGroup) {
+	type CreateScheduleRequest struct {
+		Name         string           `json:"name" binding:"required"`
+		Op           string           `json:"op" binding:"required"`
+		Rule         string           `json:"rule"`
+		IPAddress    string           `json:"ip_address"`
+		PortProtocol string           `json:"port_protocol"`
+		Comment      string           `json:"comment"`
+		Windows      []scheduleWindow `json:"windows" binding:"required"`
+		TimeZone     string           `json:"timezone"`
+	}
+	// POST /schedules creates a schedule and applies it right away. op is
+	// allow, deny, allow_ip or deny_ip, with the fields of the matching
+	// batch operation; timezone defaults to the server's local zone.
+	rg.POST("/schedules", func(c *gin.Context) {
+		var req CreateScheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reScheduleName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule name", "details": "1-64 letters, digits, spaces or _.:-"})
+			return
+		}
+		if len(req.Windows) == 0 || len(req.Windows) > maxScheduleWindows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule", "details": fmt.Sprintf("between 1 and %d windows are required", maxScheduleWindows)})
+			return
+		}
+		for i := range req.Windows {
+			if err := req.Windows[i].validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule", "details": fmt.Sprintf("window %d: %v", i, err)})
+				return
+			}
+		}
+		if req.TimeZone == "" {
+			req.TimeZone = "Local"
+		}
+		loc, err := time.LoadLocation(req.TimeZone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone", "details": err.Error()})
+			return
+		}
+		args, err := ruleOpArgs(req.Op, req.Rule, req.IPAddress, req.PortProtocol, req.Comment)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule", "details": err.Error()})
+			return
+		}
+
+		s := &schedule{
+			ID:        newID(),
+			Name:      req.Name,
+			Rule:      "ufw " + strings.Join(args, " "),
+			Args:      args,
+			Windows:   req.Windows,
+			TimeZone:  req.TimeZone,
+			CreatedBy: c.GetString(ctxKeyName),
+			CreatedAt: time.Now().UTC(),
+			loc:       loc,
+		}
+		// The rule is deleted whenever a window closes, so it must not
+		// exist already: a schedule never removes a rule it did not add.
+		added, err := addedRules()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read rules", "details": err.Error()})
+			return
+		}
+		if len(ruleNumbers(s.Rule, added)) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Rule already exists", "details": errRuleNotScheduled.Error()})
+			return
+		}
+
+		scheduleMu.Lock()
+		for _, other := range schedules {
+			if sameArgs(ruleArgsWithoutComment(other.Args), ruleArgsWithoutComment(args)) {
+				scheduleMu.Unlock()
+				c.JSON(http.StatusConflict, gin.H{"error": "Rule already has a schedule", "details": "schedule " + other.ID})
+				return
+			}
+		}
+		schedules = append(schedules, s)
+		saveSchedulesLocked()
+		scheduleMu.Unlock()
+
+		reconcileSchedules(false)
+
+		scheduleMu.Lock()
+		defer scheduleMu.Unlock()
+		c.JSON(http.StatusOK, s.view(time.Now()))
+	})
+
+	rg.GET("/schedules", func(c *gin.Context) {
+		scheduleMu.Lock()
+		defer scheduleMu.Unlock()
+		now := time.Now()
+		out := make([]gin.H, 0, len(schedules))
+		for _, s := range schedules {
+			out = append(out, s.view(now))
+		}
+		c.JSON(http.StatusOK, gin.H{"schedules": out})
+	})
+
+	// GET /schedules/transitions?within=24h lists the upcoming rule changes
+	// of all schedules in order; within is at most 31 days.
+	rg.GET("/schedules/transitions", func(c *gin.Context) {
+		within := 24 * time.Hour
+		if v := c.Query("within"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxTransitionsWindow {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid within", "details": "a duration up to 744h is required"})
+				return
+			}
+			within = d
+		}
+		scheduleMu.Lock()
+		now := time.Now()
+		out := []scheduleTransition{}
+		for _, s := range schedules {
+			out = append(out, s.transitions(now, now.Add(within))...)
+		}
+		scheduleMu.Unlock()
+		sort.SliceStable(out, func(i, j int) bool { return out[i].At.Before(out[j].At) })
+		c.JSON(http.StatusOK, gin.H{"transitions": out})
+	})
+
+	rg.GET("/schedules/:id", func(c *gin.Context) {
+		scheduleMu.Lock()
+		defer scheduleMu.Unlock()
+		_, s := findScheduleLocked(c.Param("id"))
+		if s == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+			return
+		}
+		now := time.Now()
+		resp := s.view(now)
+		resp["transitions"] = s.transitions(now, now.Add(7*24*time.Hour))
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// DELETE /schedules/:id deletes the schedule and, if it is in place,
+	// its rule, unless that uncovers a protected port and force is not set.
+	rg.DELETE("/schedules/:id", func(c *gin.Context) {
+		scheduleMu.Lock()
+		defer scheduleMu.Unlock()
+		i, s := findScheduleLocked(c.Param("id"))
+		if s == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+			return
+		}
+		if s.Applied {
+			if !forceRequested(c) && abortOnLockout(c, checkRuleDeleteLockout(s.Rule)) {
+				return
+			}
+			if err := deleteRuleByArgs(s.Args); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove scheduled rule", "details": err.Error()})
+				return
+			}
+		}
+		schedules = append(schedules[:i], schedules[i+1:]...)
+		saveSchedulesLocked()
+		armScheduleTimerLocked(time.Now())
+		c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully", "id": s.ID})
+	})
+}
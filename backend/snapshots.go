@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const snapshotsDirName = "snapshots"
+
+var (
+	reSnapshotName = regexp.MustCompile(`^[A-Za-z0-9_.:\- ]{1,64}$`)
+	reSnapshotID   = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+type snapshot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	State     *ufwState `json:"state"`
+}
+
+type snapshotFileInfo struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+}
+
+func (s *snapshot) view() gin.H {
+	var files []snapshotFileInfo
+	for _, p := range s.paths() {
+		files = append(files, snapshotFileInfo{Path: p, Size: len(s.State.Files[p])})
+	}
+	return gin.H{
+		"id":         s.ID,
+		"name":       s.Name,
+		"created_at": s.CreatedAt,
+		"active":     s.State.Active,
+		"files":      files,
+	}
+}
+
+// paths lists the files that existed when the snapshot was taken, sorted.
+func (s *snapshot) paths() []string {
+	var out []string
+	for p, data := range s.State.Files {
+		if data != nil {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func snapshotsDir() string {
+	return dataPath(snapshotsDirName)
+}
+
+func snapshotPath(id string) string {
+	return filepath.Join(snapshotsDir(), id+".json")
+}
+
+func createSnapshot(name string) (*snapshot, error) {
+	if !reSnapshotName.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	st, err := captureUFWState()
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{ID: newID(), Name: name, CreatedAt: time.Now().UTC(), State: st}
+	if err := writeJSONFile(snapshotPath(s.ID), s); err != nil {
+		return nil, fmt.Errorf("save snapshot: %w", err)
+	}
+	return s, nil
+}
+
+func loadSnapshot(id string) (*snapshot, error) {
+	if !reSnapshotID.MatchString(id) {
+		return nil, fs.ErrNotExist
+	}
+	var s snapshot
+	found, err := readJSONFile(snapshotPath(id), &s)
+	if err != nil {
+		return nil, err
+	}
+	if !found || s.State == nil {
+		return nil, fs.ErrNotExist
+	}
+	return &s, nil
+}
+
+func listSnapshots() ([]*snapshot, error) {
+	entries, err := os.ReadDir(snapshotsDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []*snapshot
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		s, err := loadSnapshot(id)
+		if err != nil {
+			log.Printf("WARN: skipping unreadable snapshot %s: %v", e.Name(), err)
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// restoreSnapshot writes the snapshot's files back and reloads ufw if it is
+// running. Files created since the snapshot are left alone.
+func restoreSnapshot(s *snapshot, force bool) error {
+	if err := writeUFWFiles(s.State); err != nil {
+		return err
+	}
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	if status.Status != "active" {
+		return nil
+	}
+	if _, err := runUFW("reload"); err != nil {
+		return err
+	}
+	if force {
+		return nil
+	}
+	return checkActiveLockout()
+}
+
+// writeSnapshotTarball writes the snapshot's files, with paths relative to /,
+// and a snapshot.json describing it as a gzipped tar stream.
+func writeSnapshotTarball(w http.ResponseWriter, s *snapshot) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	meta, err := json.MarshalIndent(gin.H{"id": s.ID, "name": s.Name, "created_at": s.CreatedAt, "active": s.State.Active}, "", "  ")
+	if err != nil {
+		return err
+	}
+	add := func(name string, data []byte, mode int64) error {
+		hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: s.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add("snapshot.json", meta, 0o644); err != nil {
+		return err
+	}
+	for _, p := range s.paths() {
+		if err := add(strings.TrimPrefix(p, "/"), s.State.Files[p], 0o640); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type snapshotFileDiff struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+func diffUFWStates(from, to *ufwState, fromName, toName string) []snapshotFileDiff {
+	seen := map[string]bool{}
+	var paths []string
+	for _, st := range []*ufwState{from, to} {
+		for p := range st.Files {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	var out []snapshotFileDiff
+	for _, p := range paths {
+		a, b := from.Files[p], to.Files[p]
+		if string(a) == string(b) && (a == nil) == (b == nil) {
+			continue
+		}
+		d := snapshotFileDiff{Path: p, Status: "modified"}
+		switch {
+		case a == nil:
+			d.Status = "added"
+		case b == nil:
+			d.Status = "removed"
+		}
+		d.Diff = unifiedDiff(fromName+p, toName+p, string(a), string(b))
+		out = append(out, d)
+	}
+	return out
+}
+
+func respondSnapshotError(c *gin.Context, err error, msg string) {
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Snapshot not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": msg, "details": err.Error()})
+}
+
+func registerSnapshotRoutes(rg *gin.RouterGroup) {
+	type CreateSnapshotRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+	rg.POST("/snapshots", func(c *gin.Context) {
+		var req CreateSnapshotRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "details": err.Error()})
+			return
+		}
+		if !reSnapshotName.MatchString(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot name", "details": "1-64 letters, digits, spaces or _.:-"})
+			return
+		}
+		s, err := createSnapshot(req.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create snapshot", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, s.view())
+	})
+
+	rg.GET("/snapshots", func(c *gin.Context) {
+		list, err := listSnapshots()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list snapshots", "details": err.Error()})
+			return
+		}
+		out := make([]gin.H, 0, len(list))
+		for _, s := range list {
+			out = append(out, s.view())
+		}
+		c.JSON(http.StatusOK, gin.H{"snapshots": out})
+	})
+
+	rg.GET("/snapshots/:id", func(c *gin.Context) {
+		s, err := loadSnapshot(c.Param("id"))
+		if err != nil {
+			respondSnapshotError(c, err, "Failed to read snapshot")
+			return
+		}
+		c.JSON(http.StatusOK, s.view())
+	})
+
+	rg.GET("/snapshots/:id/download", func(c *gin.Context) {
+		s, err := loadSnapshot(c.Param("id"))
+		if err != nil {
+			respondSnapshotError(c, err, "Failed to read snapshot")
+			return
+		}
+		filename := fmt.Sprintf("ufw-snapshot-%s-%s.tar.gz", s.CreatedAt.Format("20060102-150405"), s.ID)
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+		if err := writeSnapshotTarball(c.Writer, s); err != nil {
+			log.Printf("WARN: failed to stream snapshot %s: %v", s.ID, err)
+		}
+	})
+
+	// GET /snapshots/:id/diff?to=<id> compares two snapshots; without "to"
+	// the snapshot is compared with the current configuration.
+	rg.GET("/snapshots/:id/diff", func(c *gin.Context) {
+		from, err := loadSnapshot(c.Param("id"))
+		if err != nil {
+			respondSnapshotError(c, err, "Failed to read snapshot")
+			return
+		}
+		var to *ufwState
+		toName := "current"
+		if id := c.Query("to"); id != "" && id != "current" {
+			s, err := loadSnapshot(id)
+			if err != nil {
+				respondSnapshotError(c, err, "Failed to read snapshot")
+				return
+			}
+			to, toName = s.State, s.ID
+		} else if to, err = captureUFWState(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read current ufw configuration", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"from":  from.ID,
+			"to":    toName,
+			"files": diffUFWStates(from.State, to, from.ID, toName),
+		})
+	})
+
+	rg.POST("/snapshots/:id/restore", func(c *gin.Context) {
+		s, err := loadSnapshot(c.Param("id"))
+		if err != nil {
+			respondSnapshotError(c, err, "Failed to read snapshot")
+			return
+		}
+		timeout, err := confirmTimeout(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+
+		// Keep the configuration being replaced, so a restore can itself be
+		// undone.
+		backup, err := createSnapshot("before restore of " + s.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snapshot current configuration", "details": err.Error()})
+			return
+		}
+
+		force := forceRequested(c)
+		change, err := applyWithSnapshot("restore snapshot "+s.ID, timeout, func() error {
+			return restoreSnapshot(s, force)
+		})
+		if abortOnApplyError(c, err, "Failed to restore snapshot") {
+			return
+		}
+		resp := gin.H{"message": "Snapshot restored successfully", "id": s.ID, "backup_id": backup.ID}
+		if change != nil {
+			resp["pending"] = change.view()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	rg.DELETE("/snapshots/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := loadSnapshot(id); err != nil {
+			respondSnapshotError(c, err, "Failed to read snapshot")
+			return
+		}
+		if err := os.Remove(snapshotPath(id)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete snapshot", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Snapshot deleted successfully", "id": id})
+	})
+}
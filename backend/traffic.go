@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Traffic analytics read the ufw log, including its rotations, and report
+// the packets ufw blocked, allowed or audited: the matching events, or
+// totals per action, the top source addresses and destination ports and
+// counts per time bucket.
+
+const (
+	defaultTrafficTop    = 10
+	maxTrafficTop        = 100
+	defaultTrafficBucket = time.Hour
+	maxTrafficBuckets    = 1000
+)
+
+// trafficFilter selects events by the query parameters of the traffic
+// endpoints.
+type trafficFilter struct {
+	actions map[string]bool
+	src     *net.IPNet
+	dst     *net.IPNet
+	port    int
+	proto   string
+	iface   string
+	since   time.Time
+	until   time.Time
+}
+
+// parseTrafficTime reads an RFC 3339 time, or a duration meaning that long
+// ago.
+func parseTrafficTime(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseTrafficNet(v string) (*net.IPNet, error) {
+	if err := validateIPorCIDR(v); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(v, "/") {
+		if strings.Contains(v, ":") {
+			v += "/128"
+		} else {
+			v += "/32"
+		}
+	}
+	_, n, err := net.ParseCIDR(v)
+	return n, err
+}
+
+// parseTrafficFilter reads action (comma-separated BLOCK, ALLOW, AUDIT,
+// ...), src and dst (IP or CIDR), port, proto, in (either interface) and
+// since/until.
+func parseTrafficFilter(c *gin.Context) (*trafficFilter, error) {
+	f := &trafficFilter{proto: strings.ToLower(c.Query("proto")), iface: c.Query("in")}
+	if v := c.Query("action"); v != "" {
+		f.actions = map[string]bool{}
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.ToUpper(strings.TrimSpace(a)); a != "" {
+				f.actions[a] = true
+			}
+		}
+	}
+	var err error
+	if v := c.Query("src"); v != "" {
+		if f.src, err = parseTrafficNet(v); err != nil {
+			return nil, fmt.Errorf("src: %w", err)
+		}
+	}
+	if v := c.Query("dst"); v != "" {
+		if f.dst, err = parseTrafficNet(v); err != nil {
+			return nil, fmt.Errorf("dst: %w", err)
+		}
+	}
+	if v := c.Query("port"); v != "" {
+		if f.port, err = strconv.Atoi(v); err != nil || f.port < 1 || f.port > 65535 {
+			return nil, fmt.Errorf("port must be between 1 and 65535")
+		}
+	}
+	now := time.Now()
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if v := c.Query(p.name); v != "" {
+			if *p.t, err = parseTrafficTime(v, now); err != nil {
+				return nil, fmt.Errorf("%s: expected an RFC 3339 time or a duration", p.name)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *trafficFilter) match(ev ufwLogEvent) bool {
+	switch {
+	case f.actions != nil && !f.actions[ev.Action],
+		!f.since.IsZero() && ev.Time.Before(f.since),
+		!f.until.IsZero() && ev.Time.After(f.until),
+		f.port != 0 && ev.DstPort != f.port,
+		f.proto != "" && ev.Proto != f.proto,
+		f.iface != "" && ev.In != f.iface && ev.Out != f.iface:
+		return false
+	}
+	if f.src != nil && !f.src.Contains(net.ParseIP(ev.Src)) {
+		return false
+	}
+	if f.dst != nil && !f.dst.Contains(net.ParseIP(ev.Dst)) {
+		return false
+	}
+	return true
+}
+
+type trafficCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// topCounts returns the n largest counts, ties broken by key.
+func topCounts(counts map[string]int, n int) []trafficCount {
+	out := make([]trafficCount, 0, len(counts))
+	for k, v := range counts {
+		out = append(out, trafficCount{k, v})
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Count != out[b].Count {
+			return out[a].Count > out[b].Count
+		}
+		return out[a].Key < out[b].Key
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func registerTrafficRoutes(rg *gin.RouterGroup) {
+	// GET /traffic/events?action=&src=&dst=&port=&proto=&in=&since=&until=&limit=
+	// returns matching events from the ufw log, newest first.
+	rg.GET("/traffic/events", func(c *gin.Context) {
+		f, err := parseTrafficFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter", "details": err.Error()})
+			return
+		}
+		limit := 100
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit", "details": "limit must be between 1 and 1000"})
+				return
+			}
+			limit = n
+		}
+
+		var matched []ufwLogEvent
+		files, lines, err := scanUFWLogs(ufwLogFiles(ufwLogPath()), f.since, func(ev ufwLogEvent) {
+			if !f.match(ev) {
+				return
+			}
+			matched = append(matched, ev)
+			if len(matched) > limit {
+				matched = matched[1:]
+			}
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw log", "details": err.Error()})
+			return
+		}
+		events := make([]ufwLogEvent, 0, len(matched))
+		for i := len(matched) - 1; i >= 0; i-- {
+			events = append(events, matched[i])
+		}
+		c.JSON(http.StatusOK, gin.H{"files": files, "lines": lines, "events": events})
+	})
+
+	// GET /traffic/stats takes the filters of /traffic/events plus top (the
+	// number of sources and ports listed) and bucket (a duration) and
+	// returns the totals of the matching events.
+	rg.GET("/traffic/stats", func(c *gin.Context) {
+		f, err := parseTrafficFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter", "details": err.Error()})
+			return
+		}
+		top := defaultTrafficTop
+		if v := c.Query("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxTrafficTop {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid top", "details": fmt.Sprintf("top must be between 1 and %d", maxTrafficTop)})
+				return
+			}
+			top = n
+		}
+		bucket := defaultTrafficBucket
+		if v := c.Query("bucket"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Minute {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket", "details": "bucket must be a duration of at least 1m"})
+				return
+			}
+			bucket = d
+		}
+		if !f.since.IsZero() {
+			until := f.until
+			if until.IsZero() {
+				until = time.Now()
+			}
+			if until.Sub(f.since)/bucket > maxTrafficBuckets {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket", "details": fmt.Sprintf("more than %d buckets; use a larger bucket or a shorter range", maxTrafficBuckets)})
+				return
+			}
+		}
+
+		total := 0
+		actions := map[string]int{}
+		sources := map[string]int{}
+		ports := map[string]int{}
+		buckets := map[int64]int{}
+		var first, last time.Time
+		files, lines, err := scanUFWLogs(ufwLogFiles(ufwLogPath()), f.since, func(ev ufwLogEvent) {
+			if !f.match(ev) {
+				return
+			}
+			total++
+			actions[ev.Action]++
+			sources[ev.Src]++
+			if ev.DstPort != 0 {
+				ports[fmt.Sprintf("%d/%s", ev.DstPort, ev.Proto)]++
+			}
+			buckets[ev.Time.Truncate(bucket).Unix()]++
+			if first.IsZero() || ev.Time.Before(first) {
+				first = ev.Time
+			}
+			if ev.Time.After(last) {
+				last = ev.Time
+			}
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read ufw log", "details": err.Error()})
+			return
+		}
+
+		series := []gin.H{}
+		if total > 0 {
+			start, end := first.Truncate(bucket), last.Truncate(bucket)
+			if end.Sub(start)/bucket >= maxTrafficBuckets {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket", "details": fmt.Sprintf("more than %d buckets; use a larger bucket or a shorter range", maxTrafficBuckets)})
+				return
+			}
+			for t := start; !t.After(end); t = t.Add(bucket) {
+				series = append(series, gin.H{"start": t.UTC(), "count": buckets[t.Unix()]})
+			}
+		}
+		topSources := []gin.H{}
+		for _, tc := range topCounts(sources, top) {
+			topSources = append(topSources, gin.H{"ip": tc.Key, "count": tc.Count})
+		}
+		topPorts := []gin.H{}
+		for _, tc := range topCounts(ports, top) {
+			port, proto, _ := strings.Cut(tc.Key, "/")
+			n, _ := strconv.Atoi(port)
+			topPorts = append(topPorts, gin.H{"port": n, "proto": proto, "count": tc.Count})
+		}
+		resp := gin.H{
+			"files":       files,
+			"lines":       lines,
+			"total":       total,
+			"actions":     actions,
+			"top_sources": topSources,
+			"top_ports":   topPorts,
+			"bucket":      bucket.String(),
+			"buckets":     series,
+		}
+		if total > 0 {
+			resp["first"], resp["last"] = first.UTC(), last.UTC()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+}
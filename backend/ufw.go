@@ -12,11 +12,15 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type UFWStatus struct {
-	Status string   `json:"status"`
-	Rules  []string `json:"rules"`
+	Status    string               `json:"status"`
+	Rules     []string             `json:"rules"`
+	Protected []protectedPort      `json:"protected,omitempty"`
+	Drift     *driftSummary        `json:"drift,omitempty"`
+	Expiring  []expiringRuleStatus `json:"expiring,omitempty"`
 }
 
 var (
@@ -48,11 +52,44 @@ type cmdResult struct {
 	ExitCode int
 }
 
-func runUFW(args ...string) (*cmdResult, error) {
+func runUFW(args ...string) (res *cmdResult, err error) {
+	if ufwArgsMutate(args) {
+		beginSelfChange()
+		defer endSelfChange()
+		defer func() { recordAuditCommand(append([]string{"ufw"}, args...), res, err) }()
+	}
+	if helperSocketPath() != "" {
+		return callHelperUFW(args)
+	}
+	return execUFW(args...)
+}
+
+// ufwArgsMutate reports whether a ufw command may change the configuration.
+func ufwArgsMutate(args []string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			continue
+		}
+		switch a {
+		case "status", "show", "version", "app":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func execUFW(args ...string) (*cmdResult, error) {
 	path, err := ufwPath()
 	if err != nil {
 		return nil, fmt.Errorf("ufw not found: %w", err)
 	}
+	return execCommand("ufw", path, args, nil)
+}
+
+// execCommand runs a firewall tool, through sudo if UFW_SUDO is set, with
+// stdin as its input.
+func execCommand(name, path string, args []string, stdin []byte) (*cmdResult, error) {
 	finalArgs := args
 	if shouldUseSudo() {
 		finalArgs = append([]string{path}, args...)
@@ -62,10 +99,13 @@ func runUFW(args ...string) (*cmdResult, error) {
 	defer cancel()
 	cmd := exec.CommandContext(ctx, path, finalArgs...)
 	cmd.Env = append(os.Environ(), "LANG=C")
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
 	var out, er bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &er
-	err = cmd.Run()
+	err := cmd.Run()
 	res := &cmdResult{
 		Stdout: out.String(),
 		Stderr: er.String(),
@@ -84,10 +124,10 @@ func runUFW(args ...string) (*cmdResult, error) {
 		}(),
 	}
 	if errors.Is(err, context.DeadlineExceeded) {
-		return res, fmt.Errorf("ufw command timeout: %s %s", path, strings.Join(finalArgs, " "))
+		return res, fmt.Errorf("%s command timeout: %s %s", name, path, strings.Join(finalArgs, " "))
 	}
 	if err != nil {
-		return res, fmt.Errorf("ufw command failed: %s %s\nstderr: %s", path, strings.Join(finalArgs, " "), res.Stderr)
+		return res, fmt.Errorf("%s command failed: %s %s\nstderr: %s", name, path, strings.Join(finalArgs, " "), res.Stderr)
 	}
 	return res, nil
 }
@@ -155,6 +195,23 @@ func validateIPorCIDR(s string) error {
 	return nil
 }
 
+// sanitizeComment turns a comment ufw stored, which may have been set
+// outside the API, into one validateComment accepts: characters it refuses
+// become spaces and the comment is cut to 80 bytes on a character boundary.
+func sanitizeComment(c string) string {
+	c = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("\n\r\t`$&|;<>()\\\"'", r) {
+			return ' '
+		}
+		return r
+	}, c)
+	for len(c) > 80 {
+		_, size := utf8.DecodeLastRuneInString(c)
+		c = c[:len(c)-size]
+	}
+	return strings.TrimSpace(c)
+}
+
 func validateComment(c string) error {
 	if len(c) > 80 {
 		return fmt.Errorf("comment too long (<=80)")
@@ -224,94 +281,117 @@ func GetUFWStatus() (*UFWStatus, error) {
 	return status, nil
 }
 
-func AllowUFWPort(rule string, comment string) error {
+// portRuleArgs validates a simple-syntax rule such as "22/tcp" and returns
+// the ufw arguments that add it.
+func portRuleArgs(action, rule, comment string) ([]string, error) {
 	rule = strings.TrimSpace(rule)
 	if rule == "" {
-		return fmt.Errorf("rule cannot be empty")
+		return nil, fmt.Errorf("rule cannot be empty")
 	}
 	parts := strings.Split(rule, "/")
 	switch len(parts) {
 	case 1:
 		if _, err := strconv.Atoi(parts[0]); err == nil || strings.Contains(parts[0], ":") {
 			if err := validatePort(parts[0]); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	case 2:
 		if parts[0] != "" {
 			if _, err := strconv.Atoi(parts[0]); err == nil || strings.Contains(parts[0], ":") {
 				if err := validatePort(parts[0]); err != nil {
-					return err
+					return nil, err
 				}
 			}
 		}
 		if err := validateProto(parts[1]); err != nil {
-			return err
+			return nil, err
 		}
 	default:
-		return fmt.Errorf("invalid rule format: %s", rule)
+		return nil, fmt.Errorf("invalid rule format: %s", rule)
 	}
 	if comment != "" {
 		if err := validateComment(comment); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	args := []string{"allow", rule}
+	args := []string{action, rule}
 	if comment != "" {
 		args = append(args, "comment", comment)
 	}
-	if _, err := runUFW(args...); err != nil {
+	return args, nil
+}
+
+// addUFWRule runs a command that adds a rule. It reports false if the rule
+// already existed, in which case ufw skips it or only updates its comment.
+func addUFWRule(args []string) (bool, error) {
+	res, err := runUFW(args...)
+	if err != nil {
 		if strings.Contains(err.Error(), "Skipping adding existing rule") {
-			return nil
+			return false, nil
 		}
-		return err
+		return false, err
 	}
-	return nil
+	if res == nil {
+		return true, nil
+	}
+	out := res.Stdout + res.Stderr
+	return !strings.Contains(out, "Skipping adding existing rule") && !strings.Contains(out, "Rule updated"), nil
 }
 
-func DenyUFWPort(rule string, comment string) error {
-	rule = strings.TrimSpace(rule)
-	if rule == "" {
-		return fmt.Errorf("rule cannot be empty")
-	}
-	parts := strings.Split(rule, "/")
-	switch len(parts) {
-	case 1:
-		if _, err := strconv.Atoi(parts[0]); err == nil || strings.Contains(parts[0], ":") {
-			if err := validatePort(parts[0]); err != nil {
-				return err
-			}
-		}
-	case 2:
-		if parts[0] != "" {
-			if _, err := strconv.Atoi(parts[0]); err == nil || strings.Contains(parts[0], ":") {
-				if err := validatePort(parts[0]); err != nil {
-					return err
-				}
-			}
-		}
-		if err := validateProto(parts[1]); err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("invalid rule format: %s", rule)
+func addRuleArgs(args []string, err error) error {
+	if err != nil {
+		return err
 	}
-	if comment != "" {
-		if err := validateComment(comment); err != nil {
-			return err
-		}
+	_, err = addUFWRule(args)
+	return err
+}
+
+// ruleArgsWithoutComment drops the trailing comment the rule builders add;
+// ufw matches rules for deletion without it.
+func ruleArgsWithoutComment(args []string) []string {
+	if n := len(args); n >= 2 && args[n-2] == "comment" {
+		args = args[:n-2]
 	}
-	args := []string{"deny", rule}
-	if comment != "" {
-		args = append(args, "comment", comment)
+	return append([]string(nil), args...)
+}
+
+// deleteRuleArgs places "delete" after "route" for route rules.
+func deleteRuleArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "route" {
+		return append([]string{"route", "delete"}, args[1:]...)
 	}
-	if _, err := runUFW(args...); err != nil {
-		if strings.Contains(err.Error(), "Skipping adding existing rule") {
-			return nil
-		}
-		return err
+	return append([]string{"delete"}, args...)
+}
+
+// deleteRuleByArgs deletes the rule added with args. A rule that no longer
+// exists, e.g. because it was deleted by number, counts as deleted.
+func deleteRuleByArgs(args []string) error {
+	res, err := runUFWForce(deleteRuleArgs(ruleArgsWithoutComment(args))...)
+	if res != nil && strings.Contains(res.Stdout+res.Stderr, "non-existent rule") {
+		return nil
 	}
-	return nil
+	return err
+}
+
+// ruleOpArgs builds the arguments for the rule-adding ops shared by batches
+// and schedules: allow, deny, allow_ip and deny_ip.
+func ruleOpArgs(op, rule, ipAddress, portProto, comment string) ([]string, error) {
+	switch op {
+	case "allow", "deny":
+		return portRuleArgs(op, rule, comment)
+	case "allow_ip", "deny_ip":
+		return ipRuleArgs(strings.TrimSuffix(op, "_ip"), ipAddress, portProto, comment)
+	}
+	return nil, fmt.Errorf("unknown op %q", op)
+}
+
+func AllowUFWPort(rule string, comment string) error {
+	return addRuleArgs(portRuleArgs("allow", rule, comment))
+}
+
+func DenyUFWPort(rule string, comment string) error {
+	return addRuleArgs(portRuleArgs("deny", rule, comment))
 }
 
 func DeleteUFWByNumber(ruleNumber string) error {
@@ -352,70 +432,31 @@ func DisableUFW() error {
 	return nil
 }
 
-func AllowUFWFromIP(ipAddress string, portProto string, comment string) error {
-	ipAddress = strings.TrimSpace(ipAddress)
-	if ipAddress == "" {
-		return fmt.Errorf("ip address cannot be empty")
-	}
-	if err := validateIPorCIDR(ipAddress); err != nil {
-		return err
-	}
-	pp := strings.TrimSpace(portProto)
-	var port, proto string
-	if pp != "" {
-		if strings.Contains(pp, "/") {
-			parts := strings.SplitN(pp, "/", 2)
-			port = strings.TrimSpace(parts[0])
-			proto = strings.TrimSpace(parts[1])
-		} else {
-			if _, err := strconv.Atoi(pp); err == nil || strings.Contains(pp, ":") {
-				port = pp
-			} else {
-				proto = pp
-			}
-		}
-	}
-	if port != "" {
-		if err := validatePort(port); err != nil {
-			return err
-		}
-	}
-	if proto != "" {
-		if err := validateProto(proto); err != nil {
-			return err
-		}
-	}
-	if comment != "" {
-		if err := validateComment(comment); err != nil {
-			return err
-		}
-	}
-	args := []string{"allow", "from", ipAddress, "to", "any"}
-	if port != "" {
-		args = append(args, "port", port)
-	}
-	if proto != "" {
-		args = append(args, "proto", proto)
-	}
-	if comment != "" {
-		args = append(args, "comment", comment)
+var (
+	ufwDefaultPolicies   = map[string]bool{"allow": true, "deny": true, "reject": true}
+	ufwDefaultDirections = map[string]bool{"incoming": true, "outgoing": true, "routed": true}
+)
+
+func SetUFWDefault(policy, direction string) error {
+	if !ufwDefaultPolicies[policy] {
+		return fmt.Errorf("invalid default policy: %s", policy)
 	}
-	if _, err := runUFW(args...); err != nil {
-		if strings.Contains(err.Error(), "Skipping adding existing rule") {
-			return nil
-		}
-		return err
+	if !ufwDefaultDirections[direction] {
+		return fmt.Errorf("invalid direction: %s", direction)
 	}
-	return nil
+	_, err := runUFW("default", policy, direction)
+	return err
 }
 
-func DenyUFWFromIP(ipAddress string, portProto string, comment string) error {
+// ipRuleArgs validates a rule for traffic from an address, optionally
+// limited to a port and protocol, and returns the ufw arguments that add it.
+func ipRuleArgs(action, ipAddress, portProto, comment string) ([]string, error) {
 	ipAddress = strings.TrimSpace(ipAddress)
 	if ipAddress == "" {
-		return fmt.Errorf("ip address cannot be empty")
+		return nil, fmt.Errorf("ip address cannot be empty")
 	}
 	if err := validateIPorCIDR(ipAddress); err != nil {
-		return err
+		return nil, err
 	}
 	pp := strings.TrimSpace(portProto)
 	var port, proto string
@@ -434,20 +475,20 @@ func DenyUFWFromIP(ipAddress string, portProto string, comment string) error {
 	}
 	if port != "" {
 		if err := validatePort(port); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if proto != "" {
 		if err := validateProto(proto); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if comment != "" {
 		if err := validateComment(comment); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	args := []string{"deny", "from", ipAddress, "to", "any"}
+	args := []string{action, "from", ipAddress, "to", "any"}
 	if port != "" {
 		args = append(args, "port", port)
 	}
@@ -457,47 +498,51 @@ func DenyUFWFromIP(ipAddress string, portProto string, comment string) error {
 	if comment != "" {
 		args = append(args, "comment", comment)
 	}
-	if _, err := runUFW(args...); err != nil {
-		if strings.Contains(err.Error(), "Skipping adding existing rule") {
-			return nil
-		}
-		return err
-	}
-	return nil
+	return args, nil
 }
 
-func RouteAllowUFW(protocol, fromIP, toIP, port, comment string) error {
+func AllowUFWFromIP(ipAddress string, portProto string, comment string) error {
+	return addRuleArgs(ipRuleArgs("allow", ipAddress, portProto, comment))
+}
+
+func DenyUFWFromIP(ipAddress string, portProto string, comment string) error {
+	return addRuleArgs(ipRuleArgs("deny", ipAddress, portProto, comment))
+}
+
+// routeAllowArgs validates a route (forwarding) rule and returns the ufw
+// arguments that add it.
+func routeAllowArgs(protocol, fromIP, toIP, port, comment string) ([]string, error) {
 	protocol = strings.TrimSpace(protocol)
 	fromIP = strings.TrimSpace(fromIP)
 	toIP = strings.TrimSpace(toIP)
 	port = strings.TrimSpace(port)
 	comment = strings.TrimSpace(comment)
 	if protocol == "" && port == "" {
-		return fmt.Errorf("invalid request: protocol or port required")
+		return nil, fmt.Errorf("invalid request: protocol or port required")
 	}
 	if protocol != "" {
 		if err := validateProto(protocol); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if fromIP != "" && fromIP != "any" {
 		if err := validateIPorCIDR(fromIP); err != nil {
-			return fmt.Errorf("from ip invalid: %v", err)
+			return nil, fmt.Errorf("from ip invalid: %v", err)
 		}
 	}
 	if toIP != "" && toIP != "any" {
 		if err := validateIPorCIDR(toIP); err != nil {
-			return fmt.Errorf("to ip invalid: %v", err)
+			return nil, fmt.Errorf("to ip invalid: %v", err)
 		}
 	}
 	if port != "" {
 		if err := validatePort(port); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if comment != "" {
 		if err := validateComment(comment); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	args := []string{"route", "allow"}
@@ -517,11 +562,9 @@ func RouteAllowUFW(protocol, fromIP, toIP, port, comment string) error {
 	if comment != "" {
 		args = append(args, "comment", comment)
 	}
-	if _, err := runUFW(args...); err != nil {
-		if strings.Contains(err.Error(), "Skipping adding existing rule") {
-			return nil
-		}
-		return err
-	}
-	return nil
+	return args, nil
+}
+
+func RouteAllowUFW(protocol, fromIP, toIP, port, comment string) error {
+	return addRuleArgs(routeAllowArgs(protocol, fromIP, toIP, port, comment))
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ufw logs the packets it blocks, allows or audits through the kernel, as
+// lines such as
+//
+//	Oct 18 10:00:00 host kernel: [  12.3] [UFW BLOCK] IN=eth0 OUT= MAC=...
+//	    SRC=203.0.113.5 DST=192.0.2.1 ... PROTO=TCP SPT=54321 DPT=22 ...
+//
+// in /var/log/ufw.log and kern.log, or in the journal without the syslog
+// prefix. Any program can log text that looks like this, so only lines the
+// kernel logged are accepted: in files, those with the kernel: tag, and from
+// the journal, messages read with followKernelJournal.
+
+const defaultUFWLog = "/var/log/ufw.log"
+
+// ufwLogPath returns the ufw log, UFW_LOG_PATH or /var/log/ufw.log.
+func ufwLogPath() string {
+	if p := os.Getenv("UFW_LOG_PATH"); p != "" {
+		return p
+	}
+	return defaultUFWLog
+}
+
+var (
+	reUFWLogAction = regexp.MustCompile(`\[UFW ([A-Z ]+)\]`)
+	// reKernelTag matches the whole syslog prefix of a kernel line: an RFC
+	// 3339 or traditional time, the host and the kernel: tag, optionally
+	// followed by the kernel's own timestamp.
+	reKernelTag = regexp.MustCompile(`^(?:\S+|[A-Z][a-z]{2} +\d{1,2} \d\d:\d\d:\d\d) +\S+ kernel: *(?:\[ *\d+\.\d+\] *)?$`)
+	// reKernelStamp matches what may precede the marker in a journal
+	// message.
+	reKernelStamp = regexp.MustCompile(`^\s*(?:\[\s*\d+\.\d+\]\s*)?$`)
+)
+
+// tcpFlags are the flags the kernel logs for TCP packets, as bare words.
+var tcpFlags = map[string]bool{"CWR": true, "ECE": true, "URG": true, "ACK": true, "PSH": true, "RST": true, "SYN": true, "FIN": true}
+
+// ufwLogEvent is a parsed ufw log line.
+type ufwLogEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	In      string    `json:"in,omitempty"`
+	Out     string    `json:"out,omitempty"`
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+	Proto   string    `json:"proto,omitempty"`
+	SrcPort int       `json:"spt,omitempty"`
+	DstPort int       `json:"dpt,omitempty"`
+	Flags   []string  `json:"flags,omitempty"`
+}
+
+// isSYN reports whether the event is a TCP connection attempt: SYN set and
+// ACK not. Its source can be forged as easily as any other packet's, since
+// the packet is logged before a handshake could prove it; counting only
+// SYNs merely leaves out replies to connections made elsewhere.
+func (ev ufwLogEvent) isSYN() bool {
+	syn, ack := false, false
+	for _, f := range ev.Flags {
+		syn = syn || f == "SYN"
+		ack = ack || f == "ACK"
+	}
+	return ev.Proto == "tcp" && syn && !ack
+}
+
+// parseUFWLogLine parses a ufw log line from a file. The line must carry
+// the kernel: tag; the time is read from its RFC 3339 or traditional syslog
+// prefix.
+func parseUFWLogLine(line string, now time.Time) (ufwLogEvent, bool) {
+	loc := reUFWLogAction.FindStringSubmatchIndex(line)
+	if loc == nil || !reKernelTag.MatchString(line[:loc[0]]) {
+		return ufwLogEvent{}, false
+	}
+	return parseUFWLogFields(line, loc, parseSyslogTime(line[:loc[0]], now))
+}
+
+// parseUFWKernelMessage parses the MESSAGE of a journal entry read with
+// followKernelJournal. It has no syslog prefix, so the event gets now.
+func parseUFWKernelMessage(msg string, now time.Time) (ufwLogEvent, bool) {
+	loc := reUFWLogAction.FindStringSubmatchIndex(msg)
+	if loc == nil || !reKernelStamp.MatchString(msg[:loc[0]]) {
+		return ufwLogEvent{}, false
+	}
+	return parseUFWLogFields(msg, loc, now)
+}
+
+// parseUFWLogFields reads the fields after the [UFW ...] marker at loc.
+func parseUFWLogFields(line string, loc []int, at time.Time) (ufwLogEvent, bool) {
+	ev := ufwLogEvent{Action: line[loc[2]:loc[3]], Time: at}
+	for _, field := range strings.Fields(line[loc[1]:]) {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			if tcpFlags[field] {
+				ev.Flags = append(ev.Flags, field)
+			}
+			continue
+		}
+		switch key {
+		case "IN":
+			ev.In = val
+		case "OUT":
+			ev.Out = val
+		case "SRC":
+			ev.Src = val
+		case "DST":
+			ev.Dst = val
+		case "PROTO":
+			ev.Proto = strings.ToLower(val)
+		case "SPT":
+			ev.SrcPort, _ = strconv.Atoi(val)
+		case "DPT":
+			ev.DstPort, _ = strconv.Atoi(val)
+		}
+	}
+	if ev.Src == "" {
+		return ufwLogEvent{}, false
+	}
+	return ev, true
+}
+
+// parseSyslogTime reads the timestamp at the start of a syslog line. The
+// traditional format has no year; a time in the future is taken to be from
+// the previous year.
+func parseSyslogTime(prefix string, now time.Time) time.Time {
+	fields := strings.Fields(prefix)
+	if len(fields) == 0 {
+		return now
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		return t
+	}
+	if len(fields) >= 3 {
+		t, err := time.ParseInLocation("Jan 2 15:04:05", strings.Join(fields[:3], " "), now.Location())
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t
+		}
+	}
+	return now
+}
+
+// ufwLogFiles returns path and its rotations (path.1, path.2.gz, ...),
+// oldest first.
+func ufwLogFiles(path string) []string {
+	type rotated struct {
+		name string
+		n    int
+	}
+	var old []rotated
+	matches, _ := filepath.Glob(path + ".*")
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if n, err := strconv.Atoi(suffix); err == nil && n > 0 {
+			old = append(old, rotated{m, n})
+		}
+	}
+	sort.Slice(old, func(a, b int) bool { return old[a].n > old[b].n })
+	files := make([]string, 0, len(old)+1)
+	for _, r := range old {
+		files = append(files, r.name)
+	}
+	return append(files, path)
+}
+
+// scanUFWLogs calls fn for each ufw event in files, in order. Files last
+// written before since are skipped. It returns the files read and the
+// number of lines.
+func scanUFWLogs(files []string, since time.Time, fn func(ufwLogEvent)) ([]string, int, error) {
+	read := []string{}
+	lines := 0
+	now := time.Now()
+	for _, name := range files {
+		st, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return read, lines, err
+		}
+		if !since.IsZero() && st.ModTime().Before(since) {
+			continue
+		}
+		n, err := scanUFWLogFile(name, now, fn)
+		lines += n
+		if err != nil {
+			return read, lines, err
+		}
+		read = append(read, name)
+	}
+	return read, lines, nil
+}
+
+func scanUFWLogFile(name string, now time.Time, fn func(ufwLogEvent)) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	br := bufio.NewReaderSize(r, maxLogLine)
+	lines := 0
+	for {
+		ln, err := br.ReadString('\n')
+		if ln != "" {
+			lines++
+			if ev, ok := parseUFWLogLine(strings.TrimRight(ln, "\r\n"), now); ok {
+				fn(ev)
+			}
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ufwStateFiles together with the application profiles in
+// ufwApplicationsDir fully describe ufw's configuration: the user rules, the
+// before/after rules, the default policies and whether the firewall starts on
+// boot.
+var ufwStateFiles = []string{
+	"/etc/ufw/user.rules",
+	"/etc/ufw/user6.rules",
+	"/etc/ufw/before.rules",
+	"/etc/ufw/before6.rules",
+	"/etc/ufw/after.rules",
+	"/etc/ufw/after6.rules",
+	"/etc/default/ufw",
+	"/etc/ufw/ufw.conf",
+}
+
+const ufwApplicationsDir = "/etc/ufw/applications.d"
+
+// ufwState is a copy of ufwStateFiles plus whether the firewall was running.
+// A nil entry means the file did not exist.
+type ufwState struct {
+	Files  map[string][]byte `json:"files"`
+	Active bool              `json:"active"`
+}
+
+// ufwFileAllowed limits direct file access, both in-process and through the
+// helper, to ufw's own configuration.
+func ufwFileAllowed(path string) bool {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return false
+	}
+	return path == "/etc/default/ufw" || strings.HasPrefix(path, "/etc/ufw/")
+}
+
+// ufwRulesFiles are fed to iptables-restore by ufw. They are checked by
+// validateRulesFile.
+var ufwRulesFiles = map[string]bool{
+	"/etc/ufw/user.rules":    true,
+	"/etc/ufw/user6.rules":   true,
+	"/etc/ufw/before.rules":  true,
+	"/etc/ufw/before6.rules": true,
+	"/etc/ufw/after.rules":   true,
+	"/etc/ufw/after6.rules":  true,
+}
+
+// ufwSettingsValues lists the settings /etc/default/ufw and ufw.conf may
+// hold with a pattern for their values. The files are sourced as shell by
+// ufw's init scripts, so unknown keys (PATH, say) and values that could
+// carry shell syntax are refused, and IPT_SYSCTL, which ufw applies with
+// sysctl -p, cannot be pointed elsewhere.
+var ufwSettingsValues = map[string]*regexp.Regexp{
+	"IPV6":                       regexp.MustCompile(`^(yes|no)$`),
+	"DEFAULT_INPUT_POLICY":       regexp.MustCompile(`^(ACCEPT|DROP|REJECT)$`),
+	"DEFAULT_OUTPUT_POLICY":      regexp.MustCompile(`^(ACCEPT|DROP|REJECT)$`),
+	"DEFAULT_FORWARD_POLICY":     regexp.MustCompile(`^(ACCEPT|DROP|REJECT)$`),
+	"DEFAULT_APPLICATION_POLICY": regexp.MustCompile(`^(ACCEPT|DROP|REJECT|SKIP)$`),
+	"MANAGE_BUILTINS":            regexp.MustCompile(`^(yes|no)$`),
+	"IPT_SYSCTL":                 regexp.MustCompile(`^/etc/ufw/sysctl\.conf$`),
+	"IPT_MODULES":                regexp.MustCompile(`^[a-z0-9_ ]*$`),
+	"IPT_BACKEND":                regexp.MustCompile(`^[a-z]*$`),
+	"ENABLED":                    regexp.MustCompile(`^(yes|no)$`),
+	"LOGLEVEL":                   regexp.MustCompile(`^(off|low|medium|high|full)$`),
+}
+
+var (
+	reUFWSetting = regexp.MustCompile(`^([A-Z_][A-Z0-9_]*)=(?:"([^"]*)"|([^"'\s]*))$`)
+	reAppProfile = regexp.MustCompile(`^(\[[^\]\n]+\]|[A-Za-z_]+\s*=.*)$`)
+	// reIPSetCommand matches a line of ipsetSaveFile, which is fed to
+	// "ipset restore" at boot: like validateIPSetCommand, it only names
+	// sets carrying ipsetPrefix.
+	reIPSetCommand = regexp.MustCompile(`^(create|add|flush|destroy) ` + regexp.QuoteMeta(ipsetPrefix) + `[A-Za-z0-9_.:\-]+( [A-Za-z0-9_.:/,\- ]*)?$`)
+
+	reUFWChain      = regexp.MustCompile(`^ufw6?-[a-z0-9\-]{1,26}$`)
+	reUFWChainDecl  = regexp.MustCompile(`^:(\S+) - \[\d+:\d+\]$`)
+	rulesFileTarget = map[string]bool{"ACCEPT": true, "DROP": true, "REJECT": true, "RETURN": true, "LOG": true}
+)
+
+// ufwFileWritable limits writes, both in-process and through the helper, to
+// the files the backend manages: the rules files, ipsetSaveFile, the
+// settings files and application profiles.
+func ufwFileWritable(path string) bool {
+	if !ufwFileAllowed(path) {
+		return false
+	}
+	switch {
+	case ufwRulesFiles[path], path == ipsetSaveFile,
+		path == "/etc/default/ufw", path == "/etc/ufw/ufw.conf":
+		return true
+	}
+	return filepath.Dir(path) == ufwApplicationsDir
+}
+
+// validateUFWFileContent checks what is written to a ufw file.
+func validateUFWFileContent(path string, data []byte) error {
+	if ufwRulesFiles[path] {
+		return validateRulesFile(path, data)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		var err error
+		switch {
+		case path == ipsetSaveFile:
+			if !reIPSetCommand.MatchString(line) {
+				err = fmt.Errorf("not an ipset create, add, flush or destroy command on a %s set", ipsetPrefix)
+			}
+		case filepath.Dir(path) == ufwApplicationsDir:
+			if !reAppProfile.MatchString(line) {
+				err = errors.New("not a section or key=value line")
+			}
+		default:
+			err = validateUFWSetting(line)
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateRulesFile only lets through what ufw itself writes to its rules
+// files: iptables-restore input for the filter table that declares and
+// appends to ufw's own chains, jumping to them or to a plain target. Other
+// tables and chains, and options such as --modprobe that make
+// iptables-restore run a program, are refused.
+func validateRulesFile(path string, data []byte) error {
+	inTable := false
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var err error
+		switch {
+		case line == "*filter":
+			if inTable {
+				err = errors.New("table started before COMMIT")
+			}
+			inTable = true
+		case line == "COMMIT":
+			if !inTable {
+				err = errors.New("COMMIT outside a table")
+			}
+			inTable = false
+		case !inTable:
+			err = errors.New("only the filter table is permitted")
+		case strings.HasPrefix(line, ":"):
+			m := reUFWChainDecl.FindStringSubmatch(line)
+			if m == nil || !reUFWChain.MatchString(m[1]) {
+				err = errors.New("only ufw chains may be declared")
+			}
+		case strings.HasPrefix(line, "-A "):
+			err = validateRulesFileRule(strings.Fields(line))
+		default:
+			err = errors.New("not a chain declaration, -A rule or COMMIT")
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+	}
+	if inTable {
+		return fmt.Errorf("%s: missing COMMIT", path)
+	}
+	return nil
+}
+
+func validateRulesFileRule(fields []string) error {
+	if !reUFWChain.MatchString(fields[1]) {
+		return fmt.Errorf("chain %s is not a ufw chain", fields[1])
+	}
+	for i, f := range fields {
+		switch {
+		case f == "-M" || strings.HasPrefix(f, "--modprobe"):
+			return fmt.Errorf("option %s not permitted", f)
+		case f == "-j" || f == "--jump" || f == "-g" || f == "--goto":
+			if i+1 == len(fields) {
+				return fmt.Errorf("%s without a target", f)
+			}
+			if t := fields[i+1]; !rulesFileTarget[t] && !reUFWChain.MatchString(t) {
+				return fmt.Errorf("target %s not permitted", t)
+			}
+		}
+	}
+	return nil
+}
+
+func validateUFWSetting(line string) error {
+	m := reUFWSetting.FindStringSubmatch(line)
+	if m == nil {
+		return errors.New("not a KEY=value setting")
+	}
+	re := ufwSettingsValues[m[1]]
+	if re == nil {
+		return fmt.Errorf("setting %s not permitted", m[1])
+	}
+	if !re.MatchString(m[2] + m[3]) {
+		return fmt.Errorf("invalid value for %s", m[1])
+	}
+	return nil
+}
+
+// readUFWFile returns the contents of a ufw configuration file, or nil if it
+// does not exist.
+func readUFWFile(path string) ([]byte, error) {
+	if !ufwFileAllowed(path) {
+		return nil, fmt.Errorf("access to %s not permitted", path)
+	}
+	if helperSocketPath() != "" {
+		resp, err := callHelper(&helperRequest{Op: "read_file", Path: path}, ufwTimeout())
+		if err != nil {
+			return nil, err
+		}
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		if resp.Missing {
+			return nil, nil
+		}
+		if resp.Data == nil {
+			return []byte{}, nil
+		}
+		return resp.Data, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeUFWFile atomically replaces a ufw configuration file, keeping the
+// permissions of the file it replaces.
+func writeUFWFile(path string, data []byte) error {
+	if !ufwFileWritable(path) {
+		return fmt.Errorf("writing %s not permitted", path)
+	}
+	if err := validateUFWFileContent(path, data); err != nil {
+		return err
+	}
+	beginSelfChange()
+	defer endSelfChange()
+	err := writeUFWFileVia(path, data)
+	recordAuditCommand([]string{"write", path}, nil, err)
+	return err
+}
+
+func writeUFWFileVia(path string, data []byte) error {
+	if helperSocketPath() != "" {
+		resp, err := callHelper(&helperRequest{Op: "write_file", Path: path, Data: data}, ufwTimeout())
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		return nil
+	}
+	return writeUFWFileLocal(path, data)
+}
+
+func writeUFWFileLocal(path string, data []byte) error {
+	perm := os.FileMode(0o640)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	} else if path == "/etc/default/ufw" || path == "/etc/ufw/ufw.conf" {
+		perm = 0o644
+	}
+	return writeFileAtomic(path, data, perm)
+}
+
+// listUFWDir returns the names of the regular files in a ufw configuration
+// directory, or nothing if it does not exist.
+func listUFWDir(dir string) ([]string, error) {
+	if !ufwFileAllowed(dir) {
+		return nil, fmt.Errorf("access to %s not permitted", dir)
+	}
+	if helperSocketPath() != "" {
+		resp, err := callHelper(&helperRequest{Op: "list_dir", Path: dir}, ufwTimeout())
+		if err != nil {
+			return nil, err
+		}
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		return resp.Names, nil
+	}
+	return listUFWDirLocal(dir)
+}
+
+func listUFWDirLocal(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func captureUFWState() (*ufwState, error) {
+	files := append([]string{}, ufwStateFiles...)
+	apps, err := listUFWDir(ufwApplicationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", ufwApplicationsDir, err)
+	}
+	for _, name := range apps {
+		files = append(files, filepath.Join(ufwApplicationsDir, name))
+	}
+
+	st := &ufwState{Files: map[string][]byte{}}
+	for _, f := range files {
+		data, err := readUFWFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f, err)
+		}
+		st.Files[f] = data
+	}
+	status, err := GetUFWStatus()
+	if err != nil {
+		return nil, err
+	}
+	st.Active = status.Status == "active"
+	return st, nil
+}
+
+// writeUFWFiles writes every file of st that existed when it was captured,
+// after checking all of them so a refused file leaves nothing half-restored.
+func writeUFWFiles(st *ufwState) error {
+	paths := make([]string, 0, len(st.Files))
+	for p := range st.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if st.Files[p] == nil {
+			continue
+		}
+		if !ufwFileWritable(p) {
+			return fmt.Errorf("restore %s: writing it is not permitted", p)
+		}
+		if err := validateUFWFileContent(p, st.Files[p]); err != nil {
+			return fmt.Errorf("restore %s: %w", p, err)
+		}
+	}
+	for _, p := range paths {
+		if st.Files[p] == nil {
+			continue
+		}
+		if err := writeUFWFile(p, st.Files[p]); err != nil {
+			return fmt.Errorf("restore %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// restoreUFWState writes the saved files back and brings the running
+// firewall in line with them.
+func restoreUFWState(st *ufwState) error {
+	if err := writeUFWFiles(st); err != nil {
+		return err
+	}
+
+	if !st.Active {
+		return DisableUFW()
+	}
+	status, err := GetUFWStatus()
+	if err != nil {
+		return err
+	}
+	if status.Status == "active" {
+		_, err = runUFW("reload")
+		return err
+	}
+	return EnableUFW()
+}
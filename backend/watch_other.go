@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func watchFiles(dir string, files []string, changed func()) error {
+	return errors.New("file watching is not supported on this platform")
+}
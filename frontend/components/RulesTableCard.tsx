@@ -19,6 +19,7 @@ export interface ParsedRule {
   action: string;
   from: string;
   details?: string;
+  expiresAt?: string;
   raw: string;
 }
 
@@ -107,6 +108,11 @@ export default function RulesTableCard({
                       </TableCell>
                       <TableCell className="max-w-[220px] truncate text-slate-300/75" title={rule.details || "-"}>
                         {rule.details || "-"}
+                        {rule.expiresAt && (
+                          <span className="ml-2 inline-flex items-center rounded-full border border-amber-400/40 bg-amber-500/15 px-2 py-0.5 text-xs text-amber-100">
+                            expires {new Date(rule.expiresAt).toLocaleString()}
+                          </span>
+                        )}
                       </TableCell>
                       <TableCell className="text-right">
                         <Button
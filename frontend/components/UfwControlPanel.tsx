@@ -23,6 +23,18 @@ import { BackendConfig } from "@/lib/types";
 import { resolveApiUrl } from "@/lib/api";
 import Image from "next/image";
 
+interface DriftSummary {
+  unacknowledged: number;
+  last_detected_at?: string;
+}
+
+interface ExpiringRule {
+  id: string;
+  rule: string;
+  expires_at: string;
+  numbers: number[];
+}
+
 const getErrorMessage = (error: unknown): string => {
   if (error instanceof Error) {
     return error.message;
@@ -58,6 +70,8 @@ export default function UfwControlPanel() {
 
   const [ufwStatus, setUfwStatus] = useState<string | null>(null);
   const [rules, setRules] = useState<string[]>([]);
+  const [drift, setDrift] = useState<DriftSummary | null>(null);
+  const [expiring, setExpiring] = useState<ExpiringRule[]>([]);
   const [isLoadingStatus, setIsLoadingStatus] = useState<boolean>(true);
   const [isSubmitting, setIsSubmitting] = useState<boolean>(false);
   const [error, setError] = useState<string | null>(null);
@@ -490,6 +504,8 @@ export default function UfwControlPanel() {
 
       setUfwStatus(data.status);
       setRules(data.rules);
+      setDrift(data.drift ?? null);
+      setExpiring(data.expiring ?? []);
     } catch (err) {
       if (isAbortError(err)) return;
 
@@ -528,20 +544,31 @@ export default function UfwControlPanel() {
       }
       setUfwStatus(null);
       setRules([]);
+      setDrift(null);
       setError(null);
       setIsLoadingStatus(false);
     }
   }, [fetchStatus, selectedBackendId, isAppAuthenticated]);
 
-  const handleUfwAction = async (relativePath: string, successMessage: string, errorMessagePrefix: string) => {
+  const handleUfwAction = async (relativePath: string, successMessage: string, errorMessagePrefix: string, force = false) => {
     if (!selectedBackendId) return;
     setIsSubmitting(true);
     try {
-      const response = await fetch(getApiUrl(relativePath), {
+      const apiUrl = new URL(getApiUrl(relativePath));
+      if (force) apiUrl.searchParams.set("force", "true");
+      const response = await fetch(apiUrl.toString(), {
         method: "POST",
         credentials: "include",
       });
       const data = await response.json();
+      if (response.status === 409 && !force) {
+        const reason = data.details?.details || data.details?.error || "SSH or the panel port is not allowed.";
+        setIsSubmitting(false);
+        if (window.confirm(`${reason}\n\nThis may lock you out of this server. Continue anyway?`)) {
+          await handleUfwAction(relativePath, successMessage, errorMessagePrefix, true);
+        }
+        return;
+      }
       if (!response.ok) {
         throw new Error(data.details || data.error || `HTTP error! status: ${response.status}`);
       }
@@ -561,6 +588,31 @@ export default function UfwControlPanel() {
     }
   };
 
+  const handleAcknowledgeDrift = async () => {
+    if (!selectedBackendId) return;
+    setIsSubmitting(true);
+    try {
+      const response = await fetch(getApiUrl("/api/drift/ack"), {
+        method: "POST",
+        credentials: "include",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({}),
+      });
+      const data = await response.json();
+      if (!response.ok) {
+        throw new Error(data.details || data.error || `HTTP error! status: ${response.status}`);
+      }
+      toast.success("Out-of-band changes acknowledged.");
+      await fetchStatus();
+    } catch (err) {
+      const message = getErrorMessage(err);
+      console.error("Failed to acknowledge drift via API route:", err);
+      toast.error(`Acknowledge changes: ${message || "Unknown error"}`);
+    } finally {
+      setIsSubmitting(false);
+    }
+  };
+
   const handleEnable = () => {
     handleUfwAction("/api/enable", "UFW enabled successfully!", "Enable UFW");
   };
@@ -569,14 +621,25 @@ export default function UfwControlPanel() {
     handleUfwAction("/api/disable", "UFW disabled successfully!", "Disable UFW");
   };
 
-  const handleDeleteRule = async (ruleNumber: string) => {
+  const handleDeleteRule = async (ruleNumber: string, force = false) => {
     if (!selectedBackendId) return;
     setIsSubmitting(true);
     setRuleToDelete(null);
     try {
-      const apiUrl = getApiUrl(`/api/rules/delete/${ruleNumber}`);
-      const response = await fetch(apiUrl, { method: "DELETE", credentials: "include" });
+      const apiUrl = new URL(getApiUrl(`/api/rules/delete/${ruleNumber}`));
+      if (force) apiUrl.searchParams.set("force", "true");
+      const response = await fetch(apiUrl.toString(), { method: "DELETE", credentials: "include" });
       const data = await response.json();
+      if (response.status === 409 && !force) {
+        // The backend refused because this rule is the last one allowing SSH
+        // or the panel's own port; only proceed on an explicit second confirm.
+        const reason = data.details?.details || data.details?.error || "This rule protects SSH or the panel port.";
+        setIsSubmitting(false);
+        if (window.confirm(`${reason}\n\nDeleting it may lock you out of this server. Delete anyway?`)) {
+          await handleDeleteRule(ruleNumber, true);
+        }
+        return;
+      }
       if (!response.ok) {
         throw new Error(data.details || data.error || `HTTP error! status: ${response.status}`);
       }
@@ -797,7 +860,13 @@ export default function UfwControlPanel() {
     return potentiallyNullRules.filter((rule): rule is ParsedRule => rule !== null);
   };
 
-  const parsedRules = useMemo(() => parseRules(rules), [rules]);
+  const parsedRules = useMemo(() => {
+    const expiresAt = new Map<string, string>();
+    for (const e of expiring) {
+      for (const n of e.numbers) expiresAt.set(String(n), e.expires_at);
+    }
+    return parseRules(rules).map((rule) => ({ ...rule, expiresAt: expiresAt.get(rule.number) }));
+  }, [rules, expiring]);
 
   const renderBackendContent = () => {
     if (!selectedBackendId) {
@@ -853,6 +922,21 @@ export default function UfwControlPanel() {
           </Alert>
         )}
 
+        {drift && drift.unacknowledged > 0 && (
+          <Alert className="border-amber-500/50 bg-amber-500/10">
+            <AlertTitle>Changed outside the panel</AlertTitle>
+            <AlertDescription className="flex flex-wrap items-center justify-between gap-3">
+              <span>
+                {drift.unacknowledged} rule change{drift.unacknowledged === 1 ? " was" : "s were"} made directly with ufw
+                {drift.last_detected_at ? `, most recently ${new Date(drift.last_detected_at).toLocaleString()}` : ""}.
+              </span>
+              <Button size="sm" variant="outline" onClick={handleAcknowledgeDrift} disabled={isSubmitting}>
+                Acknowledge
+              </Button>
+            </AlertDescription>
+          </Alert>
+        )}
+
         <div className="relative">
           <StatusControlCard
             ufwStatus={ufwStatus ?? "—"}
@@ -14,6 +14,7 @@ import (
 	"ufwpanel/frontend/internal/handlers"
 	"ufwpanel/frontend/internal/middleware"
 	"ufwpanel/frontend/internal/services/auth"
+	"ufwpanel/frontend/internal/services/pki"
 	"ufwpanel/frontend/internal/services/relay"
 	"ufwpanel/frontend/internal/storage"
 )
@@ -24,13 +25,14 @@ type Server struct {
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
-	repo, err := storage.NewBackendRepository(cfg.DatabasePath)
+	repo, err := storage.NewBackendRepository(cfg.DatabasePath, cfg.JWTSecret)
 	if err != nil {
 		return nil, err
 	}
 
 	authSvc := auth.NewService(cfg)
-	relayClient := relay.NewClient(30 * time.Second)
+	relayClient := relay.NewClient(30*time.Second, cfg.SignRequests)
+	authority := pki.NewAuthority(cfg.PKIDir)
 
 	router := gin.New()
 	router.Use(gin.Recovery(), gin.Logger())
@@ -63,8 +65,9 @@ func NewServer(cfg *config.Config) (*Server, error) {
 	router.Use(cors.New(corsCfg))
 
 	authHandler := handlers.NewAuthHandler(authSvc)
-	backendHandler := handlers.NewBackendHandler(repo)
+	backendHandler := handlers.NewBackendHandler(repo, relayClient, authority)
 	firewallHandler := handlers.NewFirewallHandler(repo, relayClient)
+	pkiHandler := handlers.NewPKIHandler(authority)
 
 	api := router.Group("/api")
 	{
@@ -75,6 +78,7 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		secured.Use(middleware.RequireAuth(authSvc))
 		backendHandler.Register(secured)
 		firewallHandler.Register(secured)
+		pkiHandler.Register(secured)
 	}
 
 	registerStatic(router, cfg.StaticDir)
@@ -12,6 +12,7 @@ const (
 	DefaultListenAddr   = ":8080"
 	DefaultStaticDir    = "./out"
 	DefaultDatabasePath = "./database/ufw-webui.db"
+	DefaultPKIDir       = "./database/pki"
 	DefaultJWTExpiry    = "1d"
 	CookieName          = "auth_token"
 )
@@ -20,10 +21,12 @@ type Config struct {
 	ListenAddr     string
 	StaticDir      string
 	DatabasePath   string
+	PKIDir         string
 	AuthPassword   string
 	JWTSecret      []byte
 	JWTExpiresIn   time.Duration
 	AllowedOrigins []string
+	SignRequests   bool
 }
 
 func Load() (*Config, error) {
@@ -34,6 +37,7 @@ func Load() (*Config, error) {
 
 	staticDir := getEnvOrDefault("FRONTEND_DIST_DIR", DefaultStaticDir)
 	dbPath := getEnvOrDefault("FRONTEND_DB_PATH", DefaultDatabasePath)
+	pkiDir := getEnvOrDefault("FRONTEND_PKI_DIR", DefaultPKIDir)
 	authPassword := os.Getenv("AUTH_PASSWORD")
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
@@ -47,15 +51,18 @@ func Load() (*Config, error) {
 	}
 
 	allowedOrigins := parseOrigins(os.Getenv("FRONTEND_ALLOWED_ORIGINS"))
+	signRequests := parseBool(os.Getenv("BACKEND_REQUEST_SIGNING"))
 
 	return &Config{
 		ListenAddr:     listenAddr,
 		StaticDir:      staticDir,
 		DatabasePath:   dbPath,
+		PKIDir:         pkiDir,
 		AuthPassword:   authPassword,
 		JWTSecret:      []byte(jwtSecret),
 		JWTExpiresIn:   expiresIn,
 		AllowedOrigins: allowedOrigins,
+		SignRequests:   signRequests,
 	}, nil
 }
 
@@ -103,3 +110,12 @@ func parseOrigins(raw string) []string {
 	}
 	return cleaned
 }
+
+func parseBool(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerAllowlists(rg *gin.RouterGroup) {
+	rg.GET("/allowlists", h.listAllowlists)
+	rg.POST("/allowlists", h.createAllowlist)
+	rg.GET("/allowlists/:allowlistName", h.getAllowlist)
+	rg.DELETE("/allowlists/:allowlistName", h.deleteAllowlist)
+	rg.POST("/allowlists/:allowlistName/sync", h.syncAllowlist)
+}
+
+func allowlistPath(c *gin.Context, suffix string) string {
+	return "/allowlists/" + url.PathEscape(c.Param("allowlistName")) + suffix
+}
+
+func (h *FirewallHandler) listAllowlists(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/allowlists", "Failed to list allowlists")
+}
+
+func (h *FirewallHandler) createAllowlist(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/allowlists", "Failed to create allowlist", "name", "source", "port_protocol")
+}
+
+func (h *FirewallHandler) getAllowlist(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, allowlistPath(c, ""), "Failed to fetch allowlist")
+}
+
+func (h *FirewallHandler) deleteAllowlist(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, withBackendQuery(c, allowlistPath(c, "")), "Failed to delete allowlist")
+}
+
+func (h *FirewallHandler) syncAllowlist(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, withBackendQuery(c, allowlistPath(c, "/sync")), "Failed to start allowlist sync")
+}
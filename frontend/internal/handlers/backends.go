@@ -9,21 +9,28 @@ import (
 	"github.com/google/uuid"
 
 	"ufwpanel/frontend/internal/models"
+	"ufwpanel/frontend/internal/services/pki"
+	"ufwpanel/frontend/internal/services/relay"
 	"ufwpanel/frontend/internal/storage"
 )
 
 type BackendHandler struct {
-	repo *storage.BackendRepository
+	repo      *storage.BackendRepository
+	relay     *relay.Client
+	authority *pki.Authority
 }
 
-func NewBackendHandler(repo *storage.BackendRepository) *BackendHandler {
-	return &BackendHandler{repo: repo}
+func NewBackendHandler(repo *storage.BackendRepository, relayClient *relay.Client, authority *pki.Authority) *BackendHandler {
+	return &BackendHandler{repo: repo, relay: relayClient, authority: authority}
 }
 
 func (h *BackendHandler) Register(rg *gin.RouterGroup) {
 	rg.GET("/backends", h.list)
 	rg.POST("/backends", h.create)
 	rg.PUT("/backends/:id", h.update)
+	rg.POST("/backends/:id/repin", h.repin)
+	rg.POST("/backends/:id/client-cert", h.issueClientCert)
+	rg.DELETE("/backends/:id/client-cert", h.removeClientCert)
 	rg.DELETE("/backends", h.remove)
 }
 
@@ -39,9 +46,11 @@ func (h *BackendHandler) list(c *gin.Context) {
 
 func (h *BackendHandler) create(c *gin.Context) {
 	type request struct {
-		Name   string `json:"name"`
-		URL    string `json:"url"`
-		APIKey string `json:"apiKey"`
+		Name            string `json:"name"`
+		URL             string `json:"url"`
+		APIKey          string `json:"apiKey"`
+		CertFingerprint string `json:"certFingerprint"`
+		MTLS            bool   `json:"mtls"`
 	}
 
 	var body request
@@ -54,7 +63,7 @@ func (h *BackendHandler) create(c *gin.Context) {
 	body.URL = strings.TrimSpace(body.URL)
 	body.APIKey = strings.TrimSpace(body.APIKey)
 
-	if body.Name == "" || body.URL == "" || body.APIKey == "" {
+	if body.Name == "" || body.URL == "" || (body.APIKey == "" && !body.MTLS) {
 		writeError(c, http.StatusBadRequest, "Missing required fields: name, url, apiKey.", nil)
 		return
 	}
@@ -71,6 +80,28 @@ func (h *BackendHandler) create(c *gin.Context) {
 		APIKey: body.APIKey,
 	}
 
+	if strings.TrimSpace(body.CertFingerprint) != "" {
+		fp, err := relay.NormalizeFingerprint(body.CertFingerprint)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, "Invalid certificate fingerprint.", err.Error())
+			return
+		}
+		backend.CertFingerprint = fp
+	}
+
+	var issued *pki.Issued
+	if body.MTLS {
+		var err error
+		issued, err = h.authority.IssueClient(clientCommonName(backend.ID))
+		if err != nil {
+			writeError(c, http.StatusInternalServerError, "Failed to issue client certificate.", err.Error())
+			return
+		}
+		backend.ClientCert = issued.Certificate
+		backend.ClientKey = issued.PrivateKey
+		backend.HasClientCert = true
+	}
+
 	ctx := c.Request.Context()
 	if err := h.repo.Create(ctx, backend); err != nil {
 		if isUniqueViolation(err) {
@@ -81,6 +112,19 @@ func (h *BackendHandler) create(c *gin.Context) {
 		return
 	}
 
+	if issued != nil {
+		c.JSON(http.StatusCreated, gin.H{
+			"id":                backend.ID,
+			"name":              backend.Name,
+			"url":               backend.URL,
+			"certFingerprint":   backend.CertFingerprint,
+			"hasClientCert":     true,
+			"caCertificate":     issued.CA,
+			"clientFingerprint": issued.Fingerprint,
+		})
+		return
+	}
+
 	c.JSON(http.StatusCreated, backend)
 }
 
@@ -113,9 +157,10 @@ func (h *BackendHandler) update(c *gin.Context) {
 	}
 
 	type request struct {
-		Name   string  `json:"name"`
-		URL    string  `json:"url"`
-		APIKey *string `json:"apiKey"`
+		Name            string  `json:"name"`
+		URL             string  `json:"url"`
+		APIKey          *string `json:"apiKey"`
+		CertFingerprint *string `json:"certFingerprint"`
 	}
 
 	var body request
@@ -147,6 +192,11 @@ func (h *BackendHandler) update(c *gin.Context) {
 		return
 	}
 
+	// A pin belongs to the server it was taken from; a new URL is pinned
+	// again on first use unless a fingerprint is supplied.
+	if body.URL != backend.URL {
+		backend.CertFingerprint = ""
+	}
 	backend.Name = body.Name
 	backend.URL = body.URL
 
@@ -159,6 +209,20 @@ func (h *BackendHandler) update(c *gin.Context) {
 		backend.APIKey = apiKey
 	}
 
+	if body.CertFingerprint != nil {
+		raw := strings.TrimSpace(*body.CertFingerprint)
+		if raw == "" {
+			backend.CertFingerprint = ""
+		} else {
+			fp, err := relay.NormalizeFingerprint(raw)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, "Invalid certificate fingerprint.", err.Error())
+				return
+			}
+			backend.CertFingerprint = fp
+		}
+	}
+
 	if err := h.repo.Update(ctx, *backend); err != nil {
 		if isUniqueViolation(err) {
 			writeError(c, http.StatusConflict, "A backend with this URL already exists.", nil)
@@ -169,9 +233,71 @@ func (h *BackendHandler) update(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":   backend.ID,
-		"name": backend.Name,
-		"url":  backend.URL,
+		"id":              backend.ID,
+		"name":            backend.Name,
+		"url":             backend.URL,
+		"certFingerprint": backend.CertFingerprint,
+	})
+}
+
+// repin replaces the pinned certificate fingerprint, either with the value
+// supplied in the body or with whatever the backend currently presents.
+func (h *BackendHandler) repin(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		writeError(c, http.StatusBadRequest, "Missing backend ID.", nil)
+		return
+	}
+
+	type request struct {
+		CertFingerprint string `json:"certFingerprint"`
+	}
+
+	var body request
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			writeError(c, http.StatusBadRequest, "Invalid payload.", nil)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	backend, err := h.repo.Get(ctx, id)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to fetch backend.", err.Error())
+		return
+	}
+	if backend == nil {
+		writeError(c, http.StatusNotFound, "Backend configuration not found.", nil)
+		return
+	}
+
+	var fp string
+	if strings.TrimSpace(body.CertFingerprint) != "" {
+		fp, err = relay.NormalizeFingerprint(body.CertFingerprint)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, "Invalid certificate fingerprint.", err.Error())
+			return
+		}
+	} else {
+		fp, err = h.relay.Probe(ctx, backend)
+		if err != nil {
+			writeError(c, http.StatusBadGateway, "Failed to read backend certificate.", err.Error())
+			return
+		}
+	}
+
+	previous := backend.CertFingerprint
+	backend.CertFingerprint = fp
+	if err := h.repo.Update(ctx, *backend); err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to update backend.", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                      backend.ID,
+		"certFingerprint":         fp,
+		"previousCertFingerprint": previous,
 	})
 }
 
@@ -189,3 +315,74 @@ func isUniqueViolation(err error) bool {
 	}
 	return strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
+
+// issueClientCert enrolls a backend for mutual TLS by issuing a fresh client
+// certificate from the internal CA. The private key never leaves the gateway;
+// the response carries the CA certificate to configure as the backend's
+// TLS_CLIENT_CA_PATH and the fingerprint to pin in its MTLS_ALLOWED_CLIENTS.
+func (h *BackendHandler) issueClientCert(c *gin.Context) {
+	backend, ok := h.loadBackend(c)
+	if !ok {
+		return
+	}
+
+	issued, err := h.authority.IssueClient(clientCommonName(backend.ID))
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to issue client certificate.", err.Error())
+		return
+	}
+
+	if err := h.repo.SetClientCert(c.Request.Context(), backend.ID, issued.Certificate, issued.PrivateKey); err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to update backend.", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                backend.ID,
+		"clientCertificate": issued.Certificate,
+		"caCertificate":     issued.CA,
+		"clientFingerprint": issued.Fingerprint,
+		"notAfter":          issued.NotAfter,
+	})
+}
+
+func (h *BackendHandler) removeClientCert(c *gin.Context) {
+	backend, ok := h.loadBackend(c)
+	if !ok {
+		return
+	}
+	if backend.APIKey == "" {
+		writeError(c, http.StatusConflict, "Backend has no API key; removing its client certificate would leave it without credentials.", nil)
+		return
+	}
+
+	if err := h.repo.SetClientCert(c.Request.Context(), backend.ID, "", ""); err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to update backend.", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Client certificate removed"})
+}
+
+func (h *BackendHandler) loadBackend(c *gin.Context) (*models.Backend, bool) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		writeError(c, http.StatusBadRequest, "Missing backend ID.", nil)
+		return nil, false
+	}
+
+	backend, err := h.repo.Get(c.Request.Context(), id)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to fetch backend.", err.Error())
+		return nil, false
+	}
+	if backend == nil {
+		writeError(c, http.StatusNotFound, "Backend configuration not found.", nil)
+		return nil, false
+	}
+	return backend, true
+}
+
+func clientCommonName(backendID string) string {
+	return "ufw-panel-frontend:" + backendID
+}
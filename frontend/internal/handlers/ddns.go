@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerHostRules(rg *gin.RouterGroup) {
+	rg.GET("/ddns", h.listHostRules)
+	rg.POST("/ddns", h.createHostRule)
+	rg.GET("/ddns/:hostRuleId", h.getHostRule)
+	rg.DELETE("/ddns/:hostRuleId", h.deleteHostRule)
+	rg.POST("/ddns/:hostRuleId/resolve", h.resolveHostRule)
+}
+
+func hostRulePath(c *gin.Context, suffix string) string {
+	return "/ddns/" + url.PathEscape(c.Param("hostRuleId")) + suffix
+}
+
+func (h *FirewallHandler) listHostRules(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/ddns", "Failed to list hostname rules")
+}
+
+func (h *FirewallHandler) createHostRule(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, "/ddns"), "Failed to create hostname rule", "hostname", "action")
+}
+
+func (h *FirewallHandler) getHostRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, hostRulePath(c, ""), "Failed to fetch hostname rule")
+}
+
+func (h *FirewallHandler) deleteHostRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, withBackendQuery(c, hostRulePath(c, "")), "Failed to delete hostname rule")
+}
+
+func (h *FirewallHandler) resolveHostRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, hostRulePath(c, "/resolve"), "Failed to refresh hostname rule")
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerEvents(rg *gin.RouterGroup) {
+	rg.GET("/events/stream", h.streamEvents)
+}
+
+// streamEvents relays the backend's live event stream. EventSource sends
+// Last-Event-ID when it reconnects; it is passed on as last_event_id so the
+// backend replays what the client missed.
+func (h *FirewallHandler) streamEvents(c *gin.Context) {
+	path := withBackendQuery(c, "/events/stream", append(trafficFilterParams, "types", "last_event_id")...)
+	if id := c.GetHeader("Last-Event-ID"); id != "" && c.Query("last_event_id") == "" {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "last_event_id=" + url.QueryEscape(id)
+	}
+	h.forwardEventStream(c, path, "Failed to open event stream")
+}
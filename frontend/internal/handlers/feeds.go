@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerFeeds(rg *gin.RouterGroup) {
+	rg.GET("/feeds", h.listFeeds)
+	rg.POST("/feeds", h.createFeed)
+	rg.GET("/feeds/:feedName", h.getFeed)
+	rg.DELETE("/feeds/:feedName", h.deleteFeed)
+	rg.POST("/feeds/:feedName/sync", h.syncFeed)
+}
+
+func feedPath(c *gin.Context, suffix string) string {
+	return "/feeds/" + url.PathEscape(c.Param("feedName")) + suffix
+}
+
+func (h *FirewallHandler) listFeeds(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/feeds", "Failed to list feeds")
+}
+
+func (h *FirewallHandler) createFeed(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/feeds", "Failed to create feed", "name", "source")
+}
+
+func (h *FirewallHandler) getFeed(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, feedPath(c, ""), "Failed to fetch feed")
+}
+
+func (h *FirewallHandler) deleteFeed(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, feedPath(c, ""), "Failed to delete feed")
+}
+
+func (h *FirewallHandler) syncFeed(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, feedPath(c, "/sync"), "Failed to start feed sync")
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -32,6 +35,31 @@ func (h *FirewallHandler) Register(rg *gin.RouterGroup) {
 	rg.POST("/rules/allow/ip", h.allowIP)
 	rg.POST("/rules/deny/ip", h.denyIP)
 	rg.DELETE("/rules/delete/:ruleNumber", h.deleteRule)
+	rg.POST("/default", h.setDefault)
+	rg.POST("/rules/batch", h.batch)
+	rg.GET("/pending", h.pending)
+	rg.POST("/confirm/:changeId", h.confirm)
+	rg.POST("/rollback/:changeId", h.rollback)
+	rg.GET("/drift", h.drift)
+	rg.POST("/drift/ack", h.ackDrift)
+	rg.GET("/audit", h.audit)
+	rg.GET("/audit/verify", h.verifyAudit)
+	rg.GET("/rules/expiring", h.expiringRules)
+	rg.POST("/rules/expiring/:expiryId/extend", h.extendExpiry)
+	rg.DELETE("/rules/expiring/:expiryId", h.cancelExpiry)
+	h.registerSnapshots(rg)
+	h.registerRulesets(rg)
+	h.registerSchedules(rg)
+	h.registerGroups(rg)
+	h.registerIPSets(rg)
+	h.registerFeeds(rg)
+	h.registerAllowlists(rg)
+	h.registerGeoIP(rg)
+	h.registerHostRules(rg)
+	h.registerJails(rg)
+	h.registerPortScan(rg)
+	h.registerTraffic(rg)
+	h.registerEvents(rg)
 }
 
 func (h *FirewallHandler) status(c *gin.Context) {
@@ -40,7 +68,7 @@ func (h *FirewallHandler) status(c *gin.Context) {
 		return
 	}
 
-	resp, err := h.relay.Forward(c.Request.Context(), backend, http.MethodGet, "/status", nil)
+	resp, err := h.forward(c.Request.Context(), backend, http.MethodGet, "/status", nil)
 	if err != nil {
 		writeError(c, http.StatusInternalServerError, "Failed to fetch status from backend.", err.Error())
 		return
@@ -77,14 +105,24 @@ func (h *FirewallHandler) status(c *gin.Context) {
 		rules = []any{}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	out := gin.H{
 		"status": status,
 		"rules":  rules,
-	})
+	}
+	if protected, ok := payload["protected"]; ok {
+		out["protected"] = protected
+	}
+	if drift, ok := payload["drift"]; ok {
+		out["drift"] = drift
+	}
+	if expiring, ok := payload["expiring"]; ok {
+		out["expiring"] = expiring
+	}
+	c.JSON(http.StatusOK, out)
 }
 
 func (h *FirewallHandler) enable(c *gin.Context) {
-	h.forwardWithoutBody(c, http.MethodPost, "/enable", "Failed to enable UFW")
+	h.forwardWithoutBody(c, http.MethodPost, withBackendQuery(c, "/enable"), "Failed to enable UFW")
 }
 
 func (h *FirewallHandler) disable(c *gin.Context) {
@@ -113,7 +151,73 @@ func (h *FirewallHandler) deleteRule(c *gin.Context) {
 		writeError(c, http.StatusBadRequest, "Missing rule number.", nil)
 		return
 	}
-	h.forwardWithoutBody(c, http.MethodDelete, fmt.Sprintf("/rules/delete/%s", ruleNumber), "Failed to delete rule")
+	h.forwardWithoutBody(c, http.MethodDelete, withBackendQuery(c, fmt.Sprintf("/rules/delete/%s", ruleNumber)), "Failed to delete rule")
+}
+
+func (h *FirewallHandler) setDefault(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, "/default"), "Failed to set default policy", "direction", "policy")
+}
+
+func (h *FirewallHandler) batch(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, "/rules/batch"), "Failed to apply batch", "operations")
+}
+
+func (h *FirewallHandler) pending(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/pending", "Failed to fetch pending change")
+}
+
+func (h *FirewallHandler) confirm(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, "/confirm/"+url.PathEscape(c.Param("changeId")), "Failed to confirm change")
+}
+
+func (h *FirewallHandler) rollback(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, "/rollback/"+url.PathEscape(c.Param("changeId")), "Failed to roll back change")
+}
+
+func (h *FirewallHandler) drift(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, withBackendQuery(c, "/drift", "all"), "Failed to fetch drift report")
+}
+
+func (h *FirewallHandler) ackDrift(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/drift/ack", "Failed to acknowledge drift")
+}
+
+func (h *FirewallHandler) audit(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, withBackendQuery(c, "/audit", "since", "until", "action", "key", "limit"), "Failed to fetch audit log")
+}
+
+func (h *FirewallHandler) verifyAudit(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/audit/verify", "Failed to verify audit log")
+}
+
+func (h *FirewallHandler) expiringRules(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/rules/expiring", "Failed to fetch expiring rules")
+}
+
+func (h *FirewallHandler) extendExpiry(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/rules/expiring/"+url.PathEscape(c.Param("expiryId"))+"/extend", "Failed to extend rule expiry")
+}
+
+func (h *FirewallHandler) cancelExpiry(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, withBackendQuery(c, "/rules/expiring/"+url.PathEscape(c.Param("expiryId")), "remove"), "Failed to cancel rule expiry")
+}
+
+// backendQueryParams are passed through to the backend: force overrides its
+// lockout protection and confirm_timeout makes a change revert unless it is
+// confirmed.
+var backendQueryParams = []string{"force", "confirm_timeout"}
+
+func withBackendQuery(c *gin.Context, path string, extra ...string) string {
+	q := url.Values{}
+	for _, key := range append(backendQueryParams, extra...) {
+		if v := c.Query(key); v != "" {
+			q.Set(key, v)
+		}
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
 }
 
 func (h *FirewallHandler) forwardWithoutBody(c *gin.Context, method, path, errMsg string) {
@@ -122,7 +226,7 @@ func (h *FirewallHandler) forwardWithoutBody(c *gin.Context, method, path, errMs
 		return
 	}
 
-	resp, err := h.relay.Forward(c.Request.Context(), backend, method, path, nil)
+	resp, err := h.forward(c.Request.Context(), backend, method, path, nil)
 	if err != nil {
 		writeError(c, http.StatusInternalServerError, errMsg, err.Error())
 		return
@@ -151,7 +255,7 @@ func (h *FirewallHandler) forwardWithBody(c *gin.Context, method, path, errMsg s
 		}
 	}
 
-	resp, err := h.relay.Forward(c.Request.Context(), backend, method, path, payload)
+	resp, err := h.forward(c.Request.Context(), backend, method, path, payload)
 	if err != nil {
 		writeError(c, http.StatusInternalServerError, errMsg, err.Error())
 		return
@@ -161,6 +265,104 @@ func (h *FirewallHandler) forwardWithBody(c *gin.Context, method, path, errMsg s
 	handleProxyResponse(c, resp, errMsg)
 }
 
+// forwardStream relays a request whose successful response is not JSON, such
+// as a download, and copies it to the client unchanged.
+func (h *FirewallHandler) forwardStream(c *gin.Context, method, path string, body any, errMsg string) {
+	backend, ok := h.lookupBackend(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.forward(c.Request.Context(), backend, method, path, body)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, errMsg, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		handleProxyResponse(c, resp, errMsg)
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Disposition"} {
+		if v := resp.Header.Get(header); v != "" {
+			c.Header(header, v)
+		}
+	}
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		log.Printf("warning: relaying %s %s interrupted: %v", method, path, err)
+	}
+}
+
+// forwardEventStream relays a text/event-stream response, flushing each
+// chunk to the client as it arrives instead of buffering the response. It
+// returns when either side closes the stream.
+func (h *FirewallHandler) forwardEventStream(c *gin.Context, path, errMsg string) {
+	backend, ok := h.lookupBackend(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.relay.Stream(c.Request.Context(), backend, http.MethodGet, path)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, errMsg, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		handleProxyResponse(c, resp, errMsg)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(resp.StatusCode)
+	c.Writer.Flush()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			if err != io.EOF && c.Request.Context().Err() == nil {
+				log.Printf("warning: relaying event stream %s interrupted: %v", path, err)
+			}
+			return
+		}
+	}
+}
+
+// forward relays a request and, on the first successful exchange with a
+// backend that has no pinned certificate yet, pins the one it presented.
+func (h *FirewallHandler) forward(ctx context.Context, backend *models.Backend, method, path string, body any) (*http.Response, error) {
+	resp, err := h.relay.Forward(ctx, backend, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend.CertFingerprint == "" && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if fp := relay.PeerFingerprint(resp); fp != "" {
+			pinned, err := h.repo.PinCertificate(ctx, backend.ID, fp)
+			if err != nil {
+				log.Printf("warning: failed to pin certificate for backend %s: %v", backend.ID, err)
+			} else if pinned {
+				backend.CertFingerprint = fp
+				log.Printf("pinned certificate %s for backend %s", fp, backend.ID)
+			}
+		}
+	}
+
+	return resp, nil
+}
+
 func (h *FirewallHandler) lookupBackend(c *gin.Context) (*models.Backend, bool) {
 	backendID := c.Query("backendId")
 	if backendID == "" {
@@ -174,8 +376,8 @@ func (h *FirewallHandler) lookupBackend(c *gin.Context) (*models.Backend, bool)
 		return nil, false
 	}
 
-	if backend == nil || backend.URL == "" || backend.APIKey == "" {
-		writeError(c, http.StatusUnauthorized, "Backend not configured or API key/URL is missing.", nil)
+	if backend == nil || backend.URL == "" || (backend.APIKey == "" && backend.ClientCert == "") {
+		writeError(c, http.StatusUnauthorized, "Backend not configured or credentials/URL are missing.", nil)
 		return nil, false
 	}
 
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerGeoIP(rg *gin.RouterGroup) {
+	rg.GET("/geoip", h.getGeoIP)
+	rg.GET("/geoip/countries", h.listGeoIPCountries)
+	rg.POST("/geoip/reload", h.reloadGeoIP)
+	rg.POST("/geoip/rules", h.createGeoIPRule)
+	rg.GET("/geoip/rules/:geoRuleName", h.getGeoIPRule)
+	rg.DELETE("/geoip/rules/:geoRuleName", h.deleteGeoIPRule)
+}
+
+func geoIPRulePath(c *gin.Context) string {
+	return "/geoip/rules/" + url.PathEscape(c.Param("geoRuleName"))
+}
+
+func (h *FirewallHandler) getGeoIP(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/geoip", "Failed to fetch GeoIP status")
+}
+
+func (h *FirewallHandler) listGeoIPCountries(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/geoip/countries", "Failed to list GeoIP countries")
+}
+
+func (h *FirewallHandler) reloadGeoIP(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, "/geoip/reload", "Failed to reload GeoIP database")
+}
+
+func (h *FirewallHandler) createGeoIPRule(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, "/geoip/rules"), "Failed to create GeoIP rule", "name", "action")
+}
+
+func (h *FirewallHandler) getGeoIPRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, geoIPRulePath(c), "Failed to fetch GeoIP rule")
+}
+
+func (h *FirewallHandler) deleteGeoIPRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, geoIPRulePath(c), "Failed to delete GeoIP rule")
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerGroups(rg *gin.RouterGroup) {
+	rg.GET("/groups", h.listGroups)
+	rg.POST("/groups", h.createGroup)
+	rg.GET("/groups/:groupName", h.getGroup)
+	rg.DELETE("/groups/:groupName", h.deleteGroup)
+	rg.POST("/groups/:groupName/members", h.updateGroupMembers)
+	rg.POST("/groups/:groupName/rules", h.bindGroupRule)
+	rg.DELETE("/groups/:groupName/rules/:bindingId", h.unbindGroupRule)
+}
+
+func groupPath(c *gin.Context, suffix string) string {
+	return "/groups/" + url.PathEscape(c.Param("groupName")) + suffix
+}
+
+func (h *FirewallHandler) listGroups(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/groups", "Failed to list address groups")
+}
+
+func (h *FirewallHandler) createGroup(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/groups", "Failed to create address group", "name")
+}
+
+func (h *FirewallHandler) getGroup(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, groupPath(c, ""), "Failed to fetch address group")
+}
+
+func (h *FirewallHandler) deleteGroup(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, groupPath(c, ""), "Failed to delete address group")
+}
+
+func (h *FirewallHandler) updateGroupMembers(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, groupPath(c, "/members")), "Failed to update address group")
+}
+
+func (h *FirewallHandler) bindGroupRule(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, withBackendQuery(c, groupPath(c, "/rules")), "Failed to bind rule to address group", "action")
+}
+
+func (h *FirewallHandler) unbindGroupRule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, withBackendQuery(c, groupPath(c, "/rules/"+url.PathEscape(c.Param("bindingId")))), "Failed to unbind rule from address group")
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxIPSetUploadBytes = 32 << 20
+
+func (h *FirewallHandler) registerIPSets(rg *gin.RouterGroup) {
+	rg.GET("/ipsets", h.listIPSets)
+	rg.POST("/ipsets", h.createIPSet)
+	rg.GET("/ipsets/:setName", h.getIPSet)
+	rg.DELETE("/ipsets/:setName", h.deleteIPSet)
+	rg.POST("/ipsets/:setName/entries", h.updateIPSetEntries)
+	rg.PUT("/ipsets/:setName/entries", h.loadIPSetEntries)
+}
+
+func ipsetPath(c *gin.Context, suffix string) string {
+	return "/ipsets/" + url.PathEscape(c.Param("setName")) + suffix
+}
+
+func (h *FirewallHandler) listIPSets(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/ipsets", "Failed to list ipsets")
+}
+
+func (h *FirewallHandler) createIPSet(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/ipsets", "Failed to create ipset", "name")
+}
+
+func (h *FirewallHandler) getIPSet(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, ipsetPath(c, ""), "Failed to fetch ipset")
+}
+
+func (h *FirewallHandler) deleteIPSet(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, ipsetPath(c, ""), "Failed to delete ipset")
+}
+
+func (h *FirewallHandler) updateIPSetEntries(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, ipsetPath(c, "/entries"), "Failed to update ipset")
+}
+
+// loadIPSetEntries relays a bulk upload, JSON or plain text, as is.
+func (h *FirewallHandler) loadIPSetEntries(c *gin.Context) {
+	h.forwardRawBody(c, http.MethodPut, ipsetPath(c, "/entries"), maxIPSetUploadBytes, "Missing or oversized entry list.", "Failed to load ipset")
+}
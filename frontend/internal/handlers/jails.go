@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerJails(rg *gin.RouterGroup) {
+	rg.GET("/bans", h.listBans)
+	rg.GET("/jails", h.listJails)
+	rg.POST("/jails", h.createJail)
+	rg.POST("/jails/test", h.testJail)
+	rg.GET("/jails/:jailName", h.getJail)
+	rg.DELETE("/jails/:jailName", h.deleteJail)
+}
+
+func jailPath(c *gin.Context) string {
+	return "/jails/" + url.PathEscape(c.Param("jailName"))
+}
+
+func (h *FirewallHandler) listBans(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/bans", "Failed to list bans")
+}
+
+func (h *FirewallHandler) listJails(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/jails", "Failed to list jails")
+}
+
+func (h *FirewallHandler) createJail(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/jails", "Failed to create jail", "name")
+}
+
+func (h *FirewallHandler) testJail(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/jails/test", "Failed to test jail patterns")
+}
+
+func (h *FirewallHandler) getJail(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, jailPath(c), "Failed to fetch jail")
+}
+
+func (h *FirewallHandler) deleteJail(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, jailPath(c), "Failed to delete jail")
+}
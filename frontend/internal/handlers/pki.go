@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ufwpanel/frontend/internal/services/pki"
+)
+
+type PKIHandler struct {
+	authority *pki.Authority
+}
+
+func NewPKIHandler(authority *pki.Authority) *PKIHandler {
+	return &PKIHandler{authority: authority}
+}
+
+func (h *PKIHandler) Register(rg *gin.RouterGroup) {
+	rg.GET("/pki/ca", h.caCertificate)
+	rg.POST("/pki/server-cert", h.issueServerCert)
+}
+
+func (h *PKIHandler) caCertificate(c *gin.Context) {
+	certPEM, err := h.authority.CACertificatePEM()
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to load CA certificate.", err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "application/x-pem-file", certPEM)
+}
+
+func (h *PKIHandler) issueServerCert(c *gin.Context) {
+	type request struct {
+		Hosts []string `json:"hosts"`
+	}
+
+	var body request
+	if err := c.ShouldBindJSON(&body); err != nil {
+		writeError(c, http.StatusBadRequest, "Invalid payload.", nil)
+		return
+	}
+
+	var hosts []string
+	for _, host := range body.Hosts {
+		if trimmed := strings.TrimSpace(host); trimmed != "" {
+			hosts = append(hosts, trimmed)
+		}
+	}
+	if len(hosts) == 0 {
+		writeError(c, http.StatusBadRequest, "Missing required field: hosts.", nil)
+		return
+	}
+
+	issued, err := h.authority.IssueServer(hosts)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, "Failed to issue server certificate.", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, issued)
+}
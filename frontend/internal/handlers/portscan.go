@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerPortScan(rg *gin.RouterGroup) {
+	rg.GET("/portscan", h.getPortScan)
+	rg.PUT("/portscan", h.updatePortScan)
+}
+
+func (h *FirewallHandler) getPortScan(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/portscan", "Failed to fetch port-scan detection")
+}
+
+func (h *FirewallHandler) updatePortScan(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPut, "/portscan", "Failed to update port-scan detection")
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"ufwpanel/frontend/internal/services/relay"
+)
+
+const maxRulesetBytes = 4 << 20
+
+func (h *FirewallHandler) registerRulesets(rg *gin.RouterGroup) {
+	rg.GET("/export", h.exportRuleset)
+	rg.POST("/import", h.importRuleset)
+	rg.POST("/plans", h.createPlan)
+	rg.GET("/plans/:planId", h.getPlan)
+	rg.POST("/plans/:planId/apply", h.applyPlan)
+	rg.DELETE("/plans/:planId", h.discardPlan)
+}
+
+func planPath(c *gin.Context, suffix string) string {
+	return "/plans/" + url.PathEscape(c.Param("planId")) + suffix
+}
+
+// exportRuleset relays GET /export; YAML and script exports are not JSON, so
+// the response is streamed unchanged.
+func (h *FirewallHandler) exportRuleset(c *gin.Context) {
+	h.forwardStream(c, http.MethodGet, withBackendQuery(c, "/export", "format"), nil, "Failed to export ruleset")
+}
+
+// importRuleset relays the JSON or YAML document as is.
+func (h *FirewallHandler) importRuleset(c *gin.Context) {
+	h.forwardRuleset(c, withBackendQuery(c, "/import", "mode", "dry_run"), "Failed to import ruleset")
+}
+
+// createPlan relays a desired-state document to be planned by the backend.
+func (h *FirewallHandler) createPlan(c *gin.Context) {
+	h.forwardRuleset(c, "/plans", "Failed to create plan")
+}
+
+func (h *FirewallHandler) getPlan(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, planPath(c, ""), "Failed to fetch plan")
+}
+
+func (h *FirewallHandler) applyPlan(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, withBackendQuery(c, planPath(c, "/apply")), "Failed to apply plan")
+}
+
+func (h *FirewallHandler) discardPlan(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, planPath(c, ""), "Failed to discard plan")
+}
+
+func (h *FirewallHandler) forwardRuleset(c *gin.Context, path, errMsg string) {
+	h.forwardRawBody(c, http.MethodPost, path, maxRulesetBytes, "Missing or oversized ruleset document.", errMsg)
+}
+
+// forwardRawBody relays a non-empty body of at most maxBytes unchanged,
+// with its Content-Type.
+func (h *FirewallHandler) forwardRawBody(c *gin.Context, method, path string, maxBytes int64, invalidMsg, errMsg string) {
+	backend, ok := h.lookupBackend(c)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+	if err != nil || len(data) == 0 || int64(len(data)) > maxBytes {
+		writeError(c, http.StatusBadRequest, invalidMsg, nil)
+		return
+	}
+
+	body := relay.RawBody{ContentType: c.ContentType(), Data: data}
+	resp, err := h.forward(c.Request.Context(), backend, method, path, body)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, errMsg, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	handleProxyResponse(c, resp, errMsg)
+}
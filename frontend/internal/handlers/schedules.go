@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerSchedules(rg *gin.RouterGroup) {
+	rg.GET("/schedules", h.listSchedules)
+	rg.POST("/schedules", h.createSchedule)
+	rg.GET("/schedules/transitions", h.scheduleTransitions)
+	rg.GET("/schedules/:scheduleId", h.getSchedule)
+	rg.DELETE("/schedules/:scheduleId", h.deleteSchedule)
+}
+
+func schedulePath(c *gin.Context) string {
+	return "/schedules/" + url.PathEscape(c.Param("scheduleId"))
+}
+
+func (h *FirewallHandler) listSchedules(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/schedules", "Failed to list schedules")
+}
+
+func (h *FirewallHandler) createSchedule(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/schedules", "Failed to create schedule", "name", "op", "windows")
+}
+
+func (h *FirewallHandler) scheduleTransitions(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, withBackendQuery(c, "/schedules/transitions", "within"), "Failed to fetch schedule transitions")
+}
+
+func (h *FirewallHandler) getSchedule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, schedulePath(c), "Failed to fetch schedule")
+}
+
+func (h *FirewallHandler) deleteSchedule(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, schedulePath(c), "Failed to delete schedule")
+}
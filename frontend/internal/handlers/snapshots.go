@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FirewallHandler) registerSnapshots(rg *gin.RouterGroup) {
+	rg.GET("/snapshots", h.listSnapshots)
+	rg.POST("/snapshots", h.createSnapshot)
+	rg.GET("/snapshots/:snapshotId", h.getSnapshot)
+	rg.GET("/snapshots/:snapshotId/diff", h.diffSnapshot)
+	rg.GET("/snapshots/:snapshotId/download", h.downloadSnapshot)
+	rg.POST("/snapshots/:snapshotId/restore", h.restoreSnapshot)
+	rg.DELETE("/snapshots/:snapshotId", h.deleteSnapshot)
+}
+
+func snapshotPath(c *gin.Context, suffix string) string {
+	return "/snapshots/" + url.PathEscape(c.Param("snapshotId")) + suffix
+}
+
+func (h *FirewallHandler) listSnapshots(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, "/snapshots", "Failed to list snapshots")
+}
+
+func (h *FirewallHandler) createSnapshot(c *gin.Context) {
+	h.forwardWithBody(c, http.MethodPost, "/snapshots", "Failed to create snapshot", "name")
+}
+
+func (h *FirewallHandler) getSnapshot(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, snapshotPath(c, ""), "Failed to fetch snapshot")
+}
+
+func (h *FirewallHandler) diffSnapshot(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodGet, withBackendQuery(c, snapshotPath(c, "/diff"), "to"), "Failed to diff snapshot")
+}
+
+func (h *FirewallHandler) restoreSnapshot(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodPost, withBackendQuery(c, snapshotPath(c, "/restore")), "Failed to restore snapshot")
+}
+
+func (h *FirewallHandler) deleteSnapshot(c *gin.Context) {
+	h.forwardWithoutBody(c, http.MethodDelete, snapshotPath(c, ""), "Failed to delete snapshot")
+}
+
+func (h *FirewallHandler) downloadSnapshot(c *gin.Context) {
+	h.forwardStream(c, http.MethodGet, snapshotPath(c, "/download"), nil, "Failed to download snapshot")
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trafficFilterParams are the filters shared by the traffic endpoints.
+var trafficFilterParams = []string{"action", "src", "dst", "port", "proto", "in", "since", "until"}
+
+func (h *FirewallHandler) registerTraffic(rg *gin.RouterGroup) {
+	rg.GET("/traffic/events", h.listTrafficEvents)
+	rg.GET("/traffic/stats", h.getTrafficStats)
+}
+
+func (h *FirewallHandler) listTrafficEvents(c *gin.Context) {
+	path := withBackendQuery(c, "/traffic/events", append(trafficFilterParams, "limit")...)
+	h.forwardWithoutBody(c, http.MethodGet, path, "Failed to list traffic events")
+}
+
+func (h *FirewallHandler) getTrafficStats(c *gin.Context) {
+	path := withBackendQuery(c, "/traffic/stats", append(trafficFilterParams, "top", "bucket")...)
+	h.forwardWithoutBody(c, http.MethodGet, path, "Failed to fetch traffic stats")
+}
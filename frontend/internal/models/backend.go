@@ -1,8 +1,12 @@
 package models
 
 type Backend struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	URL    string `json:"url"`
-	APIKey string `json:"apiKey,omitempty"`
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	URL             string `json:"url"`
+	APIKey          string `json:"apiKey,omitempty"`
+	CertFingerprint string `json:"certFingerprint,omitempty"`
+	ClientCert      string `json:"-"`
+	ClientKey       string `json:"-"`
+	HasClientCert   bool   `json:"hasClientCert,omitempty"`
 }
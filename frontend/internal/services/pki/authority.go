@@ -0,0 +1,245 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 2 * 365 * 24 * time.Hour
+)
+
+// Authority is a small internal CA used to enroll backends for mutual TLS.
+// The CA key pair is created lazily on first use and kept in dir.
+type Authority struct {
+	dir string
+
+	mu      sync.Mutex
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// Issued is a freshly issued certificate and its private key, PEM encoded.
+type Issued struct {
+	Certificate string    `json:"certificate"`
+	PrivateKey  string    `json:"privateKey"`
+	CA          string    `json:"caCertificate"`
+	NotAfter    time.Time `json:"notAfter"`
+	// Fingerprint is the hex SHA-256 of the certificate's public key (SPKI),
+	// the value a backend pins in MTLS_ALLOWED_CLIENTS.
+	Fingerprint string `json:"fingerprint"`
+}
+
+func NewAuthority(dir string) *Authority {
+	return &Authority{dir: dir}
+}
+
+// CACertificatePEM returns the CA certificate, creating the CA if needed.
+func (a *Authority) CACertificatePEM() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a.certPEM, nil
+}
+
+// IssueClient issues a client-auth certificate for the gateway to present to
+// one backend.
+func (a *Authority) IssueClient(commonName string) (*Issued, error) {
+	return a.issue(commonName, nil, x509.ExtKeyUsageClientAuth)
+}
+
+// IssueServer issues a server-auth certificate for a backend's TLS listener.
+// Each host is added as an IP or DNS subject alternative name.
+func (a *Authority) IssueServer(hosts []string) (*Issued, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("at least one host is required")
+	}
+	return a.issue(hosts[0], hosts, x509.ExtKeyUsageServerAuth)
+}
+
+func (a *Authority) issue(commonName string, hosts []string, usage x509.ExtKeyUsage) (*Issued, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"UFW-Panel"},
+			CommonName:   commonName,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("sign certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(spki)
+
+	return &Issued{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CA:          string(a.certPEM),
+		NotAfter:    template.NotAfter,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func (a *Authority) load() error {
+	if a.cert != nil {
+		return nil
+	}
+
+	certPath := filepath.Join(a.dir, caCertFile)
+	keyPath := filepath.Join(a.dir, caKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		return a.create(certPath, keyPath)
+	}
+	if certErr != nil {
+		return fmt.Errorf("read CA certificate: %w", certErr)
+	}
+	if keyErr != nil {
+		return fmt.Errorf("read CA key: %w", keyErr)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return fmt.Errorf("invalid CA certificate PEM in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("parse CA certificate: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return fmt.Errorf("invalid CA key PEM in %s", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("parse CA key: %w", err)
+	}
+
+	a.cert, a.key, a.certPEM = cert, key, certPEM
+	return nil
+}
+
+func (a *Authority) create(certPath, keyPath string) error {
+	if err := os.MkdirAll(a.dir, 0o700); err != nil {
+		return fmt.Errorf("create PKI directory: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"UFW-Panel"},
+			CommonName:   "UFW-Panel Internal CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("parse CA certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal CA key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("write CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return fmt.Errorf("write CA certificate: %w", err)
+	}
+
+	a.cert, a.key, a.certPEM = cert, key, certPEM
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -10,30 +10,92 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"ufwpanel/frontend/internal/models"
 )
 
 type Client struct {
-	http *http.Client
+	timeout      time.Duration
+	signRequests bool
+
+	mu         sync.Mutex
+	transports map[string]*backendTransport
+}
+
+type backendTransport struct {
+	fingerprint string
+	clientCert  string
+	client      *http.Client
 }
 
-func NewClient(timeout time.Duration) *Client {
+func NewClient(timeout time.Duration, signRequests bool) *Client {
+	return &Client{
+		timeout:      timeout,
+		signRequests: signRequests,
+		transports:   make(map[string]*backendTransport),
+	}
+}
+
+// clientFor returns an HTTP client whose TLS handshake enforces the backend's
+// pinned fingerprint and presents its client certificate, if any. Clients are
+// cached per backend and rebuilt when either changes so stale keep-alive
+// connections are not reused.
+func (c *Client) clientFor(backend *models.Backend) (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.transports[backend.ID]; ok {
+		if t.fingerprint == backend.CertFingerprint && t.clientCert == backend.ClientCert {
+			return t.client, nil
+		}
+		t.client.CloseIdleConnections()
+		delete(c.transports, backend.ID)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   verifyPin(backend.CertFingerprint),
+	}
+	if backend.ClientCert != "" {
+		pair, err := tls.X509KeyPair([]byte(backend.ClientCert), []byte(backend.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
 	transport := &http.Transport{
 		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
 	}
-
-	return &Client{
-		http: &http.Client{
-			Timeout:   timeout,
-			Transport: transport,
-		},
+	client := &http.Client{Timeout: c.timeout, Transport: transport}
+	c.transports[backend.ID] = &backendTransport{
+		fingerprint: backend.CertFingerprint,
+		clientCert:  backend.ClientCert,
+		client:      client,
 	}
+	return client, nil
+}
+
+// RawBody is a request body forwarded as is instead of being encoded as JSON.
+type RawBody struct {
+	ContentType string
+	Data        []byte
 }
 
 func (c *Client) Forward(ctx context.Context, backend *models.Backend, method, path string, body any) (*http.Response, error) {
+	return c.do(ctx, backend, method, path, body, true)
+}
+
+// Stream is Forward without the client timeout, for long-lived responses
+// such as event streams. The response ends when ctx is cancelled.
+func (c *Client) Stream(ctx context.Context, backend *models.Backend, method, path string) (*http.Response, error) {
+	return c.do(ctx, backend, method, path, nil, false)
+}
+
+func (c *Client) do(ctx context.Context, backend *models.Backend, method, path string, body any, timeout bool) (*http.Response, error) {
 	if backend == nil {
 		return nil, fmt.Errorf("missing backend configuration")
 	}
@@ -42,16 +104,25 @@ func (c *Client) Forward(ctx context.Context, backend *models.Backend, method, p
 	if err != nil {
 		return nil, err
 	}
+	if backend.CertFingerprint != "" && !strings.HasPrefix(strings.ToLower(fullURL), "https://") {
+		return nil, fmt.Errorf("backend has a pinned certificate but URL is not https")
+	}
 
 	var reader io.ReadCloser
-	if body != nil {
-		payload, err := json.Marshal(body)
+	var payload []byte
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+		reader = http.NoBody
+	case RawBody:
+		payload, contentType = b.Data, b.ContentType
+		reader = io.NopCloser(bytes.NewReader(payload))
+	default:
+		payload, err = json.Marshal(body)
 		if err != nil {
 			return nil, fmt.Errorf("marshal payload: %w", err)
 		}
 		reader = io.NopCloser(bytes.NewReader(payload))
-	} else {
-		reader = http.NoBody
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, fullURL, reader)
@@ -59,12 +130,28 @@ func (c *Client) Forward(ctx context.Context, backend *models.Backend, method, p
 		return nil, fmt.Errorf("create request: %w", err)
 	}
 
-	req.Header.Set("X-API-KEY", backend.APIKey)
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	switch {
+	case backend.APIKey == "":
+		// Authenticated by the TLS client certificate alone.
+	case c.signRequests:
+		if err := signRequest(req, payload, backend.APIKey); err != nil {
+			return nil, err
+		}
+	default:
+		req.Header.Set("X-API-KEY", backend.APIKey)
+	}
+	if body != nil && contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
-	return c.http.Do(req)
+	client, err := c.clientFor(backend)
+	if err != nil {
+		return nil, err
+	}
+	if !timeout {
+		client = &http.Client{Transport: client.Transport}
+	}
+	return client.Do(req)
 }
 
 func joinURL(base, path string) (string, error) {
@@ -82,6 +169,7 @@ func joinURL(base, path string) (string, error) {
 	if joined.Scheme != "" || joined.Host != "" {
 		return joined.String(), nil
 	}
-	baseURL.Path = strings.TrimRight(baseURL.Path, "/") + path
+	baseURL.Path = strings.TrimRight(baseURL.Path, "/") + joined.Path
+	baseURL.RawQuery = joined.RawQuery
 	return baseURL.String(), nil
 }
@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ufwpanel/frontend/internal/models"
+)
+
+var ErrPinMismatch = errors.New("backend certificate fingerprint does not match pinned value")
+
+// Fingerprint returns the hex SHA-256 of the certificate's SubjectPublicKeyInfo,
+// which stays stable when a backend renews its certificate with the same key.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// PeerFingerprint reports the fingerprint of the leaf certificate presented on
+// the connection that produced resp, or "" for plain HTTP.
+func PeerFingerprint(resp *http.Response) string {
+	if resp == nil || resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return Fingerprint(resp.TLS.PeerCertificates[0])
+}
+
+// NormalizeFingerprint accepts hex with optional colons, spaces or a
+// "sha256:" prefix and returns the lowercase 64-character form.
+func NormalizeFingerprint(raw string) (string, error) {
+	fp := strings.ToLower(strings.TrimSpace(raw))
+	fp = strings.TrimPrefix(fp, "sha256:")
+	fp = strings.NewReplacer(":", "", " ", "").Replace(fp)
+	if len(fp) != sha256.Size*2 {
+		return "", fmt.Errorf("fingerprint must be %d hex characters", sha256.Size*2)
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", fmt.Errorf("fingerprint is not valid hex")
+	}
+	return fp, nil
+}
+
+func verifyPin(expected string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if expected == "" {
+			return nil
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return ErrPinMismatch
+		}
+		if Fingerprint(cs.PeerCertificates[0]) != expected {
+			return ErrPinMismatch
+		}
+		return nil
+	}
+}
+
+// Probe performs a bare TLS handshake with the backend, without enforcing any
+// pin, and returns the fingerprint it presents. Used for explicit re-pinning.
+// The backend's client certificate, if any, is presented so that backends
+// requiring mutual TLS complete the handshake.
+func (c *Client) Probe(ctx context.Context, backend *models.Backend) (string, error) {
+	if backend == nil {
+		return "", fmt.Errorf("missing backend configuration")
+	}
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid backend URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("backend URL is not https")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if backend.ClientCert != "" {
+		pair, err := tls.X509KeyPair([]byte(backend.ClientCert), []byte(backend.ClientKey))
+		if err != nil {
+			return "", fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return "", fmt.Errorf("tls handshake: %w", err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("backend presented no certificate")
+	}
+	return Fingerprint(state.PeerCertificates[0]), nil
+}
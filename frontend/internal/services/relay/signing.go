@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	headerTimestamp = "X-UFW-Timestamp"
+	headerNonce     = "X-UFW-Nonce"
+	headerSignature = "X-UFW-Signature"
+)
+
+// signRequest attaches an HMAC-SHA256 signature over the method, request URI,
+// timestamp, nonce and body hash. The canonical form must match the backend's
+// signingPayload.
+func signRequest(req *http.Request, body []byte, secret string) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	sum := sha256.Sum256(body)
+	payload := strings.Join([]string{req.Method, req.URL.RequestURI(), timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks a column value encrypted by a sealer. Values without it
+// are legacy plaintext, encrypted by migrateClientKeys.
+const sealedPrefix = "sealed:v1:"
+
+// sealer encrypts secrets kept in the database, such as client private
+// keys, with AES-GCM under a key derived from the app secret. Rotating the
+// app secret makes sealed values unreadable; their client certificates must
+// then be issued again.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret []byte) (*sealer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty app secret")
+	}
+	key := sha256.Sum256(append([]byte("ufwpanel backend client keys\x00"), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) seal(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := s.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (s *sealer) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	n := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt (was JWT_SECRET changed?): %w", err)
+	}
+	return string(plain), nil
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -14,10 +15,17 @@ import (
 )
 
 type BackendRepository struct {
-	db *sql.DB
+	db     *sql.DB
+	sealer *sealer
 }
 
-func NewBackendRepository(dbPath string) (*BackendRepository, error) {
+// NewBackendRepository opens the database. Client private keys are stored
+// encrypted with a key derived from secret.
+func NewBackendRepository(dbPath string, secret []byte) (*BackendRepository, error) {
+	s, err := newSealer(secret)
+	if err != nil {
+		return nil, fmt.Errorf("prepare key encryption: %w", err)
+	}
 	if err := ensureDir(dbPath); err != nil {
 		return nil, fmt.Errorf("prepare db directory: %w", err)
 	}
@@ -33,7 +41,46 @@ func NewBackendRepository(dbPath string) (*BackendRepository, error) {
 		return nil, err
 	}
 
-	return &BackendRepository{db: db}, nil
+	r := &BackendRepository{db: db, sealer: s}
+	if err := r.migrateClientKeys(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// migrateClientKeys encrypts client private keys stored in plaintext by
+// earlier versions.
+func (r *BackendRepository) migrateClientKeys() error {
+	rows, err := r.db.Query(`SELECT id, clientKey FROM backends WHERE clientKey != ''`)
+	if err != nil {
+		return fmt.Errorf("query client keys: %w", err)
+	}
+	plain := map[string]string{}
+	for rows.Next() {
+		var id, key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan client key: %w", err)
+		}
+		if !isSealed(key) {
+			plain[id] = key
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate client keys: %w", err)
+	}
+	for id, key := range plain {
+		sealed, err := r.sealer.seal(key)
+		if err != nil {
+			return fmt.Errorf("encrypt client key of backend %s: %w", id, err)
+		}
+		if _, err := r.db.Exec(`UPDATE backends SET clientKey = ? WHERE id = ?`, sealed, id); err != nil {
+			return fmt.Errorf("encrypt client key of backend %s: %w", id, err)
+		}
+	}
+	return nil
 }
 
 func ensureDir(dbPath string) error {
@@ -56,6 +103,44 @@ func migrate(db *sql.DB) error {
 	if _, err := db.Exec(stmt); err != nil {
 		return fmt.Errorf("create table backends: %w", err)
 	}
+	for _, column := range []string{"certFingerprint", "clientCert", "clientKey"} {
+		if err := addColumnIfMissing(db, "backends", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("scan column info: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate column info: %w", err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -67,7 +152,7 @@ func (r *BackendRepository) Close() error {
 }
 
 func (r *BackendRepository) List(ctx context.Context) ([]models.Backend, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT id, name, url FROM backends ORDER BY createdAt DESC`)
+	rows, err := r.db.QueryContext(ctx, `SELECT id, name, url, certFingerprint, clientCert != '' FROM backends ORDER BY createdAt DESC`)
 	if err != nil {
 		return nil, fmt.Errorf("query backends: %w", err)
 	}
@@ -76,7 +161,7 @@ func (r *BackendRepository) List(ctx context.Context) ([]models.Backend, error)
 	var backends []models.Backend
 	for rows.Next() {
 		var b models.Backend
-		if err := rows.Scan(&b.ID, &b.Name, &b.URL); err != nil {
+		if err := rows.Scan(&b.ID, &b.Name, &b.URL, &b.CertFingerprint, &b.HasClientCert); err != nil {
 			return nil, fmt.Errorf("scan backend: %w", err)
 		}
 		backends = append(backends, b)
@@ -89,22 +174,34 @@ func (r *BackendRepository) List(ctx context.Context) ([]models.Backend, error)
 
 func (r *BackendRepository) Get(ctx context.Context, id string) (*models.Backend, error) {
 	var backend models.Backend
-	err := r.db.QueryRowContext(ctx, `SELECT id, name, url, apiKey FROM backends WHERE id = ?`, id).
-		Scan(&backend.ID, &backend.Name, &backend.URL, &backend.APIKey)
+	err := r.db.QueryRowContext(ctx, `SELECT id, name, url, apiKey, certFingerprint, clientCert, clientKey FROM backends WHERE id = ?`, id).
+		Scan(&backend.ID, &backend.Name, &backend.URL, &backend.APIKey, &backend.CertFingerprint, &backend.ClientCert, &backend.ClientKey)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("get backend %s: %w", id, err)
 	}
+	// A key that no longer decrypts is dropped with its certificate, so the
+	// backend can be enrolled again instead of becoming unusable. The stored
+	// columns are kept: Update does not write them back.
+	if backend.ClientKey, err = r.sealer.open(backend.ClientKey); err != nil {
+		log.Printf("warning: ignoring client certificate of backend %s: client key: %v", id, err)
+		backend.ClientCert, backend.ClientKey = "", ""
+	}
+	backend.HasClientCert = backend.ClientCert != ""
 	return &backend, nil
 }
 
 func (r *BackendRepository) Create(ctx context.Context, backend models.Backend) error {
-	_, err := r.db.ExecContext(
+	clientKey, err := r.sealer.seal(backend.ClientKey)
+	if err != nil {
+		return fmt.Errorf("encrypt client key: %w", err)
+	}
+	_, err = r.db.ExecContext(
 		ctx,
-		`INSERT INTO backends (id, name, url, apiKey) VALUES (?, ?, ?, ?)`,
-		backend.ID, backend.Name, backend.URL, backend.APIKey,
+		`INSERT INTO backends (id, name, url, apiKey, certFingerprint, clientCert, clientKey) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		backend.ID, backend.Name, backend.URL, backend.APIKey, backend.CertFingerprint, backend.ClientCert, clientKey,
 	)
 	if err != nil {
 		return fmt.Errorf("insert backend: %w", err)
@@ -124,14 +221,48 @@ func (r *BackendRepository) Delete(ctx context.Context, id string) (bool, error)
 	return affected > 0, nil
 }
 
+// Update saves the backend's settings. The client certificate and key are
+// left alone; SetClientCert changes them.
 func (r *BackendRepository) Update(ctx context.Context, backend models.Backend) error {
 	_, err := r.db.ExecContext(
 		ctx,
-		`UPDATE backends SET name = ?, url = ?, apiKey = ? WHERE id = ?`,
-		backend.Name, backend.URL, backend.APIKey, backend.ID,
+		`UPDATE backends SET name = ?, url = ?, apiKey = ?, certFingerprint = ? WHERE id = ?`,
+		backend.Name, backend.URL, backend.APIKey, backend.CertFingerprint, backend.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("update backend %s: %w", backend.ID, err)
 	}
 	return nil
 }
+
+// SetClientCert replaces the backend's client certificate and key, or
+// removes them if both are empty.
+func (r *BackendRepository) SetClientCert(ctx context.Context, id, cert, key string) error {
+	clientKey, err := r.sealer.seal(key)
+	if err != nil {
+		return fmt.Errorf("encrypt client key: %w", err)
+	}
+	_, err = r.db.ExecContext(ctx, `UPDATE backends SET clientCert = ?, clientKey = ? WHERE id = ?`, cert, clientKey, id)
+	if err != nil {
+		return fmt.Errorf("update client certificate of backend %s: %w", id, err)
+	}
+	return nil
+}
+
+// PinCertificate records a trust-on-first-use fingerprint. It only succeeds
+// while no pin is stored, so a concurrent manual pin is never overwritten.
+func (r *BackendRepository) PinCertificate(ctx context.Context, id, fingerprint string) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		`UPDATE backends SET certFingerprint = ? WHERE id = ? AND certFingerprint = ''`,
+		fingerprint, id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("pin backend %s: %w", id, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %w", err)
+	}
+	return affected > 0, nil
+}
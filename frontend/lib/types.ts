@@ -4,4 +4,5 @@ export interface BackendConfig {
   name: string;
   url: string;
   apiKey?: string; 
+  certFingerprint?: string;
 }